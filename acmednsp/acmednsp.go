@@ -0,0 +1,327 @@
+// Package acmednsp provides a joohoi/acme-dns client that satisfies
+// autocertdns.Provisioner and autocertdns.ProvisionerV2.
+//
+// Each domain is registered with the acme-dns server on first use, and the
+// returned account credentials and full domain are persisted to a JSON
+// storage file compatible with certbot's acme-dns-auth hook. The challenge
+// name for the domain (_acme-challenge.<domain>) must then be delegated to the
+// account's full domain with a CNAME record:
+//
+//	_acme-challenge.example.com. CNAME 8e5700ea-a4bf-41c7-8a77-e990661dcc6a.auth.acme-dns.io.
+//
+// Provisioning fails with a *CNAMERequiredError for newly registered domains,
+// and, when the Client has a propagation checker, for domains whose CNAME is
+// missing.
+package acmednsp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/brankas/autocertdns/internal/atomicfile"
+	"github.com/brankas/autocertdns/propagation"
+	"github.com/brankas/autocertdns/provision"
+)
+
+const (
+	// allowedRecordType is the allowed record provisioning type.
+	allowedRecordType = "TXT"
+
+	// DefaultBaseURL is the default acme-dns server.
+	DefaultBaseURL = "https://auth.acme-dns.io"
+)
+
+// Account is an acme-dns account.
+type Account struct {
+	Username   string   `json:"username"`
+	Password   string   `json:"password"`
+	FullDomain string   `json:"fulldomain"`
+	SubDomain  string   `json:"subdomain"`
+	AllowFrom  []string `json:"allowfrom"`
+}
+
+// CNAMERequiredError is the error returned when the challenge name for a
+// domain needs to be delegated to the acme-dns account's full domain.
+type CNAMERequiredError struct {
+	Domain string
+	Name   string
+	Target string
+}
+
+// Error satisfies the error interface.
+func (err *CNAMERequiredError) Error() string {
+	return fmt.Sprintf("create the record %s CNAME %s. for %s", err.Name, err.Target, err.Domain)
+}
+
+// record is a handle to a provisioned record.
+type record struct {
+	domain string
+	value  string
+}
+
+// Client is an acme-dns client.
+type Client struct {
+	client    *http.Client
+	baseURL   string
+	storage   string
+	allowFrom []string
+	checker   *propagation.Checker
+	logf      func(string, ...interface{})
+	errf      func(string, ...interface{})
+
+	// accounts are the registered accounts, keyed by domain.
+	accounts map[string]*Account
+	mu       sync.Mutex
+}
+
+// New creates an acme-dns client that can handle DNS provisioning requests
+// for use with the autocertdns.Manager.
+func New(opts ...Option) (*Client, error) {
+	c := &Client{
+		client:   http.DefaultClient,
+		baseURL:  DefaultBaseURL,
+		accounts: make(map[string]*Account),
+		logf:     func(string, ...interface{}) {},
+	}
+
+	// apply opts
+	for _, o := range opts {
+		if err := o(c); err != nil {
+			return nil, err
+		}
+	}
+
+	// ensure errf is set
+	if c.errf == nil {
+		c.errf = func(s string, v ...interface{}) {
+			c.logf("ERROR: "+s, v...)
+		}
+	}
+
+	if c.storage == "" {
+		return nil, errors.New("acmednsp missing storage file")
+	}
+	c.baseURL = strings.TrimSuffix(c.baseURL, "/")
+
+	// load accounts
+	buf, err := ioutil.ReadFile(c.storage)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	default:
+		if err = json.Unmarshal(buf, &c.accounts); err != nil {
+			return nil, fmt.Errorf("could not load %s: %w", c.storage, err)
+		}
+	}
+
+	return c, nil
+}
+
+// Register registers an acme-dns account for the domain, unless already
+// registered, returning the account. The account's full domain is the target
+// for the CNAME record delegating the domain's challenge name.
+func (c *Client) Register(ctxt context.Context, domain string) (*Account, error) {
+	a, _, err := c.account(ctxt, domain)
+	return a, err
+}
+
+// account returns the account for the domain, registering a new account when
+// none exists. Returns true when the account was registered.
+func (c *Client) account(ctxt context.Context, domain string) (*Account, bool, error) {
+	domain = normalize(domain)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if a, ok := c.accounts[domain]; ok {
+		return a, false, nil
+	}
+
+	// register
+	c.logf("registering acme-dns account for %s", domain)
+	var body interface{}
+	if len(c.allowFrom) != 0 {
+		body = map[string][]string{"allowfrom": c.allowFrom}
+	}
+	a := new(Account)
+	if err := c.do(ctxt, "/register", nil, body, a); err != nil {
+		c.errf("could not register acme-dns account for %s: %v", domain, err)
+		return nil, false, err
+	}
+
+	// persist, before caching the account, so that an account that could not
+	// be saved is not used
+	accounts := make(map[string]*Account, len(c.accounts)+1)
+	for k, v := range c.accounts {
+		accounts[k] = v
+	}
+	accounts[domain] = a
+	buf, err := json.MarshalIndent(accounts, "", "  ")
+	if err != nil {
+		return nil, false, err
+	}
+	if err = atomicfile.WriteFile(c.storage, buf, 0600); err != nil {
+		c.errf("could not save acme-dns accounts: %v", err)
+		return nil, false, err
+	}
+	c.accounts[domain] = a
+
+	c.logf("registered acme-dns account for %s: create the record _acme-challenge.%s CNAME %s.", domain, domain, a.FullDomain)
+	return a, true, nil
+}
+
+// Provision updates the TXT value of the acme-dns account for the domain name.
+func (c *Client) Provision(ctxt context.Context, typ, name, token string) error {
+	_, err := c.ProvisionRecords(ctxt, []provision.Challenge{{Type: typ, Name: name, Value: token}})
+	return err
+}
+
+// Unprovision satisfies the autocertdns.Provisioner interface.
+//
+// acme-dns does not support deleting TXT values, which are instead rotated by
+// later updates, so Unprovision does nothing.
+func (c *Client) Unprovision(ctxt context.Context, typ, name, token string) error {
+	if typ != allowedRecordType {
+		return errors.New("only TXT records are supported")
+	}
+	return nil
+}
+
+// ProvisionRecords updates the TXT values of the acme-dns accounts for the
+// challenges' domains, registering accounts as needed.
+//
+// The domain of a challenge is its Domain, or, when not set, is derived from
+// its Name by removing the _acme-challenge label. acme-dns keeps the two most
+// recent values for each account, allowing a domain and its wildcard to be
+// validated together.
+func (c *Client) ProvisionRecords(ctxt context.Context, challenges []provision.Challenge) ([]provision.Record, error) {
+	var records []provision.Record
+	for _, ch := range challenges {
+		if ch.Type != allowedRecordType {
+			return records, errors.New("only TXT records are supported")
+		}
+		domain := ch.Domain
+		if domain == "" {
+			domain = strings.TrimPrefix(normalize(ch.Name), "_acme-challenge.")
+		}
+		domain = normalize(domain)
+
+		// get account
+		a, registered, err := c.account(ctxt, domain)
+		if err != nil {
+			return records, err
+		}
+		cnameErr := &CNAMERequiredError{
+			Domain: domain,
+			Name:   "_acme-challenge." + domain,
+			Target: strings.TrimSuffix(a.FullDomain, "."),
+		}
+		if registered {
+			return records, cnameErr
+		}
+
+		// verify delegation
+		if c.checker != nil {
+			target, err := c.checker.Target(ctxt, cnameErr.Name)
+			if err != nil {
+				return records, err
+			}
+			if !strings.EqualFold(strings.TrimSuffix(target, "."), cnameErr.Target) {
+				c.errf("%v", cnameErr)
+				return records, cnameErr
+			}
+		}
+
+		// update
+		c.logf("provisioning (type: %s, name: %s, token: %s)", ch.Type, a.FullDomain, ch.Value)
+		header := http.Header{"X-Api-User": {a.Username}, "X-Api-Key": {a.Password}}
+		if err = c.do(ctxt, "/update", header, map[string]string{
+			"subdomain": a.SubDomain,
+			"txt":       ch.Value,
+		}, nil); err != nil {
+			c.errf("unable to provision (type: %s, name: %s, token: %s): %v", ch.Type, a.FullDomain, ch.Value, err)
+			return records, err
+		}
+		records = append(records, &record{domain: domain, value: ch.Value})
+	}
+	return records, nil
+}
+
+// UnprovisionRecords satisfies the autocertdns.ProvisionerV2 interface.
+//
+// acme-dns does not support deleting TXT values, so UnprovisionRecords does
+// nothing.
+func (c *Client) UnprovisionRecords(ctxt context.Context, records []provision.Record) error {
+	for _, rec := range records {
+		if _, ok := rec.(*record); !ok {
+			return provision.ErrUnknownRecord
+		}
+	}
+	return nil
+}
+
+// WaitsForPropagation satisfies the autocertdns.ProvisionerV2 interface.
+//
+// acme-dns serves updated values immediately, so always returns true.
+func (c *Client) WaitsForPropagation() bool {
+	return true
+}
+
+// do posts body to the acme-dns API, decoding the response into v.
+func (c *Client) do(ctxt context.Context, path string, header http.Header, body, v interface{}) error {
+	var r io.Reader = http.NoBody
+	if body != nil {
+		buf, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(buf)
+	}
+
+	req, err := http.NewRequest("POST", c.baseURL+path, r)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctxt)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		buf, _ := ioutil.ReadAll(io.LimitReader(res.Body, 4096))
+		if json.Unmarshal(buf, &apiErr) == nil && apiErr.Error != "" {
+			return fmt.Errorf("%s (status %d)", apiErr.Error, res.StatusCode)
+		}
+		return fmt.Errorf("request failed with status %d", res.StatusCode)
+	}
+	if v != nil {
+		return json.NewDecoder(res.Body).Decode(v)
+	}
+	return nil
+}
+
+// normalize lowercases the domain, and removes any wildcard label and trailing
+// dot.
+func normalize(domain string) string {
+	return strings.ToLower(strings.TrimPrefix(strings.TrimSuffix(domain, "."), "*."))
+}
@@ -0,0 +1,144 @@
+package acmednsp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/brankas/autocertdns/provision"
+)
+
+func TestProvision(t *testing.T) {
+	s := newStandIn(t)
+	storage := filepath.Join(t.TempDir(), "acmedns.json")
+
+	c, err := New(BaseURL(s.url), Storage(storage))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	// new registration requires cname
+	challenges := []provision.Challenge{
+		{Domain: "*.example.com", Name: "_acme-challenge.example.com", Type: "TXT", Value: "a"},
+		{Domain: "example.com", Name: "_acme-challenge.example.com", Type: "TXT", Value: "b"},
+	}
+	_, err = c.ProvisionRecords(context.Background(), challenges)
+	var cnameErr *CNAMERequiredError
+	if !errors.As(err, &cnameErr) {
+		t.Fatalf("expected CNAMERequiredError, got: %v", err)
+	}
+	if cnameErr.Name != "_acme-challenge.example.com" || cnameErr.Target != "sub1.auth.example.net" {
+		t.Errorf("unexpected cname: %s -> %s", cnameErr.Name, cnameErr.Target)
+	}
+
+	// credentials are persisted
+	if c, err = New(BaseURL(s.url), Storage(storage)); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	records, err := c.ProvisionRecords(context.Background(), challenges)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err = c.UnprovisionRecords(context.Background(), records); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if s.registrations != 1 {
+		t.Errorf("expected 1 registration, got: %d", s.registrations)
+	}
+	if len(s.txt["sub1"]) != 2 || s.txt["sub1"][0] != "a" || s.txt["sub1"][1] != "b" {
+		t.Errorf("expected a and b, got: %v", s.txt["sub1"])
+	}
+}
+
+func TestPersistFailure(t *testing.T) {
+	s := newStandIn(t)
+	storage := filepath.Join(t.TempDir(), "missing", "acmedns.json")
+
+	c, err := New(BaseURL(s.url), Storage(storage))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	// account that could not be saved is not used
+	challenges := []provision.Challenge{
+		{Domain: "example.com", Name: "_acme-challenge.example.com", Type: "TXT", Value: "a"},
+	}
+	for i := 0; i < 2; i++ {
+		_, err = c.ProvisionRecords(context.Background(), challenges)
+		var cnameErr *CNAMERequiredError
+		if err == nil || errors.As(err, &cnameErr) {
+			t.Errorf("test %d expected save error, got: %v", i, err)
+		}
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if s.registrations != 2 {
+		t.Errorf("expected 2 registrations, got: %d", s.registrations)
+	}
+}
+
+// standIn is a local stand-in for an acme-dns server.
+type standIn struct {
+	url           string
+	accounts      map[string]Account
+	txt           map[string][]string
+	registrations int
+	sync.Mutex
+}
+
+// newStandIn starts an acme-dns stand-in.
+func newStandIn(t *testing.T) *standIn {
+	s := &standIn{accounts: make(map[string]Account), txt: make(map[string][]string)}
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+	s.url = ts.URL
+	return s
+}
+
+func (s *standIn) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	switch req.URL.Path {
+	case "/register":
+		s.registrations++
+		a := Account{
+			Username:   "user1",
+			Password:   "pass1",
+			FullDomain: "sub1.auth.example.net",
+			SubDomain:  "sub1",
+		}
+		s.accounts[a.Username] = a
+		res.WriteHeader(http.StatusCreated)
+		json.NewEncoder(res).Encode(a)
+	case "/update":
+		a, ok := s.accounts[req.Header.Get("X-Api-User")]
+		if !ok || a.Password != req.Header.Get("X-Api-Key") {
+			res.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(res).Encode(map[string]string{"error": "forbidden"})
+			return
+		}
+		var v struct {
+			SubDomain string `json:"subdomain"`
+			TXT       string `json:"txt"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&v); err != nil || v.SubDomain != a.SubDomain {
+			res.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(res).Encode(map[string]string{"error": "bad_subdomain"})
+			return
+		}
+		s.txt[v.SubDomain] = append(s.txt[v.SubDomain], v.TXT)
+		json.NewEncoder(res).Encode(map[string]string{"txt": v.TXT})
+	default:
+		http.NotFound(res, req)
+	}
+}
@@ -0,0 +1,71 @@
+package acmednsp
+
+import (
+	"net/http"
+
+	"github.com/brankas/autocertdns/propagation"
+)
+
+// Option is the Client option type.
+type Option func(c *Client) error
+
+// BaseURL is a Client option to set the acme-dns server URL.
+//
+// If not set, DefaultBaseURL is used.
+func BaseURL(baseURL string) Option {
+	return func(c *Client) error {
+		c.baseURL = baseURL
+		return nil
+	}
+}
+
+// Storage is a Client option to set the JSON file the registered accounts
+// are persisted to.
+func Storage(path string) Option {
+	return func(c *Client) error {
+		c.storage = path
+		return nil
+	}
+}
+
+// AllowFrom is a Client option to restrict updates for newly registered
+// accounts to the CIDR ranges.
+func AllowFrom(cidrs ...string) Option {
+	return func(c *Client) error {
+		c.allowFrom = cidrs
+		return nil
+	}
+}
+
+// HTTPClient is a Client option that sets the http.Client used.
+func HTTPClient(client *http.Client) Option {
+	return func(c *Client) error {
+		c.client = client
+		return nil
+	}
+}
+
+// Checker is a Client option to set the propagation checker used to verify
+// that challenge names are delegated to the acme-dns accounts.
+func Checker(checker *propagation.Checker) Option {
+	return func(c *Client) error {
+		c.checker = checker
+		return nil
+	}
+}
+
+// Logf is a Client option to specify the logging function used.
+func Logf(f func(string, ...interface{})) Option {
+	return func(c *Client) error {
+		c.logf = f
+		return nil
+	}
+}
+
+// Errorf is a Client option to specify the error logging function used.
+func Errorf(f func(string, ...interface{})) Option {
+	return func(c *Client) error {
+		c.errf = f
+		return nil
+	}
+}
@@ -7,7 +7,6 @@ import (
 	"context"
 	"crypto"
 	"crypto/ecdsa"
-	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
@@ -25,6 +24,9 @@ import (
 
 	"github.com/kenshaw/pemutil"
 	"golang.org/x/crypto/acme"
+
+	"github.com/brankas/autocertdns/propagation"
+	"github.com/brankas/autocertdns/provision"
 )
 
 const (
@@ -41,6 +43,9 @@ const (
 	// certSuffix is the filename suffix for cached certificate files.
 	certSuffix = ".crt"
 
+	// retryDelay is the delay before retrying a failed renewal.
+	retryDelay = 5 * time.Minute
+
 	// LetsEncryptURL is the default ACME server URL.
 	LetsEncryptURL = acme.LetsEncryptURL
 
@@ -83,8 +88,15 @@ const (
 	ErrUnknownPublicKeyAlgorithm Error = "unknown public key algorithm"
 )
 
+// ErrUnknownRecord is the unknown record error, returned when a provisioner is
+// passed a record handle it did not create.
+const ErrUnknownRecord = provision.ErrUnknownRecord
+
 // Provisioner is the shared interface for providers that can provision DNS
 // records.
+//
+// Provisioners may additionally implement the extended ProvisionerV2
+// interface.
 type Provisioner interface {
 	// Provision provisions a DNS entry of typ (always TXT), for the FQDN name
 	// and with the provided token.
@@ -95,6 +107,15 @@ type Provisioner interface {
 	Unprovision(ctxt context.Context, typ, name, token string) error
 }
 
+// Exporter is the shared interface for exporters that write issued
+// certificates to other locations or formats.
+type Exporter interface {
+	// Export exports the certificate for domain. Export is called each time
+	// the Manager's certificate is loaded, renewed or reloaded, and should
+	// not rewrite an already exported certificate.
+	Export(ctxt context.Context, domain string, cert *tls.Certificate) error
+}
+
 // Manager holds information related to managing a DNS-01 based ACME autocert
 // provider.
 type Manager struct {
@@ -119,16 +140,65 @@ type Manager struct {
 	// If zero, certificates will be renewed 5 days before expiration.
 	RenewBefore time.Duration
 
+	// NonBlocking, when true, causes Run to return immediately, with the
+	// certificate being loaded or issued in the background.
+	//
+	// Until a valid certificate is available, GetCertificate returns a stale
+	// cached certificate or, when no cached certificate is available, a
+	// self-signed placeholder certificate.
+	NonBlocking bool
+
 	// Provisioner is the DNS provisioner used to provision and unprovision the
 	// DNS-01 challenges given by the ACME server.
 	Provisioner Provisioner
 
+	// FollowCNAME, when true, provisions the DNS-01 challenges at the target of
+	// any CNAME record for _acme-challenge.<domain>, allowing challenges to be
+	// delegated to a separate zone (ie, the acme-dns delegation pattern).
+	FollowCNAME bool
+
+	// DelegateProvisioner is the DNS provisioner used to provision and
+	// unprovision DNS-01 challenges that have been delegated via a CNAME
+	// record, when FollowCNAME is true.
+	//
+	// If nil, Provisioner is used.
+	DelegateProvisioner Provisioner
+
+	// PropagationChecker is the propagation checker used to wait for the
+	// provisioned DNS-01 challenges to propagate before accepting the
+	// challenges.
+	//
+	// If nil, the Manager does not wait for propagation, and relies on the
+	// Provisioner to wait for propagation.
+	PropagationChecker *propagation.Checker
+
+	// Exporters are the exporters used to export the certificate after it has
+	// been loaded, renewed or reloaded.
+	Exporters []Exporter
+
 	// Logf is a logging func.
 	Logf func(string, ...interface{})
 
 	// Errorf is an error logging func.
 	Errorf func(string, ...interface{})
 
+	// DisableWatch disables watching the cached certificate and key files for
+	// changes made outside of the Manager.
+	DisableWatch bool
+
+	// RedirectAddr is the address that ListenAndServeTLS listens on for plain
+	// HTTP requests, redirecting all requests to HTTPS.
+	//
+	// If empty, no redirect listener is started.
+	RedirectAddr string
+
+	// WatchInterval is the interval used to poll the cached certificate and
+	// key files for changes, when file system notifications are not
+	// available.
+	//
+	// If zero, the cache will be polled every 30 seconds.
+	WatchInterval time.Duration
+
 	// cert is the current certificate.
 	cert *tls.Certificate
 
@@ -154,18 +224,26 @@ func (m *Manager) errf(s string, v ...interface{}) error {
 	if m.Errorf == nil {
 		m.log("ERROR: %v", err)
 	} else {
-		m.Errorf(s, v)
+		m.Errorf(s, v...)
 	}
 	return err
 }
 
 // loadOrRenew will attempt to load a certificate from the directory in
-// Manager.DirCache, if that fails then an attempt will be made to create/renew
-// a certificate based on the Manager configuration.
+// Manager.DirCache, if that fails (or if the loaded certificate is due for
+// renewal) then an attempt will be made to create/renew a certificate based on
+// the Manager configuration.
+//
+// A cached certificate and key that are corrupt or do not match are moved
+// aside before renewing.
 func (m *Manager) loadOrRenew(ctxt context.Context) error {
-	if err := m.load(); err == nil {
+	err := m.load()
+	if err == nil && !m.needsRenewal() {
 		return nil
 	}
+	if isCorrupt(err) {
+		m.moveAside(strings.TrimSuffix(m.Domain, "."), err)
+	}
 	return m.renew(ctxt)
 }
 
@@ -178,14 +256,100 @@ func (m *Manager) load() error {
 
 	domain := strings.TrimSuffix(m.Domain, ".")
 
-	certKey, err := m.cachedKey(domain + keySuffix)
+	// complete any interrupted write of the certificate and key
+	if err := m.recoverPair(domain); err != nil {
+		m.errf("could not recover pending certificate and key for %s: %v", domain, err)
+	}
+
+	cert, err := m.readCert(domain)
 	if err != nil {
 		return err
 	}
 
+	m.setCert(cert)
+
+	return nil
+}
+
+// reload reloads the cached certificate on disk, replacing the current
+// certificate only when the cached certificate and key are a valid pair.
+func (m *Manager) reload() error {
+	domain := strings.TrimSuffix(m.Domain, ".")
+
+	cert, err := m.readCert(domain)
+	if err != nil {
+		return m.errf("could not reload certificate for %s: %v", domain, err)
+	}
+
+	m.rw.Lock()
+	defer m.rw.Unlock()
+
+	if m.cert != nil && bytes.Equal(m.cert.Certificate[0], cert.Certificate[0]) {
+		return nil
+	}
+
+	m.log("reloaded certificate (domain: %s, expires: %s)", domain, cert.Leaf.NotAfter.Format(time.RFC3339))
+	m.setCert(cert)
+
+	return nil
+}
+
+// readCert reads the cached certificate and key on disk for domain, verifying
+// that the certificate is valid for domain and that the certificate and key
+// are a matching pair.
+func (m *Manager) readCert(domain string) (*tls.Certificate, error) {
+	der, certKey, err := m.readPair(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	leaf, err := parseCert(domain, der, certKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{
+		Certificate: der,
+		Leaf:        leaf,
+		PrivateKey:  certKey,
+	}, nil
+}
+
+// readStaleCert reads the cached certificate and key on disk for domain,
+// verifying that the certificate is for domain and that the certificate and
+// key are a matching pair, but ignoring the certificate's validity period.
+func (m *Manager) readStaleCert(domain string) (*tls.Certificate, error) {
+	der, certKey, err := m.readPair(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	leaf, err := parseLeaf(der)
+	if err != nil {
+		return nil, err
+	}
+	if err = verifyLeaf(domain, leaf, certKey); err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{
+		Certificate: der,
+		Leaf:        leaf,
+		PrivateKey:  certKey,
+	}, nil
+}
+
+// readPair reads the cached certificate chain and key on disk for domain,
+// decoding the PEM encoded CERTIFICATE blocks.
+func (m *Manager) readPair(domain string) ([][]byte, *ecdsa.PrivateKey, error) {
+	certKey, err := m.readKey(domain + keySuffix)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	buf, err := ioutil.ReadFile(filepath.Join(m.CacheDir, domain+certSuffix))
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
 	var b *pem.Block
@@ -196,7 +360,7 @@ func (m *Manager) load() error {
 			break
 		}
 		if b.Type != "CERTIFICATE" {
-			return ErrInvalidCertificate
+			return nil, nil, ErrInvalidCertificate
 		}
 		der = append(der, b.Bytes)
 		if buf == nil {
@@ -204,32 +368,38 @@ func (m *Manager) load() error {
 		}
 	}
 	if len(der) == 0 {
-		return ErrInvalidCertificate
+		return nil, nil, ErrInvalidCertificate
 	}
 
-	leaf, err := parseCert(domain, der, certKey)
-	if err != nil {
-		return err
-	}
+	return der, certKey, nil
+}
 
-	if time.Now().After(leaf.NotAfter) {
-		return ErrCertificateExpired
+// setCert sets the current certificate, and schedules the next renewal based
+// on the certificate's expiration. The caller must hold the write lock.
+func (m *Manager) setCert(cert *tls.Certificate) {
+	renewBefore := m.RenewBefore
+	if renewBefore == 0 {
+		renewBefore = 5 * 24 * time.Hour
 	}
 
-	m.cert = &tls.Certificate{
-		Certificate: der,
-		Leaf:        leaf,
-		PrivateKey:  certKey,
-	}
+	m.cert = cert
+	m.nextExpiry = cert.Leaf.NotAfter.Add(-renewBefore)
+}
 
-	return nil
+// needsRenewal returns true when the current certificate is due for renewal.
+func (m *Manager) needsRenewal() bool {
+	m.rw.RLock()
+	defer m.rw.RUnlock()
+
+	return !time.Now().Before(m.nextExpiry)
 }
 
 // renew renews the certificate using the provided context.
+//
+// The ACME and DNS provisioning work is done without holding the Manager's
+// lock, so that GetCertificate continues to return the current (or fallback)
+// certificate while the certificate is being issued.
 func (m *Manager) renew(ctxt context.Context) error {
-	m.rw.Lock()
-	defer m.rw.Unlock()
-
 	var err error
 
 	if m.Email == "" {
@@ -268,6 +438,12 @@ func (m *Manager) renew(ctxt context.Context) error {
 		return m.errf("could not register with ACME server: %v", err)
 	}
 
+	// account key thumbprint, used for the key authorization
+	thumbprint, err := acme.JWKThumbprint(key.Public())
+	if err != nil {
+		return m.errf("could not generate ACME account key thumbprint: %v", err)
+	}
+
 	// normalize domain name
 	domain := strings.TrimSuffix(m.Domain, ".")
 
@@ -295,12 +471,34 @@ func (m *Manager) renew(ctxt context.Context) error {
 		return m.errf("could not generate token for ACME challenge: %v", err)
 	}
 
+	// determine where to provision the challenge
+	name, provisioner, err := m.challengeTarget(ctxt, acmeChallengeDomainPrefix+domain)
+	if err != nil {
+		return m.errf("could not determine dns-01 challenge name: %v", err)
+	}
+
 	// provision TXT under _acme-challenge.<domain>
-	err = m.Provisioner.Provision(ctxt, "TXT", acmeChallengeDomainPrefix+domain, tok)
+	p := AsProvisionerV2(provisioner)
+	records, err := p.ProvisionRecords(ctxt, []provision.Challenge{{
+		Domain:  domain,
+		Name:    name,
+		Type:    "TXT",
+		Value:   tok,
+		Token:   challenge.Token,
+		KeyAuth: challenge.Token + "." + thumbprint,
+	}})
+	defer p.UnprovisionRecords(ctxt, records)
 	if err != nil {
 		return m.errf("could not provision dns-01 TXT challenge: %v", err)
 	}
-	defer m.Provisioner.Unprovision(ctxt, "TXT", acmeChallengeDomainPrefix+domain, tok)
+
+	// wait for propagation
+	if !p.WaitsForPropagation() && m.PropagationChecker != nil {
+		err = m.PropagationChecker.Wait(ctxt, name, tok)
+		if err != nil {
+			return m.errf("dns-01 TXT challenge did not propagate: %v", err)
+		}
+	}
 
 	// accept challenge
 	_, err = client.Accept(ctxt, challenge)
@@ -316,8 +514,12 @@ func (m *Manager) renew(ctxt context.Context) error {
 		return m.errf("dns-01 challenge is invalid (has status %v)", authz.Status)
 	}
 
-	// grab domain key
-	certKey, err := m.cachedKey(domain + keySuffix)
+	// grab domain key, generating a new key if one is not cached. a new key
+	// is only written to disk together with the issued certificate.
+	certKey, err := m.readKey(domain + keySuffix)
+	if err != nil && os.IsNotExist(err) {
+		certKey, err = generateKey()
+	}
 	if err != nil {
 		return m.errf("could not load domain key: %v", err)
 	}
@@ -349,116 +551,160 @@ func (m *Manager) renew(ctxt context.Context) error {
 		}
 	}
 
-	// cache certificate
-	certPath := filepath.Join(m.CacheDir, domain+certSuffix)
-	err = ioutil.WriteFile(certPath, buf.Bytes(), 0600)
-	if err != nil {
-		return m.errf("could not write to %s: %v", certPath, err)
+	// cache certificate and key
+	m.rw.Lock()
+	defer m.rw.Unlock()
+	if err = m.writePair(domain, certKey, buf.Bytes()); err != nil {
+		return m.errf("could not cache certificate and key for %s: %v", domain, err)
 	}
 
 	m.log("created certificate (domain: %s, url: %s, expires: %s)", domain, urlstr, leaf.NotAfter.Format(time.RFC3339))
-	m.cert = &tls.Certificate{
+	m.setCert(&tls.Certificate{
 		Certificate: der,
 		Leaf:        leaf,
 		PrivateKey:  certKey,
-	}
+	})
 
 	return nil
 }
 
-// cachedKey retrieves a private key from disk, generating a new elliptic.P256
-// key if the file is not on disk.
-func (m *Manager) cachedKey(filename string) (*ecdsa.PrivateKey, error) {
-	keyfile := filepath.Join(m.CacheDir, filename)
+// challengeTarget returns the name and provisioner to use for the challenge
+// name, following any CNAME for name when FollowCNAME is true.
+func (m *Manager) challengeTarget(ctxt context.Context, name string) (string, Provisioner, error) {
+	if !m.FollowCNAME {
+		return name, m.Provisioner, nil
+	}
 
-	// try to load cached credentials
-	store, err := pemutil.LoadFile(keyfile)
-	if err != nil && os.IsNotExist(err) {
-		store, err = pemutil.GenerateECKeySet(elliptic.P256())
-		if err != nil {
-			return nil, fmt.Errorf("could not generate ec key set: %v", err)
-		}
-		err = os.MkdirAll(m.CacheDir, 0700)
-		if err != nil {
-			return nil, fmt.Errorf("could not create cache directory: %v", err)
+	checker := m.PropagationChecker
+	if checker == nil {
+		var err error
+		if checker, err = propagation.New(propagation.Logf(m.log)); err != nil {
+			return "", nil, err
 		}
-		err = store.WriteFile(keyfile)
-		if err != nil {
-			return nil, fmt.Errorf("could not save PEM: %v", err)
-		}
-	} else if err != nil {
-		return nil, fmt.Errorf("unexpected error: %v", err)
 	}
 
-	// grab key
-	key, ok := store.ECPrivateKey()
-	if !ok {
-		return nil, fmt.Errorf("%s does not contain ec private key", keyfile)
+	target, err := checker.Target(ctxt, name)
+	if err != nil {
+		return "", nil, err
 	}
-
-	return key, nil
-}
-
-// cachedCert retrieves the certificate on disk for domain, and extracting the
-// expiry date.
-func (m *Manager) cachedCert(domain string) (crypto.Signer, time.Time, error) {
-	certPath := filepath.Join(m.CacheDir, domain+certSuffix)
-	store, err := pemutil.LoadFile(certPath)
-	if err != nil && !os.IsNotExist(err) {
-		return nil, time.Time{}, err
+	target = strings.TrimSuffix(target, ".")
+	if strings.EqualFold(target, name) {
+		return name, m.Provisioner, nil
 	}
 
-	cert, ok := store.Certificate()
-	if !ok {
-		return nil, time.Time{}, fmt.Errorf("%s does not contain a certificate", certPath)
+	m.log("challenge %s delegated to %s", name, target)
+	if m.DelegateProvisioner != nil {
+		return target, m.DelegateProvisioner, nil
 	}
-
-	// extract signer, time
-	cert = cert
-
-	return nil, time.Time{}, nil
+	return target, m.Provisioner, nil
 }
 
-// afterRenew returns a channel that will be closed after the passing the
-// Manager's next expiration date.
-func (m *Manager) afterRenew() <-chan time.Time {
+// untilRenew returns the duration until the Manager's next expiration date.
+func (m *Manager) untilRenew() time.Duration {
 	m.rw.RLock()
-	exp := m.nextExpiry
-	m.rw.RUnlock()
+	defer m.rw.RUnlock()
 
-	return time.After(exp.Sub(time.Now()))
+	return time.Until(m.nextExpiry)
 }
 
 // Run starts a goroutine to automatically renew a certificate until the passed
-// context has been closed. Will return an error if initially a certificate
-// cannot be issued/renewed and if any cached certificate is expired.
+// context has been closed. Will return an error if no usable certificate is
+// cached and one cannot be issued, unless NonBlocking is set. A cached
+// certificate that is due for renewal is served while it is renewed in the
+// background.
+//
+// Failed renewals are retried every 5 minutes.
+//
+// Unless DisableWatch is set, the cached certificate and key files are watched
+// for changes, and are reloaded when replaced by another process.
 func (m *Manager) Run(ctxt context.Context) error {
-	// manually renew
-	err := m.loadOrRenew(ctxt)
-	if err != nil {
-		return err
+	if m.NonBlocking {
+		// load cached certificate or use fallback certificate
+		if err := m.load(); err != nil {
+			m.fallback()
+		} else {
+			m.export(ctxt)
+		}
+	} else {
+		// load cached certificate, issuing one only when none is usable; a
+		// loaded certificate due for renewal is renewed in the background
+		if err := m.load(); err != nil {
+			if isCorrupt(err) {
+				m.moveAside(strings.TrimSuffix(m.Domain, "."), err)
+			}
+			if err = m.renew(ctxt); err != nil {
+				return err
+			}
+		}
+		m.export(ctxt)
+	}
+
+	// watch cache
+	var changed <-chan struct{}
+	if !m.DisableWatch {
+		changed = m.watch(ctxt)
 	}
 
 	go func() {
+		timer := time.NewTimer(m.untilRenew())
+		defer timer.Stop()
+
 		for {
 			select {
-			case <-m.afterRenew():
-				err = m.loadOrRenew(ctxt)
-				if err != nil {
-					_ = m.errf("cannot renew: %v", err)
-					return
+			case <-timer.C:
+				if err := m.loadOrRenew(ctxt); err != nil {
+					_ = m.errf("cannot renew, retrying in %v: %v", retryDelay, err)
+					m.retryAfter(retryDelay)
+				} else {
+					m.export(ctxt)
+				}
+
+			case <-changed:
+				if m.reload() == nil {
+					m.export(ctxt)
 				}
 
 			case <-ctxt.Done():
 				m.log("context done: %v", ctxt.Err())
 				return
 			}
+
+			// reschedule for the next expiration date
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(m.untilRenew())
 		}
 	}()
 
 	return nil
 }
 
+// retryAfter schedules the next renewal attempt after d.
+func (m *Manager) retryAfter(d time.Duration) {
+	m.rw.Lock()
+	defer m.rw.Unlock()
+
+	m.nextExpiry = time.Now().Add(d)
+}
+
+// export exports the current certificate using the Manager's exporters.
+func (m *Manager) export(ctxt context.Context) {
+	m.rw.RLock()
+	cert := m.cert
+	m.rw.RUnlock()
+
+	domain := strings.TrimSuffix(m.Domain, ".")
+	for _, e := range m.Exporters {
+		if err := e.Export(ctxt, domain, cert); err != nil {
+			_ = m.errf("could not export certificate for %s: %v", domain, err)
+		}
+	}
+}
+
 // GetCertificate returns the current certificate.
 func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
 	m.rw.RLock()
@@ -480,8 +726,29 @@ func AcceptTOS(string) bool {
 // The returned value is the verified leaf cert.
 //
 // adapted from golang.org/x/crypto/acme/autocert.validCert
-func parseCert(domain string, der [][]byte, key crypto.Signer) (leaf *x509.Certificate, err error) {
-	// parse public part(s)
+func parseCert(domain string, der [][]byte, key crypto.Signer) (*x509.Certificate, error) {
+	leaf, err := parseLeaf(der)
+	if err != nil {
+		return nil, err
+	}
+
+	// verify the leaf is not expired and matches the domain name
+	now := time.Now()
+	if now.Before(leaf.NotBefore) {
+		return nil, ErrCertificateNotYetValid
+	}
+	if now.After(leaf.NotAfter) {
+		return nil, ErrCertificateExpired
+	}
+	if err := verifyLeaf(domain, leaf, key); err != nil {
+		return nil, err
+	}
+	return leaf, nil
+}
+
+// parseLeaf parses the public part(s) of a cert chain provided as der,
+// returning the leaf, der[0].
+func parseLeaf(der [][]byte) (*x509.Certificate, error) {
 	var n int
 	for _, b := range der {
 		n += len(b)
@@ -491,21 +758,18 @@ func parseCert(domain string, der [][]byte, key crypto.Signer) (leaf *x509.Certi
 	for _, b := range der {
 		n += copy(pub[n:], b)
 	}
-	x509Cert, err := x509.ParseCertificates(pub)
+	x509Cert, _ := x509.ParseCertificates(pub)
 	if len(x509Cert) == 0 {
 		return nil, ErrNoPublicKeyFound
 	}
-	// verify the leaf is not expired and matches the domain name
-	leaf = x509Cert[0]
-	now := time.Now()
-	if now.Before(leaf.NotBefore) {
-		return nil, ErrCertificateNotYetValid
-	}
-	if now.After(leaf.NotAfter) {
-		return nil, ErrCertificateExpired
-	}
+	return x509Cert[0], nil
+}
+
+// verifyLeaf verifies that leaf matches the domain name, and that leaf
+// corresponds to the private key.
+func verifyLeaf(domain string, leaf *x509.Certificate, key crypto.Signer) error {
 	if err := leaf.VerifyHostname(domain); err != nil {
-		return nil, err
+		return err
 	}
 
 	// ensure the leaf corresponds to the private key
@@ -513,23 +777,23 @@ func parseCert(domain string, der [][]byte, key crypto.Signer) (leaf *x509.Certi
 	case *rsa.PublicKey:
 		prv, ok := key.(*rsa.PrivateKey)
 		if !ok {
-			return nil, ErrPrivateKeyTypeDoesNotMatchPublicKeyType
+			return ErrPrivateKeyTypeDoesNotMatchPublicKeyType
 		}
 		if pub.N.Cmp(prv.N) != 0 {
-			return nil, ErrPrivateKeyDoesNotMatchPublicKey
+			return ErrPrivateKeyDoesNotMatchPublicKey
 		}
 
 	case *ecdsa.PublicKey:
 		prv, ok := key.(*ecdsa.PrivateKey)
 		if !ok {
-			return nil, ErrPrivateKeyTypeDoesNotMatchPublicKeyType
+			return ErrPrivateKeyTypeDoesNotMatchPublicKeyType
 		}
 		if pub.X.Cmp(prv.X) != 0 || pub.Y.Cmp(prv.Y) != 0 {
-			return nil, ErrPrivateKeyDoesNotMatchPublicKey
+			return ErrPrivateKeyDoesNotMatchPublicKey
 		}
 
 	default:
-		return nil, ErrUnknownPublicKeyAlgorithm
+		return ErrUnknownPublicKeyAlgorithm
 	}
-	return leaf, nil
+	return nil
 }
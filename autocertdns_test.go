@@ -3,19 +3,37 @@ package autocertdns
 import (
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/md5"
 	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"fmt"
 	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/kenshaw/pemutil"
+
 	"github.com/brankas/autocertdns/gcdnsp"
 	"github.com/brankas/autocertdns/godop"
 )
 
+// ensure providers satisfy ProvisionerV2.
+var (
+	_ ProvisionerV2 = (*gcdnsp.Client)(nil)
+	_ ProvisionerV2 = (*godop.Client)(nil)
+)
+
 const (
 	gcdnspManagedZone = "dns-ken"
 	gcdnspDomain      = "ken.dev.brank.as"
@@ -135,6 +153,412 @@ func TestRenewGodop(t *testing.T) {
 	}
 }
 
+func TestReload(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "autocertdns")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	const domain = "reload.example.com"
+	m := &Manager{
+		CacheDir: dir,
+		Domain:   domain,
+		Logf:     t.Logf,
+	}
+
+	// initial load
+	if err := writeTestCert(dir, domain, domain, true); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err := m.load(); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	prev, _ := m.GetCertificate(nil)
+
+	// replace with a new valid pair
+	if err := writeTestCert(dir, domain, domain, true); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err := m.reload(); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cur, _ := m.GetCertificate(nil)
+	if cur == prev {
+		t.Fatalf("expected certificate to be replaced")
+	}
+
+	// replace with a mismatched pair
+	if err := writeTestCert(dir, domain, domain, false); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err := m.reload(); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+
+	// replace with a certificate for a different name
+	if err := writeTestCert(dir, domain, "other.example.com", true); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err := m.reload(); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+
+	if c, _ := m.GetCertificate(nil); c != cur {
+		t.Errorf("expected invalid certificates to be rejected")
+	}
+}
+
+func TestRecoverPair(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "autocertdns")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	const domain = "recover.example.com"
+	m := &Manager{
+		CacheDir: dir,
+		Domain:   domain,
+		Logf:     t.Logf,
+	}
+
+	// simulate a crash after the pending key was committed
+	if err := writeTestCert(dir, domain, domain, true); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	certPath := filepath.Join(dir, domain+certSuffix)
+	if err := os.Rename(certPath, certPath+pendingSuffix); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err := m.load(); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if _, err := os.Stat(certPath + pendingSuffix); !os.IsNotExist(err) {
+		t.Errorf("expected pending certificate to be committed, got: %v", err)
+	}
+}
+
+func TestMoveAside(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "autocertdns")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	const domain = "corrupt.example.com"
+	m := &Manager{
+		CacheDir: dir,
+		Domain:   domain,
+		Logf:     t.Logf,
+	}
+
+	if err := writeTestCert(dir, domain, domain, false); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	// renewal fails, as the Manager is not configured for renewal
+	if err := m.loadOrRenew(context.Background()); err == nil {
+		t.Fatalf("expected error, got nil")
+	}
+
+	for _, s := range []string{keySuffix, certSuffix} {
+		if _, err := os.Stat(filepath.Join(dir, domain+s)); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be moved aside, got: %v", domain+s, err)
+		}
+		matches, _ := filepath.Glob(filepath.Join(dir, domain+s+corruptSuffix+".*"))
+		if len(matches) != 1 {
+			t.Errorf("expected 1 moved aside %s, got: %d", domain+s, len(matches))
+		}
+	}
+}
+
+func TestNonBlocking(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "autocertdns")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctxt, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// renewal fails in the background, as the Manager is not configured for
+	// renewal
+	const domain = "nonblocking.example.com"
+	m := &Manager{
+		CacheDir:     dir,
+		Domain:       domain,
+		NonBlocking:  true,
+		DisableWatch: true,
+	}
+	if err := m.Run(ctxt); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	cert, err := m.GetCertificate(nil)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if cert == nil || cert.Leaf == nil {
+		t.Fatalf("expected placeholder certificate")
+	}
+	if err := cert.Leaf.VerifyHostname(domain); err != nil {
+		t.Errorf("expected placeholder certificate for %s, got: %v", domain, err)
+	}
+}
+
+func TestNonBlockingRenewing(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "autocertdns")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// acme server that blocks until released
+	requested, release := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		once.Do(func() { close(requested) })
+		<-release
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer s.Close()
+	defer close(release)
+
+	ctxt, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const domain = "renewing.example.com"
+	m := &Manager{
+		DirectoryURL: s.URL,
+		Prompt:       AcceptTOS,
+		CacheDir:     dir,
+		Email:        "test@example.com",
+		Domain:       domain,
+		NonBlocking:  true,
+		Provisioner:  nopProvisioner{},
+		DisableWatch: true,
+	}
+	if err := m.Run(ctxt); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	// renewal is blocked on the acme server
+	select {
+	case <-requested:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected renewal to contact the ACME server")
+	}
+
+	certc := make(chan *tls.Certificate, 1)
+	go func() {
+		cert, _ := m.GetCertificate(nil)
+		certc <- cert
+	}()
+	select {
+	case cert := <-certc:
+		if cert == nil || cert.Leaf == nil || cert.Leaf.VerifyHostname(domain) != nil {
+			t.Errorf("expected placeholder certificate for %s", domain)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("expected GetCertificate to not block while renewing")
+	}
+}
+
+func TestNonBlockingRetry(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "autocertdns")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctxt, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// renewal fails in the background, as the Manager is not configured for
+	// renewal
+	const domain = "retry.example.com"
+	m := &Manager{
+		CacheDir:     dir,
+		Domain:       domain,
+		NonBlocking:  true,
+		DisableWatch: true,
+	}
+	start := time.Now()
+	if err := m.Run(ctxt); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	// the failed renewal is rescheduled
+	for i := 0; ; i++ {
+		m.rw.RLock()
+		next := m.nextExpiry
+		m.rw.RUnlock()
+		if !next.IsZero() {
+			if next.Before(start.Add(retryDelay)) || next.After(time.Now().Add(retryDelay)) {
+				t.Errorf("expected retry after %v, got: %v", retryDelay, next.Sub(start))
+			}
+			break
+		}
+		if i == 100 {
+			t.Fatalf("expected failed renewal to be retried")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRunRenewalDue(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "autocertdns")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctxt, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the cached certificate is due for renewal, and renewal fails in the
+	// background, as the Manager is not configured for renewal
+	const domain = "due.example.com"
+	if err := writeTestCert(dir, domain, domain, true); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	der, _, err := (&Manager{CacheDir: dir}).readPair(domain)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	m := &Manager{
+		CacheDir:     dir,
+		Domain:       domain,
+		RenewBefore:  48 * time.Hour,
+		DisableWatch: true,
+	}
+	if err := m.Run(ctxt); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	cert, err := m.GetCertificate(nil)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if cert == nil || !bytes.Equal(cert.Certificate[0], der[0]) {
+		t.Errorf("expected cached certificate")
+	}
+}
+
+func TestRetry(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "autocertdns")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctxt, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the cached certificate becomes due for renewal shortly after Run, and
+	// renewal fails, as the Manager is not configured for renewal
+	const domain = "retry.example.com"
+	notAfter := time.Now().Add(24 * time.Hour)
+	if err := writeTestCertExpiring(dir, domain, domain, true, notAfter); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	m := &Manager{
+		CacheDir:     dir,
+		Domain:       domain,
+		RenewBefore:  time.Until(notAfter) - 2*time.Second,
+		DisableWatch: true,
+	}
+	if err := m.Run(ctxt); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	// the failed renewal is rescheduled
+	for i := 0; ; i++ {
+		m.rw.RLock()
+		next := m.nextExpiry
+		m.rw.RUnlock()
+		if time.Until(next) > retryDelay/2 {
+			break
+		}
+		if i == 500 {
+			t.Fatalf("expected failed renewal to be retried")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNonBlockingStale(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "autocertdns")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctxt, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const domain = "stale.example.com"
+	if err := writeTestCertExpiring(dir, domain, domain, true, time.Now().Add(-time.Hour)); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	der, _, err := (&Manager{CacheDir: dir}).readPair(domain)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	m := &Manager{
+		CacheDir:     dir,
+		Domain:       domain,
+		NonBlocking:  true,
+		DisableWatch: true,
+	}
+	if err := m.Run(ctxt); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	cert, err := m.GetCertificate(nil)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if cert == nil || !bytes.Equal(cert.Certificate[0], der[0]) {
+		t.Fatalf("expected stale certificate")
+	}
+	if !cert.Leaf.NotAfter.Before(time.Now()) {
+		t.Errorf("expected stale certificate to be expired")
+	}
+}
+
+// nopProvisioner is a provisioner that does nothing.
+type nopProvisioner struct{}
+
+func (nopProvisioner) Provision(context.Context, string, string, string) error {
+	return nil
+}
+
+func (nopProvisioner) Unprovision(context.Context, string, string, string) error {
+	return nil
+}
+
 // getEnvOrFile checks the specifiied environment variable name, returning its
 // value or loading the data from the filename.
 func getEnvOrFile(name, filename string) (string, error) {
@@ -162,3 +586,41 @@ func randHost() (string, error) {
 	}
 	return fmt.Sprintf("%x", h.Sum(nil)), nil
 }
+
+// writeTestCert writes a self-signed certificate and key for name to the
+// cached certificate and key files for domain in dir. When match is false,
+// the written key does not match the certificate.
+func writeTestCert(dir, domain, name string, match bool) error {
+	return writeTestCertExpiring(dir, domain, name, match, time.Now().Add(24*time.Hour))
+}
+
+// writeTestCertExpiring writes a self-signed certificate and key as with
+// writeTestCert, with the certificate expiring at notAfter.
+func writeTestCertExpiring(dir, domain, name string, match bool, notAfter time.Time) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    notAfter.Add(-48 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, key.Public(), key)
+	if err != nil {
+		return err
+	}
+	if !match {
+		if key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+			return err
+		}
+	}
+	store := pemutil.Store{pemutil.ECPrivateKey: key}
+	if err := store.WriteFile(filepath.Join(dir, domain+keySuffix)); err != nil {
+		return err
+	}
+	buf := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return ioutil.WriteFile(filepath.Join(dir, domain+certSuffix), buf, 0600)
+}
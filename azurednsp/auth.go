@@ -0,0 +1,102 @@
+package azurednsp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+// imdsURL is the Azure Instance Metadata Service token endpoint.
+var imdsURL = "http://169.254.169.254/metadata/identity/oauth2/token"
+
+// resource returns the resource for tokens, the Resource Manager endpoint.
+func (c *Client) resource() string {
+	return c.baseURL + "/"
+}
+
+// clientSecretTokenSource returns a token source for a service principal's
+// client secret.
+func clientSecretTokenSource(tenantID, clientID, secret string) func(*Client) (oauth2.TokenSource, error) {
+	return func(c *Client) (oauth2.TokenSource, error) {
+		config := &clientcredentials.Config{
+			ClientID:     clientID,
+			ClientSecret: secret,
+			TokenURL:     c.authorityURL + "/" + url.PathEscape(tenantID) + "/oauth2/v2.0/token",
+			Scopes:       []string{c.resource() + ".default"},
+		}
+		ctxt := context.Background()
+		if c.client != nil {
+			ctxt = context.WithValue(ctxt, oauth2.HTTPClient, c.client)
+		}
+		return config.TokenSource(ctxt), nil
+	}
+}
+
+// managedIdentityTokenSource returns a token source for the managed identity
+// of the host, using the Instance Metadata Service.
+func managedIdentityTokenSource(clientID string) func(*Client) (oauth2.TokenSource, error) {
+	return func(c *Client) (oauth2.TokenSource, error) {
+		client := c.client
+		if client == nil {
+			client = http.DefaultClient
+		}
+		return oauth2.ReuseTokenSource(nil, &imdsTokenSource{
+			client:   client,
+			resource: c.resource(),
+			clientID: clientID,
+		}), nil
+	}
+}
+
+// imdsTokenSource is a token source for a managed identity.
+type imdsTokenSource struct {
+	client   *http.Client
+	resource string
+	clientID string
+}
+
+// Token satisfies the oauth2.TokenSource interface.
+func (ts *imdsTokenSource) Token() (*oauth2.Token, error) {
+	q := url.Values{
+		"api-version": {"2018-02-01"},
+		"resource":    {ts.resource},
+	}
+	if ts.clientID != "" {
+		q.Set("client_id", ts.clientID)
+	}
+	req, err := http.NewRequest("GET", imdsURL+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Metadata", "true")
+
+	res, err := ts.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("managed identity token request failed with status %d", res.StatusCode)
+	}
+
+	var v struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresOn   string `json:"expires_on"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&v); err != nil {
+		return nil, err
+	}
+	tok := &oauth2.Token{AccessToken: v.AccessToken, TokenType: v.TokenType}
+	if sec, err := strconv.ParseInt(v.ExpiresOn, 10, 64); err == nil {
+		tok.Expiry = time.Unix(sec, 0)
+	}
+	return tok, nil
+}
@@ -0,0 +1,480 @@
+// Package azurednsp provides an Azure DNS client that satisfies
+// autocertdns.Provisioner and autocertdns.ProvisionerV2.
+package azurednsp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"github.com/brankas/autocertdns/propagation"
+	"github.com/brankas/autocertdns/provision"
+)
+
+const (
+	// allowedRecordType is the allowed record provisioning type.
+	allowedRecordType = "TXT"
+
+	// DefaultBaseURL is the default Azure Resource Manager endpoint.
+	DefaultBaseURL = "https://management.azure.com"
+
+	// DefaultAuthorityURL is the default Azure Active Directory endpoint.
+	DefaultAuthorityURL = "https://login.microsoftonline.com"
+
+	// DefaultTTL is the default TTL of provisioned records.
+	DefaultTTL = 60
+
+	// DefaultPropagationWait is the default propagation waiting time.
+	DefaultPropagationWait = 60 * time.Second
+
+	// DefaultCheckDelay is the default check delay.
+	DefaultCheckDelay = 2 * time.Second
+
+	// apiVersion is the Azure DNS API version.
+	apiVersion = "2018-05-01"
+
+	// maxAttempts is the maximum number of attempts for a record set update
+	// conflicting with a concurrent update.
+	maxAttempts = 5
+)
+
+// Client is an Azure DNS client.
+type Client struct {
+	client                  *http.Client
+	tokenSource             oauth2.TokenSource
+	auth                    func(*Client) (oauth2.TokenSource, error)
+	baseURL                 string
+	authorityURL            string
+	subscriptionID          string
+	resourceGroup           string
+	domain                  string
+	ttl                     int
+	propagationWait         time.Duration
+	checkDelay              time.Duration
+	ignorePropagationErrors bool
+	checker                 *propagation.Checker
+	logf                    func(string, ...interface{})
+	errf                    func(string, ...interface{})
+
+	// resolver is the checker used to look up the zone apex when no domain
+	// was specified.
+	resolver *propagation.Checker
+
+	// zones are the DNS zones, loaded on first use.
+	zones []*zone
+	mu    sync.Mutex
+}
+
+// zone is a DNS zone.
+type zone struct {
+	// id is the zone's resource ID.
+	id string
+
+	// domain is the zone's DNS name (without the trailing .).
+	domain string
+
+	// nameservers are the zone's nameservers, to check for propagation.
+	nameservers []string
+}
+
+// record is a handle to a provisioned record.
+type record struct {
+	zone  *zone
+	name  string
+	value string
+}
+
+// New creates an Azure DNS client that can handle DNS provisioning requests
+// for use with the autocertdns.Manager.
+func New(opts ...Option) (*Client, error) {
+	var err error
+
+	c := &Client{
+		baseURL:         DefaultBaseURL,
+		authorityURL:    DefaultAuthorityURL,
+		ttl:             DefaultTTL,
+		propagationWait: DefaultPropagationWait,
+		checkDelay:      DefaultCheckDelay,
+		logf:            func(string, ...interface{}) {},
+	}
+
+	// apply opts
+	for _, o := range opts {
+		if err = o(c); err != nil {
+			return nil, err
+		}
+	}
+
+	// ensure errf is set
+	if c.errf == nil {
+		c.errf = func(s string, v ...interface{}) {
+			c.logf("ERROR: "+s, v...)
+		}
+	}
+
+	if c.subscriptionID == "" {
+		return nil, errors.New("azurednsp missing subscription id")
+	}
+	c.baseURL = strings.TrimSuffix(c.baseURL, "/")
+	c.authorityURL = strings.TrimSuffix(c.authorityURL, "/")
+	c.domain = strings.ToLower(strings.TrimSuffix(c.domain, "."))
+
+	// create token source
+	if c.tokenSource == nil {
+		if c.auth == nil {
+			return nil, errors.New("azurednsp missing credentials")
+		}
+		if c.tokenSource, err = c.auth(c); err != nil {
+			return nil, err
+		}
+	}
+	base := c.client
+	if base == nil {
+		base = http.DefaultClient
+	}
+	c.client = oauth2.NewClient(context.WithValue(context.Background(), oauth2.HTTPClient, base), c.tokenSource)
+
+	// create resolver for zone apex lookups
+	c.resolver = c.checker
+	if c.resolver == nil && c.domain == "" {
+		if c.resolver, err = propagation.New(propagation.Logf(c.logf), propagation.Errorf(c.errf)); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// Provision creates a DNS record of typ, for the specified domain name and
+// with the value in token.
+func (c *Client) Provision(ctxt context.Context, typ, name, token string) error {
+	_, err := c.ProvisionRecords(ctxt, []provision.Challenge{{Type: typ, Name: name, Value: token}})
+	return err
+}
+
+// Unprovision deletes the DNS record of typ, for the specified domain name,
+// and for the record with the specified token as the value.
+func (c *Client) Unprovision(ctxt context.Context, typ, name, token string) error {
+	if typ != allowedRecordType {
+		return errors.New("only TXT records are supported")
+	}
+	z, err := c.zoneFor(ctxt, name)
+	if err != nil {
+		return err
+	}
+	return c.UnprovisionRecords(ctxt, []provision.Record{&record{zone: z, name: normalize(name), value: token}})
+}
+
+// ProvisionRecords adds the values of the challenges to the TXT record sets,
+// merging with any existing values, and waits for the records to propagate
+// to the zones' nameservers.
+func (c *Client) ProvisionRecords(ctxt context.Context, challenges []provision.Challenge) ([]provision.Record, error) {
+	var records []provision.Record
+	for _, ch := range challenges {
+		if ch.Type != allowedRecordType {
+			return records, errors.New("only TXT records are supported")
+		}
+		z, err := c.zoneFor(ctxt, ch.Name)
+		if err != nil {
+			return records, err
+		}
+		r := &record{zone: z, name: normalize(ch.Name), value: ch.Value}
+		c.logf("provisioning (type: %s, name: %s, token: %s)", allowedRecordType, r.name, r.value)
+		if err = c.update(ctxt, r, true); err != nil {
+			c.errf("unable to provision (type: %s, name: %s, token: %s): %v", allowedRecordType, r.name, r.value, err)
+			return records, err
+		}
+		records = append(records, r)
+	}
+
+	// wait for propagation
+	for _, rec := range records {
+		r := rec.(*record)
+		checker, err := c.propagationChecker(r.zone)
+		if err != nil {
+			return records, err
+		}
+		if err = checker.Wait(ctxt, r.name, r.value); err != nil && !c.ignorePropagationErrors {
+			return records, err
+		} else if err != nil {
+			c.errf("ignored propagated error: %v", err)
+		}
+	}
+
+	return records, nil
+}
+
+// UnprovisionRecords removes the values of the provisioned records from their
+// record sets, deleting any record sets left empty.
+func (c *Client) UnprovisionRecords(ctxt context.Context, records []provision.Record) error {
+	var err error
+	for _, rec := range records {
+		r, ok := rec.(*record)
+		if !ok {
+			if err == nil {
+				err = provision.ErrUnknownRecord
+			}
+			continue
+		}
+		c.logf("unprovisioning (type: %s, name: %s, token: %s)", allowedRecordType, r.name, r.value)
+		if e := c.update(ctxt, r, false); e != nil {
+			c.errf("unable to unprovision (type: %s, name: %s, token: %s): %v", allowedRecordType, r.name, r.value, e)
+			if err == nil {
+				err = e
+			}
+		}
+	}
+	return err
+}
+
+// WaitsForPropagation satisfies the autocertdns.ProvisionerV2 interface.
+func (c *Client) WaitsForPropagation() bool {
+	return true
+}
+
+// recordSet is an Azure DNS record set. The properties are kept as raw
+// values, so that the metadata and any other properties of an existing record
+// set are preserved when it is updated.
+type recordSet struct {
+	Etag       string                     `json:"etag,omitempty"`
+	Properties map[string]json.RawMessage `json:"properties"`
+}
+
+// txtRecord is an Azure DNS TXT record.
+type txtRecord struct {
+	Value []string `json:"value"`
+}
+
+// update adds or removes the record's value in its record set, retrying when
+// the record set is concurrently modified.
+func (c *Client) update(ctxt context.Context, r *record, add bool) error {
+	rel := "@"
+	if r.name != r.zone.domain {
+		rel = strings.TrimSuffix(r.name, "."+r.zone.domain)
+	}
+	path := r.zone.id + "/TXT/" + url.PathEscape(rel)
+
+	for i := 0; ; i++ {
+		// get existing record set
+		var rs recordSet
+		status, err := c.do(ctxt, "GET", path, nil, nil, &rs)
+		switch {
+		case status == http.StatusNotFound:
+			rs = recordSet{Properties: make(map[string]json.RawMessage)}
+			if rs.Properties["TTL"], err = json.Marshal(c.ttl); err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		case rs.Properties == nil:
+			rs.Properties = make(map[string]json.RawMessage)
+		}
+
+		// merge values
+		var existing, values []txtRecord
+		if buf, ok := rs.Properties["TXTRecords"]; ok {
+			if err = json.Unmarshal(buf, &existing); err != nil {
+				return err
+			}
+		}
+		for _, txt := range existing {
+			if strings.Join(txt.Value, "") != r.value {
+				values = append(values, txt)
+			}
+		}
+		if add {
+			values = append(values, txtRecord{Value: []string{r.value}})
+		}
+		if rs.Properties["TXTRecords"], err = json.Marshal(values); err != nil {
+			return err
+		}
+
+		// conditionally update, so concurrent changes are not lost
+		header := make(http.Header)
+		if rs.Etag != "" {
+			header.Set("If-Match", rs.Etag)
+		} else {
+			header.Set("If-None-Match", "*")
+		}
+		switch {
+		case len(values) != 0:
+			status, err = c.do(ctxt, "PUT", path, header, rs, nil)
+		case rs.Etag != "":
+			status, err = c.do(ctxt, "DELETE", path, header, nil, nil)
+		default:
+			return nil
+		}
+		if status != http.StatusPreconditionFailed || i >= maxAttempts-1 {
+			return err
+		}
+		c.logf("record set %s modified concurrently, retrying", r.name)
+	}
+}
+
+// zoneFor returns the zone for name.
+//
+// When the Client was not created with a domain, the zone is the zone in the
+// subscription (or resource group) for the zone apex of name, as determined
+// by the SOA records of name and its parent domains.
+func (c *Client) zoneFor(ctxt context.Context, name string) (*zone, error) {
+	name = normalize(name)
+
+	// determine domain
+	domain := c.domain
+	switch {
+	case domain != "":
+		if name != domain && !strings.HasSuffix(name, "."+domain) {
+			return nil, errors.New("invalid domain")
+		}
+	default:
+		apex, err := c.resolver.Zone(ctxt, name)
+		if err != nil {
+			c.errf("could not determine zone for %s: %v", name, err)
+			return nil, err
+		}
+		domain = normalize(apex)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// find zone, reloading the zones when not found, as zones may have been
+	// created since they were loaded
+	loaded := c.zones == nil
+	for {
+		if loaded {
+			if err := c.loadZones(ctxt); err != nil {
+				return nil, err
+			}
+		}
+		for _, z := range c.zones {
+			if z.domain == domain {
+				return z, nil
+			}
+		}
+		if loaded {
+			return nil, errors.New("no zone found for " + domain)
+		}
+		loaded = true
+	}
+}
+
+// loadZones loads the DNS zones in the subscription (or resource group). The
+// caller must hold the lock.
+func (c *Client) loadZones(ctxt context.Context) error {
+	var zones []*zone
+	path := "/subscriptions/" + c.subscriptionID
+	if c.resourceGroup != "" {
+		path += "/resourceGroups/" + c.resourceGroup
+	}
+	path += "/providers/Microsoft.Network/dnszones"
+	for path != "" {
+		var res struct {
+			Value []struct {
+				ID         string `json:"id"`
+				Name       string `json:"name"`
+				Properties struct {
+					NameServers []string `json:"nameServers"`
+				} `json:"properties"`
+			} `json:"value"`
+			NextLink string `json:"nextLink"`
+		}
+		if _, err := c.do(ctxt, "GET", path, nil, nil, &res); err != nil {
+			c.errf("could not list zones: %v", err)
+			return err
+		}
+		for _, v := range res.Value {
+			z := &zone{id: v.ID, domain: normalize(v.Name)}
+			for _, ns := range v.Properties.NameServers {
+				z.nameservers = append(z.nameservers, strings.TrimSuffix(ns, "."))
+			}
+			zones = append(zones, z)
+		}
+		path = res.NextLink
+	}
+	c.zones = zones
+	return nil
+}
+
+// propagationChecker returns the propagation checker for the zone.
+func (c *Client) propagationChecker(z *zone) (*propagation.Checker, error) {
+	if c.checker != nil {
+		return c.checker, nil
+	}
+	return propagation.New(
+		propagation.Nameservers(z.nameservers...),
+		propagation.Timeout(c.propagationWait),
+		propagation.Interval(c.checkDelay),
+		propagation.Logf(c.logf),
+		propagation.Errorf(c.errf),
+	)
+}
+
+// do performs an API request, decoding the response into v. The path may be a
+// resource ID, or an absolute URL (as for next links).
+func (c *Client) do(ctxt context.Context, method, path string, header http.Header, body, v interface{}) (int, error) {
+	var r io.Reader
+	if body != nil {
+		buf, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		r = bytes.NewReader(buf)
+	}
+
+	urlstr := path
+	if !strings.HasPrefix(path, "https://") && !strings.HasPrefix(path, "http://") {
+		urlstr = c.baseURL + path + "?api-version=" + apiVersion
+	}
+	req, err := http.NewRequest(method, urlstr, r)
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(ctxt)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		var apiErr struct {
+			Error struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		buf, _ := ioutil.ReadAll(io.LimitReader(res.Body, 4096))
+		if json.Unmarshal(buf, &apiErr) == nil && apiErr.Error.Code != "" {
+			return res.StatusCode, fmt.Errorf("%s: %s", apiErr.Error.Code, apiErr.Error.Message)
+		}
+		return res.StatusCode, fmt.Errorf("request failed with status %d", res.StatusCode)
+	}
+	if v != nil {
+		return res.StatusCode, json.NewDecoder(res.Body).Decode(v)
+	}
+	return res.StatusCode, nil
+}
+
+// normalize lowercases name and removes its trailing dot.
+func normalize(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
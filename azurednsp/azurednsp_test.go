@@ -0,0 +1,303 @@
+package azurednsp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/brankas/autocertdns/propagation"
+	"github.com/brankas/autocertdns/provision"
+)
+
+const testZoneID = "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Network/dnszones/example.com"
+
+func TestProvision(t *testing.T) {
+	s := newStandIn(t)
+	s.sets["_acme-challenge"] = []string{"existing"}
+	s.metadata["_acme-challenge"] = map[string]string{"owner": "ops"}
+	s.conflict = true
+
+	checker, err := propagation.New(
+		propagation.Resolvers(s.ns),
+		propagation.Nameservers(s.ns),
+		propagation.Timeout(5*time.Second),
+		propagation.Interval(10*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	c, err := New(
+		SubscriptionID("sub"),
+		ClientSecret("tenant", "client", "secret"),
+		BaseURL(s.url),
+		AuthorityURL(s.url),
+		Checker(checker),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	records, err := c.ProvisionRecords(context.Background(), []provision.Challenge{
+		{Name: "_acme-challenge.example.com.", Type: "TXT", Value: "a"},
+		{Name: "_acme-challenge.www.example.com", Type: "TXT", Value: "b"},
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if v := s.values("_acme-challenge"); v != "a existing" {
+		t.Errorf("expected existing value to be preserved, got: %q", v)
+	}
+	if m := s.metadata["_acme-challenge"]; m["owner"] != "ops" {
+		t.Errorf("expected metadata to be preserved, got: %v", m)
+	}
+	if v := s.values("_acme-challenge.www"); v != "b" {
+		t.Errorf("expected b, got: %q", v)
+	}
+
+	if err = c.UnprovisionRecords(context.Background(), records); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if v := s.values("_acme-challenge"); v != "existing" {
+		t.Errorf("expected existing, got: %q", v)
+	}
+	if _, ok := s.sets["_acme-challenge.www"]; ok {
+		t.Errorf("expected record set to be deleted")
+	}
+
+	if err = c.Provision(context.Background(), "TXT", "_acme-challenge.example.org", "c"); err == nil {
+		t.Errorf("expected error for unknown zone")
+	}
+
+	// zone created after the zones were loaded
+	if c, err = New(
+		SubscriptionID("sub"),
+		ClientSecret("tenant", "client", "secret"),
+		BaseURL(s.url),
+		AuthorityURL(s.url),
+		Domain("example.org"),
+		Checker(checker),
+	); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if _, err = c.zoneFor(context.Background(), "_acme-challenge.example.org"); err == nil {
+		t.Errorf("expected error for unknown zone")
+	}
+	s.Lock()
+	s.orgZone = true
+	s.Unlock()
+	if z, err := c.zoneFor(context.Background(), "_acme-challenge.example.org"); err != nil || z.domain != "example.org" {
+		t.Errorf("expected zone example.org, got: %v, %v", z, err)
+	}
+}
+
+func TestManagedIdentity(t *testing.T) {
+	s := newStandIn(t)
+	defer func(u string) { imdsURL = u }(imdsURL)
+	imdsURL = s.url + "/metadata/identity/oauth2/token"
+
+	c, err := New(
+		SubscriptionID("sub"),
+		ResourceGroup("rg"),
+		Domain("example.com"),
+		ManagedIdentity(""),
+		BaseURL(s.url),
+		CheckDelay(10*time.Millisecond),
+		PropagationWait(5*time.Second),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err = c.Provision(context.Background(), "TXT", "_acme-challenge.example.com", "a"); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if v := s.values("_acme-challenge"); v != "a" {
+		t.Errorf("expected a, got: %q", v)
+	}
+}
+
+// standIn is a local stand-in for the Azure DNS and token APIs, serving the
+// zone example.com.
+type standIn struct {
+	url      string
+	ns       string
+	sets     map[string][]string
+	metadata map[string]map[string]string
+	etags    map[string]int
+	conflict bool
+	orgZone  bool
+	sync.Mutex
+}
+
+// newStandIn starts an Azure API stand-in, and a nameserver serving its
+// records.
+func newStandIn(t *testing.T) *standIn {
+	s := &standIn{
+		sets:     make(map[string][]string),
+		metadata: make(map[string]map[string]string),
+		etags:    make(map[string]int),
+	}
+
+	// start nameserver
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(s.serveDNS)}
+	started := make(chan struct{})
+	srv.NotifyStartedFunc = func() { close(started) }
+	go srv.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { srv.Shutdown() })
+	s.ns = pc.LocalAddr().String()
+
+	// start api
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+	s.url = ts.URL
+
+	return s
+}
+
+func (s *standIn) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	// tokens
+	switch req.URL.Path {
+	case "/tenant/oauth2/v2.0/token":
+		req.ParseForm()
+		if req.Form.Get("client_secret") != "secret" && !strings.Contains(req.Header.Get("Authorization"), "Basic") {
+			http.Error(res, "invalid client", http.StatusUnauthorized)
+			return
+		}
+		res.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(res).Encode(map[string]interface{}{"access_token": "token", "token_type": "Bearer", "expires_in": 3600})
+		return
+	case "/metadata/identity/oauth2/token":
+		if req.Header.Get("Metadata") != "true" {
+			http.Error(res, "missing metadata header", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(res).Encode(map[string]string{"access_token": "token", "token_type": "Bearer", "expires_on": fmt.Sprint(time.Now().Add(time.Hour).Unix())})
+		return
+	}
+
+	if req.Header.Get("Authorization") != "Bearer token" {
+		http.Error(res, `{"error":{"code":"AuthenticationFailed","message":"invalid token"}}`, http.StatusUnauthorized)
+		return
+	}
+
+	switch path := req.URL.Path; {
+	case path == "/subscriptions/sub/providers/Microsoft.Network/dnszones",
+		path == "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Network/dnszones":
+		zones := []interface{}{map[string]interface{}{
+			"id":         testZoneID,
+			"name":       "example.com",
+			"properties": map[string]interface{}{"nameServers": []string{s.ns}},
+		}}
+		if s.orgZone {
+			zones = append(zones, map[string]interface{}{
+				"id":         strings.TrimSuffix(testZoneID, "example.com") + "example.org",
+				"name":       "example.org",
+				"properties": map[string]interface{}{"nameServers": []string{s.ns}},
+			})
+		}
+		json.NewEncoder(res).Encode(map[string]interface{}{"value": zones})
+	case strings.HasPrefix(path, testZoneID+"/TXT/"):
+		name := strings.TrimPrefix(path, testZoneID+"/TXT/")
+		values, exists := s.sets[name]
+		etag := fmt.Sprintf(`"%d"`, s.etags[name])
+		if req.Method != "GET" {
+			if s.conflict || (exists && req.Header.Get("If-Match") != etag) || (!exists && req.Header.Get("If-None-Match") != "*") {
+				s.conflict = false
+				s.etags[name]++
+				http.Error(res, `{"error":{"code":"PreconditionFailed","message":"etag mismatch"}}`, http.StatusPreconditionFailed)
+				return
+			}
+		}
+		switch req.Method {
+		case "GET":
+			if !exists {
+				http.Error(res, `{"error":{"code":"NotFound","message":"not found"}}`, http.StatusNotFound)
+				return
+			}
+			var rs testRecordSet
+			rs.Etag, rs.Properties.TTL, rs.Properties.Metadata = etag, 60, s.metadata[name]
+			for _, v := range values {
+				rs.Properties.TXTRecords = append(rs.Properties.TXTRecords, txtRecord{Value: []string{v}})
+			}
+			json.NewEncoder(res).Encode(rs)
+		case "PUT":
+			var rs testRecordSet
+			json.NewDecoder(req.Body).Decode(&rs)
+			s.metadata[name] = rs.Properties.Metadata
+			values = nil
+			for _, txt := range rs.Properties.TXTRecords {
+				values = append(values, strings.Join(txt.Value, ""))
+			}
+			s.sets[name] = values
+			s.etags[name]++
+			json.NewEncoder(res).Encode(rs)
+		case "DELETE":
+			delete(s.sets, name)
+			delete(s.metadata, name)
+		}
+	default:
+		http.Error(res, `{"error":{"code":"NotFound","message":"not found"}}`, http.StatusNotFound)
+	}
+}
+
+// testRecordSet is an Azure DNS record set, as served by the stand-in.
+type testRecordSet struct {
+	Etag       string `json:"etag,omitempty"`
+	Properties struct {
+		TTL        int               `json:"TTL"`
+		Metadata   map[string]string `json:"metadata,omitempty"`
+		TXTRecords []txtRecord       `json:"TXTRecords"`
+	} `json:"properties"`
+}
+
+func (s *standIn) serveDNS(w dns.ResponseWriter, req *dns.Msg) {
+	s.Lock()
+	defer s.Unlock()
+
+	res := new(dns.Msg)
+	res.SetReply(req)
+	res.Authoritative = true
+	q := req.Question[0]
+	if q.Qtype == dns.TypeSOA {
+		if strings.EqualFold(q.Name, "example.com.") {
+			res.Answer = append(res.Answer, &dns.SOA{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 60},
+				Ns:  "ns.example.com.", Mbox: "hostmaster.example.com.", Serial: 1,
+			})
+		}
+		w.WriteMsg(res)
+		return
+	}
+	for _, v := range s.sets[strings.TrimSuffix(strings.ToLower(q.Name), ".example.com.")] {
+		res.Answer = append(res.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+			Txt: []string{v},
+		})
+	}
+	w.WriteMsg(res)
+}
+
+func (s *standIn) values(name string) string {
+	s.Lock()
+	defer s.Unlock()
+	v := append([]string(nil), s.sets[name]...)
+	sort.Strings(v)
+	return strings.Join(v, " ")
+}
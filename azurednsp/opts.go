@@ -0,0 +1,153 @@
+package azurednsp
+
+import (
+	"net/http"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"github.com/brankas/autocertdns/propagation"
+)
+
+// Option is the Client option type.
+type Option func(c *Client) error
+
+// SubscriptionID is a Client option to set the Azure subscription ID.
+func SubscriptionID(subscriptionID string) Option {
+	return func(c *Client) error {
+		c.subscriptionID = subscriptionID
+		return nil
+	}
+}
+
+// ResourceGroup is a Client option to set the resource group of the zones.
+//
+// If not set, zones from all resource groups in the subscription are used.
+func ResourceGroup(resourceGroup string) Option {
+	return func(c *Client) error {
+		c.resourceGroup = resourceGroup
+		return nil
+	}
+}
+
+// Domain is a Client option to set the domain (zone name).
+//
+// If not set, the zone is the zone for the apex of the provisioned name, as
+// found from its SOA records.
+func Domain(domain string) Option {
+	return func(c *Client) error {
+		c.domain = domain
+		return nil
+	}
+}
+
+// ClientSecret is a Client option to authenticate as a service principal with
+// a client secret.
+func ClientSecret(tenantID, clientID, secret string) Option {
+	return func(c *Client) error {
+		c.auth = clientSecretTokenSource(tenantID, clientID, secret)
+		return nil
+	}
+}
+
+// ManagedIdentity is a Client option to authenticate with the managed
+// identity of the host. The client ID selects a user-assigned identity, and
+// may be empty for the system-assigned identity.
+func ManagedIdentity(clientID string) Option {
+	return func(c *Client) error {
+		c.auth = managedIdentityTokenSource(clientID)
+		return nil
+	}
+}
+
+// TokenSource is a Client option to set the token source used to authenticate
+// requests.
+func TokenSource(ts oauth2.TokenSource) Option {
+	return func(c *Client) error {
+		c.tokenSource = ts
+		return nil
+	}
+}
+
+// HTTPClient is a Client option that sets the http.Client used.
+func HTTPClient(client *http.Client) Option {
+	return func(c *Client) error {
+		c.client = client
+		return nil
+	}
+}
+
+// BaseURL is a Client option to set the Azure Resource Manager endpoint, such
+// as for a sovereign cloud.
+func BaseURL(baseURL string) Option {
+	return func(c *Client) error {
+		c.baseURL = baseURL
+		return nil
+	}
+}
+
+// AuthorityURL is a Client option to set the Azure Active Directory endpoint
+// used for client secret authentication.
+func AuthorityURL(authorityURL string) Option {
+	return func(c *Client) error {
+		c.authorityURL = authorityURL
+		return nil
+	}
+}
+
+// TTL is a Client option to set the TTL of new record sets.
+func TTL(ttl int) Option {
+	return func(c *Client) error {
+		c.ttl = ttl
+		return nil
+	}
+}
+
+// PropagationWait is a Client option to set the propagation wait timeout.
+func PropagationWait(d time.Duration) Option {
+	return func(c *Client) error {
+		c.propagationWait = d
+		return nil
+	}
+}
+
+// CheckDelay is a Client option to set the delay between DNS name propagation
+// checks.
+func CheckDelay(d time.Duration) Option {
+	return func(c *Client) error {
+		c.checkDelay = d
+		return nil
+	}
+}
+
+// Checker is a Client option to set the propagation checker used to wait for
+// provisioned records to propagate, instead of checking the zone's
+// nameservers. The checker is also used to look up zone apexes.
+func Checker(checker *propagation.Checker) Option {
+	return func(c *Client) error {
+		c.checker = checker
+		return nil
+	}
+}
+
+// Logf is a Client option to specify the logging function used.
+func Logf(f func(string, ...interface{})) Option {
+	return func(c *Client) error {
+		c.logf = f
+		return nil
+	}
+}
+
+// Errorf is a Client option to specify the error logging function used.
+func Errorf(f func(string, ...interface{})) Option {
+	return func(c *Client) error {
+		c.errf = f
+		return nil
+	}
+}
+
+// IgnorePropagationErrors is a Client option to ignore propagation errors.
+func IgnorePropagationErrors(c *Client) error {
+	c.ignorePropagationErrors = true
+	return nil
+}
@@ -0,0 +1,188 @@
+package autocertdns
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/kenshaw/pemutil"
+
+	"github.com/brankas/autocertdns/internal/atomicfile"
+)
+
+const (
+	// pendingSuffix is the filename suffix for a certificate and key pair
+	// that has been written, but not yet committed to the cache.
+	pendingSuffix = ".next"
+
+	// corruptSuffix is the filename suffix used for a certificate and key pair
+	// that has been moved aside.
+	corruptSuffix = ".corrupt"
+)
+
+// cachedKey retrieves a private key from disk, generating and saving a new
+// elliptic.P256 key if the file is not on disk.
+func (m *Manager) cachedKey(filename string) (*ecdsa.PrivateKey, error) {
+	// try to load cached credentials
+	key, err := m.readKey(filename)
+	switch {
+	case err == nil:
+		return key, nil
+	case !os.IsNotExist(err):
+		return nil, fmt.Errorf("unexpected error: %v", err)
+	}
+
+	key, err = generateKey()
+	if err != nil {
+		return nil, err
+	}
+	buf, err := encodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(m.CacheDir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("could not create cache directory: %v", err)
+	}
+	err = atomicfile.WriteFile(filepath.Join(m.CacheDir, filename), buf, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("could not save PEM: %v", err)
+	}
+
+	return key, nil
+}
+
+// readKey reads a cached private key from disk.
+func (m *Manager) readKey(filename string) (*ecdsa.PrivateKey, error) {
+	keyfile := filepath.Join(m.CacheDir, filename)
+
+	store, err := pemutil.LoadFile(keyfile)
+	if err != nil {
+		return nil, err
+	}
+
+	// grab key
+	key, ok := store.ECPrivateKey()
+	if !ok {
+		return nil, fmt.Errorf("%s does not contain ec private key", keyfile)
+	}
+
+	return key, nil
+}
+
+// writePair writes the certificate and key for domain to the cache as a
+// single unit.
+//
+// The pair is first written to pending files, which are then renamed into
+// place. Should the pair only be partially renamed (ie, after a crash), the
+// pending pair will be committed by recoverPair the next time the cache is
+// loaded.
+func (m *Manager) writePair(domain string, key *ecdsa.PrivateKey, cert []byte) error {
+	keyBuf, err := encodeKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(m.CacheDir, 0700); err != nil {
+		return fmt.Errorf("could not create cache directory: %v", err)
+	}
+
+	keyPath := filepath.Join(m.CacheDir, domain+keySuffix)
+	certPath := filepath.Join(m.CacheDir, domain+certSuffix)
+
+	// write pending pair
+	if err = atomicfile.WriteFile(keyPath+pendingSuffix, keyBuf, 0600); err != nil {
+		return err
+	}
+	if err = atomicfile.WriteFile(certPath+pendingSuffix, cert, 0600); err != nil {
+		return err
+	}
+
+	return m.commitPair(domain)
+}
+
+// recoverPair completes an interrupted writePair for domain, committing a
+// complete pending pair, or removing an incomplete pending pair.
+func (m *Manager) recoverPair(domain string) error {
+	keyPath := filepath.Join(m.CacheDir, domain+keySuffix+pendingSuffix)
+	certPath := filepath.Join(m.CacheDir, domain+certSuffix+pendingSuffix)
+
+	_, keyErr := os.Stat(keyPath)
+	_, certErr := os.Stat(certPath)
+	switch {
+	case os.IsNotExist(keyErr) && os.IsNotExist(certErr):
+		return nil
+
+	case keyErr == nil && certErr == nil:
+		m.log("committing pending certificate and key for %s", domain)
+		return m.commitPair(domain)
+
+	case os.IsNotExist(certErr):
+		m.log("removing incomplete pending key for %s", domain)
+		return os.Remove(keyPath)
+	}
+
+	// the certificate is renamed after the key, so a lone pending certificate
+	// belongs with the already committed key
+	m.log("committing pending certificate for %s", domain)
+	return atomicfile.Rename(certPath, filepath.Join(m.CacheDir, domain+certSuffix))
+}
+
+// commitPair renames the pending certificate and key for domain into place.
+func (m *Manager) commitPair(domain string) error {
+	for _, suffix := range []string{keySuffix, certSuffix} {
+		path := filepath.Join(m.CacheDir, domain+suffix)
+		if err := atomicfile.Rename(path+pendingSuffix, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveAside moves the cached certificate and key for domain aside, so that
+// they are not overwritten by a renewal.
+func (m *Manager) moveAside(domain string, cause error) {
+	suffix := corruptSuffix + "." + time.Now().UTC().Format("20060102T150405Z")
+	for _, s := range []string{keySuffix, certSuffix} {
+		path := filepath.Join(m.CacheDir, domain+s)
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		if err := atomicfile.Rename(path, path+suffix); err != nil {
+			m.errf("could not move aside %s: %v", path, err)
+			continue
+		}
+		m.log("moved aside %s to %s: %v", path, path+suffix, cause)
+	}
+}
+
+// isCorrupt returns true when err indicates that a cached certificate and key
+// pair is unreadable or mismatched, rather than missing or expired.
+func isCorrupt(err error) bool {
+	switch {
+	case err == nil,
+		os.IsNotExist(err),
+		err == ErrCertificateExpired,
+		err == ErrCertificateNotYetValid:
+		return false
+	}
+	return true
+}
+
+// generateKey generates a new elliptic.P256 private key.
+func generateKey() (*ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("could not generate ec key: %v", err)
+	}
+	return key, nil
+}
+
+// encodeKey PEM encodes the private key.
+func encodeKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	return pemutil.Store{pemutil.ECPrivateKey: key}.Bytes()
+}
@@ -0,0 +1,326 @@
+// Package certbotexp provides an autocertdns.Exporter that writes
+// certificates using the certbot directory layout.
+//
+// Each exported certificate is written as a new version to
+// <dir>/archive/<name>/{cert,chain,fullchain,privkey}N.pem, and stable
+// symlinks are updated in <dir>/live/<name>/{cert,chain,fullchain,privkey}.pem
+// to point to the latest version.
+package certbotexp
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+
+	"software.sslmate.com/src/go-pkcs12"
+
+	"github.com/brankas/autocertdns/internal/atomicfile"
+)
+
+const (
+	// DefaultFileMode is the default mode for exported certificate and chain
+	// files.
+	DefaultFileMode os.FileMode = 0644
+
+	// DefaultKeyFileMode is the default mode for exported private key and
+	// PKCS#12 files.
+	DefaultKeyFileMode os.FileMode = 0600
+
+	// DefaultDirMode is the default mode for created directories.
+	DefaultDirMode os.FileMode = 0755
+)
+
+// file is an exported file.
+type file struct {
+	name string
+	ext  string
+	key  bool
+}
+
+// files are the exported files, in the order they are written. The cert file
+// is written last, as it is used to determine the latest exported version.
+var files = []file{
+	{"privkey", ".pem", true},
+	{"chain", ".pem", false},
+	{"fullchain", ".pem", false},
+	{"bundle", ".p12", true},
+	{"cert", ".pem", false},
+}
+
+// certRE matches versioned cert files in the archive directory.
+var certRE = regexp.MustCompile(`^cert([0-9]+)\.pem$`)
+
+// Exporter exports certificates using the certbot directory layout.
+type Exporter struct {
+	dir            string
+	name           string
+	pkcs12         bool
+	pkcs12Password string
+	uid, gid       int
+	fileMode       os.FileMode
+	keyFileMode    os.FileMode
+	dirMode        os.FileMode
+	logf           func(string, ...interface{})
+	errf           func(string, ...interface{})
+}
+
+// New creates a new certbot layout Exporter for use with the
+// autocertdns.Manager.
+func New(opts ...Option) (*Exporter, error) {
+	var err error
+
+	e := &Exporter{
+		uid:         -1,
+		gid:         -1,
+		fileMode:    DefaultFileMode,
+		keyFileMode: DefaultKeyFileMode,
+		dirMode:     DefaultDirMode,
+		logf:        func(string, ...interface{}) {},
+	}
+
+	// apply opts
+	for _, o := range opts {
+		if err = o(e); err != nil {
+			return nil, err
+		}
+	}
+
+	// ensure errf is set
+	if e.errf == nil {
+		e.errf = func(s string, v ...interface{}) {
+			e.logf("ERROR: "+s, v...)
+		}
+	}
+
+	if e.dir == "" {
+		return nil, errors.New("certbotexp missing dir")
+	}
+
+	return e, nil
+}
+
+// Export writes cert as a new version to the archive directory, and updates
+// the live symlinks, unless cert is already the latest exported version.
+func (e *Exporter) Export(ctxt context.Context, domain string, cert *tls.Certificate) error {
+	if cert == nil || len(cert.Certificate) == 0 {
+		return errors.New("no certificate to export")
+	}
+
+	name := e.name
+	if name == "" {
+		name = domain
+	}
+	archiveDir := filepath.Join(e.dir, "archive", name)
+	liveDir := filepath.Join(e.dir, "live", name)
+
+	// encode files
+	bufs, err := e.encode(cert)
+	if err != nil {
+		return err
+	}
+
+	// determine version
+	n, err := latest(archiveDir)
+	if err != nil {
+		return err
+	}
+	if n != 0 && exported(archiveDir, n, bufs) {
+		return e.link(archiveDir, liveDir, n)
+	}
+	n++
+
+	// create directories
+	for _, dir := range []string{archiveDir, liveDir} {
+		if err := e.mkdir(dir); err != nil {
+			return err
+		}
+	}
+
+	// write archive
+	for _, f := range files {
+		buf, ok := bufs[f.name]
+		if !ok {
+			continue
+		}
+		mode := e.fileMode
+		if f.key {
+			mode = e.keyFileMode
+		}
+		path := filepath.Join(archiveDir, f.name+strconv.Itoa(n)+f.ext)
+		if err := atomicfile.WriteFile(path, buf, mode); err != nil {
+			e.errf("could not write %s: %v", path, err)
+			return err
+		}
+		if err := e.chown(path); err != nil {
+			return err
+		}
+	}
+
+	e.logf("exported certificate (domain: %s, version: %d, dir: %s)", domain, n, archiveDir)
+
+	return e.link(archiveDir, liveDir, n)
+}
+
+// encode encodes the exported files for cert.
+func (e *Exporter) encode(cert *tls.Certificate) (map[string][]byte, error) {
+	// private key
+	der, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal private key: %v", err)
+	}
+	bufs := map[string][]byte{
+		"privkey": pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}),
+	}
+
+	// certificate and chain
+	var chain, fullchain []byte
+	for i, b := range cert.Certificate {
+		buf := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: b})
+		if i == 0 {
+			bufs["cert"] = buf
+		} else {
+			chain = append(chain, buf...)
+		}
+		fullchain = append(fullchain, buf...)
+	}
+	bufs["chain"], bufs["fullchain"] = chain, fullchain
+
+	// pkcs#12 bundle
+	if e.pkcs12 {
+		certs := make([]*x509.Certificate, len(cert.Certificate))
+		for i, b := range cert.Certificate {
+			if certs[i], err = x509.ParseCertificate(b); err != nil {
+				return nil, err
+			}
+		}
+		bufs["bundle"], err = pkcs12.Encode(rand.Reader, cert.PrivateKey, certs[0], certs[1:], e.pkcs12Password)
+		if err != nil {
+			return nil, fmt.Errorf("could not encode pkcs#12 bundle: %v", err)
+		}
+	}
+
+	return bufs, nil
+}
+
+// link atomically updates the symlinks in liveDir to point to version n of
+// the files in archiveDir.
+func (e *Exporter) link(archiveDir, liveDir string, n int) error {
+	if err := e.mkdir(liveDir); err != nil {
+		return err
+	}
+
+	rel, err := filepath.Rel(liveDir, archiveDir)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		target := filepath.Join(rel, f.name+strconv.Itoa(n)+f.ext)
+		if _, err := os.Stat(filepath.Join(liveDir, target)); os.IsNotExist(err) {
+			continue
+		}
+
+		path := filepath.Join(liveDir, f.name+f.ext)
+		if cur, err := os.Readlink(path); err == nil && cur == target {
+			continue
+		}
+
+		// replace by renaming a temporary symlink over the existing symlink
+		tmp := filepath.Join(liveDir, "."+f.name+f.ext+".tmp")
+		os.Remove(tmp)
+		if err := os.Symlink(target, tmp); err != nil {
+			return err
+		}
+		if e.uid != -1 || e.gid != -1 {
+			if err := os.Lchown(tmp, e.uid, e.gid); err != nil {
+				os.Remove(tmp)
+				return err
+			}
+		}
+		if err := atomicfile.Rename(tmp, path); err != nil {
+			os.Remove(tmp)
+			e.errf("could not link %s: %v", path, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// mkdir creates dir (and any parents) with the Exporter's directory mode and
+// ownership.
+func (e *Exporter) mkdir(dir string) error {
+	if _, err := os.Stat(dir); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(dir, e.dirMode); err != nil {
+		return err
+	}
+	if err := os.Chmod(dir, e.dirMode); err != nil {
+		return err
+	}
+	return e.chown(dir)
+}
+
+// chown changes the ownership of path, if an owner was specified.
+func (e *Exporter) chown(path string) error {
+	if e.uid == -1 && e.gid == -1 {
+		return nil
+	}
+	return os.Chown(path, e.uid, e.gid)
+}
+
+// exported returns true when version n in the archive directory has the
+// same certificate as bufs, and has all of the files in bufs (such as the
+// PKCS#12 bundle, when enabled after the version was exported).
+func exported(archiveDir string, n int, bufs map[string][]byte) bool {
+	for _, f := range files {
+		if _, ok := bufs[f.name]; !ok {
+			continue
+		}
+		path := filepath.Join(archiveDir, f.name+strconv.Itoa(n)+f.ext)
+		if f.name == "cert" {
+			buf, err := ioutil.ReadFile(path)
+			if err != nil || !bytes.Equal(buf, bufs["cert"]) {
+				return false
+			}
+		} else if _, err := os.Stat(path); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// latest returns the latest version of the exported files in dir, or 0 if no
+// files have been exported.
+func latest(dir string) (int, error) {
+	entries, err := ioutil.ReadDir(dir)
+	switch {
+	case os.IsNotExist(err):
+		return 0, nil
+	case err != nil:
+		return 0, err
+	}
+
+	var n int
+	for _, fi := range entries {
+		m := certRE.FindStringSubmatch(fi.Name())
+		if m == nil {
+			continue
+		}
+		if i, err := strconv.Atoi(m[1]); err == nil && i > n {
+			n = i
+		}
+	}
+	return n, nil
+}
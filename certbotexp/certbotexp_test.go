@@ -0,0 +1,200 @@
+package certbotexp
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+func TestExport(t *testing.T) {
+	dir := t.TempDir()
+	e, err := New(
+		Dir(dir),
+		PKCS12("password"),
+		Owner(os.Getuid(), os.Getgid()),
+		FileMode(0640),
+		KeyFileMode(0400),
+		DirMode(0750),
+		Logf(t.Logf),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	const domain = "example.com"
+	archiveDir := filepath.Join(dir, "archive", domain)
+	liveDir := filepath.Join(dir, "live", domain)
+
+	// first version
+	cert1 := testCert(t, domain)
+	if err := e.Export(context.Background(), domain, cert1); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	checkLive(t, liveDir, "1")
+	checkVersion(t, archiveDir, liveDir, cert1)
+
+	// unchanged certificate is not re-exported
+	if err := e.Export(context.Background(), domain, cert1); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(archiveDir, "cert2.pem")); !os.IsNotExist(err) {
+		t.Errorf("expected unchanged certificate to not be exported, got: %v", err)
+	}
+
+	// second version
+	cert2 := testCert(t, domain)
+	if err := e.Export(context.Background(), domain, cert2); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	checkLive(t, liveDir, "2")
+	checkVersion(t, archiveDir, liveDir, cert2)
+	if _, err := os.Stat(filepath.Join(archiveDir, "cert1.pem")); err != nil {
+		t.Errorf("expected previous version to be kept, got: %v", err)
+	}
+
+	// modes
+	tests := []struct {
+		path string
+		mode os.FileMode
+	}{
+		{archiveDir, 0750},
+		{liveDir, 0750},
+		{filepath.Join(archiveDir, "cert2.pem"), 0640},
+		{filepath.Join(archiveDir, "chain2.pem"), 0640},
+		{filepath.Join(archiveDir, "fullchain2.pem"), 0640},
+		{filepath.Join(archiveDir, "privkey2.pem"), 0400},
+		{filepath.Join(archiveDir, "bundle2.p12"), 0400},
+	}
+	for i, test := range tests {
+		fi, err := os.Stat(test.path)
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		if mode := fi.Mode().Perm(); mode != test.mode {
+			t.Errorf("test %d expected %s to have mode %o, got: %o", i, test.path, test.mode, mode)
+		}
+	}
+
+	// unchanged certificate is re-exported when pkcs#12 is enabled later
+	dir = t.TempDir()
+	archiveDir, liveDir = filepath.Join(dir, "archive", domain), filepath.Join(dir, "live", domain)
+	if e, err = New(Dir(dir), Logf(t.Logf)); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err := e.Export(context.Background(), domain, cert2); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if e, err = New(Dir(dir), PKCS12("password"), Logf(t.Logf)); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err := e.Export(context.Background(), domain, cert2); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	checkLive(t, liveDir, "2")
+	checkVersion(t, archiveDir, liveDir, cert2)
+}
+
+// checkLive checks that the live symlinks point to version n.
+func checkLive(t *testing.T, liveDir, n string) {
+	t.Helper()
+	for _, f := range files {
+		target, err := os.Readlink(filepath.Join(liveDir, f.name+f.ext))
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+		if exp := filepath.Join("..", "..", "archive", "example.com", f.name+n+f.ext); target != exp {
+			t.Errorf("expected %s to point to %s, got: %s", f.name+f.ext, exp, target)
+		}
+	}
+}
+
+// checkVersion checks the files read through the live symlinks match cert.
+func checkVersion(t *testing.T, archiveDir, liveDir string, cert *tls.Certificate) {
+	t.Helper()
+
+	// pem pair
+	pair, err := tls.LoadX509KeyPair(filepath.Join(liveDir, "fullchain.pem"), filepath.Join(liveDir, "privkey.pem"))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if !reflect.DeepEqual(pair.Certificate, cert.Certificate) {
+		t.Errorf("expected fullchain to match certificate")
+	}
+	if !cert.PrivateKey.(*ecdsa.PrivateKey).Equal(pair.PrivateKey) {
+		t.Errorf("expected privkey to match key")
+	}
+
+	// pkcs#12
+	buf, err := ioutil.ReadFile(filepath.Join(liveDir, "bundle.p12"))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	key, leaf, chain, err := pkcs12.DecodeChain(buf, "password")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if !cert.PrivateKey.(*ecdsa.PrivateKey).Equal(key) {
+		t.Errorf("expected pkcs#12 key to match key")
+	}
+	if !bytes.Equal(leaf.Raw, cert.Certificate[0]) {
+		t.Errorf("expected pkcs#12 certificate to match certificate")
+	}
+	if len(chain) != 1 || !bytes.Equal(chain[0].Raw, cert.Certificate[1]) {
+		t.Errorf("expected pkcs#12 chain to match chain")
+	}
+}
+
+// testCert creates a certificate for domain issued by a new self-signed CA.
+func testCert(t *testing.T, domain string) *tls.Certificate {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	caTpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTpl, caTpl, caKey.Public(), caKey)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: domain},
+		DNSNames:     []string{domain},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, caTpl, key.Public(), caKey)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{der, caDER},
+		PrivateKey:  key,
+	}
+}
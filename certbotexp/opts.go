@@ -0,0 +1,89 @@
+package certbotexp
+
+import (
+	"os"
+)
+
+// Option is the Exporter option type.
+type Option func(*Exporter) error
+
+// Dir is an Exporter option to set the base directory that the live and
+// archive directories are created in (ie, /etc/letsencrypt).
+func Dir(dir string) Option {
+	return func(e *Exporter) error {
+		e.dir = dir
+		return nil
+	}
+}
+
+// Name is an Exporter option to set the lineage name used for the live and
+// archive directories.
+//
+// If not set, the certificate's domain is used.
+func Name(name string) Option {
+	return func(e *Exporter) error {
+		e.name = name
+		return nil
+	}
+}
+
+// PKCS12 is an Exporter option to additionally export a PKCS#12 bundle
+// containing the private key, certificate and chain, encrypted with password.
+func PKCS12(password string) Option {
+	return func(e *Exporter) error {
+		e.pkcs12 = true
+		e.pkcs12Password = password
+		return nil
+	}
+}
+
+// Owner is an Exporter option to set the user and group ids of exported files
+// and directories. A uid or gid of -1 leaves the value unchanged.
+func Owner(uid, gid int) Option {
+	return func(e *Exporter) error {
+		e.uid, e.gid = uid, gid
+		return nil
+	}
+}
+
+// FileMode is an Exporter option to set the mode of exported certificate and
+// chain files.
+func FileMode(mode os.FileMode) Option {
+	return func(e *Exporter) error {
+		e.fileMode = mode
+		return nil
+	}
+}
+
+// KeyFileMode is an Exporter option to set the mode of exported private key
+// and PKCS#12 files.
+func KeyFileMode(mode os.FileMode) Option {
+	return func(e *Exporter) error {
+		e.keyFileMode = mode
+		return nil
+	}
+}
+
+// DirMode is an Exporter option to set the mode of created directories.
+func DirMode(mode os.FileMode) Option {
+	return func(e *Exporter) error {
+		e.dirMode = mode
+		return nil
+	}
+}
+
+// Logf is an Exporter option to specify the logging function used.
+func Logf(f func(string, ...interface{})) Option {
+	return func(e *Exporter) error {
+		e.logf = f
+		return nil
+	}
+}
+
+// Errorf is an Exporter option to specify the error logging function used.
+func Errorf(f func(string, ...interface{})) Option {
+	return func(e *Exporter) error {
+		e.errf = f
+		return nil
+	}
+}
@@ -0,0 +1,373 @@
+// Package cloudflarep provides a Cloudflare DNS client that satisfies
+// autocertdns.Provisioner and autocertdns.ProvisionerV2.
+//
+// The client uses the Cloudflare v4 API with scoped API tokens. The token
+// requires the Zone.DNS:Edit permission for the zones provisioned, and,
+// unless the zone ID is provided, the Zone.Zone:Read permission.
+package cloudflarep
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brankas/autocertdns/propagation"
+	"github.com/brankas/autocertdns/provision"
+)
+
+const (
+	// allowedRecordType is the allowed record provisioning type.
+	allowedRecordType = "TXT"
+
+	// DefaultBaseURL is the default Cloudflare API base URL.
+	DefaultBaseURL = "https://api.cloudflare.com/client/v4"
+
+	// DefaultTTL is the default TTL of provisioned records, and is
+	// Cloudflare's minimum TTL for most plans.
+	DefaultTTL = 60
+
+	// DefaultPropagationWait is the default propagation waiting time.
+	DefaultPropagationWait = 60 * time.Second
+)
+
+// Client is a Cloudflare DNS client.
+type Client struct {
+	client          *http.Client
+	baseURL         string
+	token           string
+	zoneToken       string
+	zoneID          string
+	domain          string
+	ttl             int
+	checker         *propagation.Checker
+	propagationWait time.Duration
+	logf            func(string, ...interface{})
+	errf            func(string, ...interface{})
+
+	// resolver is the checker used to look up the zone apex when no zone ID
+	// or domain was specified.
+	resolver *propagation.Checker
+
+	// zones are the resolved zone IDs, keyed by domain.
+	zones map[string]string
+	mu    sync.Mutex
+}
+
+// record is a handle to a provisioned record.
+type record struct {
+	zoneID string
+	id     string
+	name   string
+	value  string
+}
+
+// New creates a Cloudflare DNS client that can handle DNS provisioning
+// requests for use with the autocertdns.Manager.
+func New(opts ...Option) (*Client, error) {
+	var err error
+
+	c := &Client{
+		client:          http.DefaultClient,
+		baseURL:         DefaultBaseURL,
+		ttl:             DefaultTTL,
+		propagationWait: DefaultPropagationWait,
+		logf:            func(string, ...interface{}) {},
+		zones:           make(map[string]string),
+	}
+
+	// apply opts
+	for _, o := range opts {
+		if err = o(c); err != nil {
+			return nil, err
+		}
+	}
+
+	// ensure errf is set
+	if c.errf == nil {
+		c.errf = func(s string, v ...interface{}) {
+			c.logf("ERROR: "+s, v...)
+		}
+	}
+
+	if c.token == "" {
+		return nil, errors.New("cloudflarep missing api token")
+	}
+	if c.zoneToken == "" {
+		c.zoneToken = c.token
+	}
+	c.baseURL = strings.TrimSuffix(c.baseURL, "/")
+	c.domain = strings.ToLower(strings.TrimSuffix(c.domain, "."))
+
+	// create propagation checker
+	if c.checker == nil && c.propagationWait > 0 {
+		if c.checker, err = propagation.New(
+			propagation.Timeout(c.propagationWait),
+			propagation.Logf(c.logf),
+			propagation.Errorf(c.errf),
+		); err != nil {
+			return nil, err
+		}
+	}
+
+	// create resolver for zone apex lookups
+	c.resolver = c.checker
+	if c.resolver == nil && c.zoneID == "" && c.domain == "" {
+		if c.resolver, err = propagation.New(propagation.Logf(c.logf), propagation.Errorf(c.errf)); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// Provision creates a DNS record of typ, for the specified domain name and
+// with the value in token.
+func (c *Client) Provision(ctxt context.Context, typ, name, token string) error {
+	_, err := c.ProvisionRecords(ctxt, []provision.Challenge{{Type: typ, Name: name, Value: token}})
+	return err
+}
+
+// Unprovision deletes the DNS record of typ, for the specified domain name,
+// and for the record with the specified token as the value.
+func (c *Client) Unprovision(ctxt context.Context, typ, name, token string) error {
+	if typ != allowedRecordType {
+		return errors.New("only TXT records are supported")
+	}
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+
+	// determine zone
+	zoneID, err := c.zoneFor(ctxt, name)
+	if err != nil {
+		return err
+	}
+
+	// find records
+	var res []dnsRecord
+	q := url.Values{"type": {allowedRecordType}, "name": {name}, "content": {token}}
+	if err = c.do(ctxt, c.token, "GET", "/zones/"+zoneID+"/dns_records?"+q.Encode(), nil, &res); err != nil {
+		c.errf("could not retrieve records (type: %s, name: %s, token: %s): %v", typ, name, token, err)
+		return err
+	}
+	if len(res) == 0 {
+		c.errf("could not find record (type: %s, name: %s, token: %s)", typ, name, token)
+		return errors.New("record not deleted")
+	}
+
+	var records []provision.Record
+	for _, r := range res {
+		records = append(records, &record{zoneID: zoneID, id: r.ID, name: name, value: token})
+	}
+	return c.UnprovisionRecords(ctxt, records)
+}
+
+// ProvisionRecords creates the DNS records for the challenges and, when the
+// Client has a propagation checker, waits for the records to propagate.
+//
+// The records created before an error are returned along with the error.
+func (c *Client) ProvisionRecords(ctxt context.Context, challenges []provision.Challenge) ([]provision.Record, error) {
+	var records []provision.Record
+	for _, ch := range challenges {
+		if ch.Type != allowedRecordType {
+			return records, errors.New("only TXT records are supported")
+		}
+		name := strings.ToLower(strings.TrimSuffix(ch.Name, "."))
+
+		// determine zone
+		zoneID, err := c.zoneFor(ctxt, name)
+		if err != nil {
+			return records, err
+		}
+
+		// create dns record
+		c.logf("provisioning (type: %s, name: %s, token: %s)", ch.Type, name, ch.Value)
+		var res dnsRecord
+		if err = c.do(ctxt, c.token, "POST", "/zones/"+zoneID+"/dns_records", dnsRecord{
+			Type:    allowedRecordType,
+			Name:    name,
+			Content: ch.Value,
+			TTL:     c.ttl,
+		}, &res); err != nil {
+			c.errf("unable to provision (type: %s, name: %s, token: %s): %v", ch.Type, name, ch.Value, err)
+			return records, err
+		}
+		records = append(records, &record{zoneID: zoneID, id: res.ID, name: name, value: ch.Value})
+	}
+
+	// wait for propagation
+	if c.checker != nil {
+		for _, ch := range challenges {
+			if err := c.checker.Wait(ctxt, ch.Name, ch.Value); err != nil {
+				return records, err
+			}
+		}
+	}
+
+	return records, nil
+}
+
+// UnprovisionRecords deletes the provisioned records by their IDs.
+//
+// Deletion is attempted for every record, and the first error encountered is
+// returned.
+func (c *Client) UnprovisionRecords(ctxt context.Context, records []provision.Record) error {
+	var err error
+	for _, rec := range records {
+		r, ok := rec.(*record)
+		if !ok {
+			if err == nil {
+				err = provision.ErrUnknownRecord
+			}
+			continue
+		}
+
+		c.logf("unprovisioning (type: %s, name: %s, token: %s)", allowedRecordType, r.name, r.value)
+		if e := c.do(ctxt, c.token, "DELETE", "/zones/"+r.zoneID+"/dns_records/"+r.id, nil, nil); e != nil {
+			c.errf("unable to unprovision (type: %s, name: %s, token: %s): %v", allowedRecordType, r.name, r.value, e)
+			if err == nil {
+				err = e
+			}
+		}
+	}
+	return err
+}
+
+// WaitsForPropagation satisfies the autocertdns.ProvisionerV2 interface.
+//
+// Returns true unless waiting for propagation was disabled with a zero or
+// negative PropagationWait.
+func (c *Client) WaitsForPropagation() bool {
+	return c.checker != nil
+}
+
+// zoneFor returns the zone ID for name.
+//
+// When the Client was not created with a zone ID, the zone is found from the
+// domain, or from the zone apex of name, as determined by the SOA records of
+// name and its parent domains. Resolved zone IDs are cached, keyed by domain.
+func (c *Client) zoneFor(ctxt context.Context, name string) (string, error) {
+	// determine domain
+	domain := c.domain
+	switch {
+	case domain != "":
+		if name != domain && !strings.HasSuffix(name, "."+domain) {
+			return "", errors.New("invalid domain")
+		}
+		if c.zoneID != "" {
+			return c.zoneID, nil
+		}
+	case c.zoneID != "":
+		return c.zoneID, nil
+	default:
+		apex, err := c.resolver.Zone(ctxt, name)
+		if err != nil {
+			c.errf("could not determine zone for %s: %v", name, err)
+			return "", err
+		}
+		domain = strings.TrimSuffix(apex, ".")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if id, ok := c.zones[domain]; ok {
+		return id, nil
+	}
+	var res []zone
+	q := url.Values{"name": {domain}, "status": {"active"}}
+	if err := c.do(ctxt, c.zoneToken, "GET", "/zones?"+q.Encode(), nil, &res); err != nil {
+		c.errf("could not list zones for %s: %v", domain, err)
+		return "", err
+	}
+	for _, z := range res {
+		if strings.EqualFold(z.Name, domain) {
+			c.zones[domain] = z.ID
+			return z.ID, nil
+		}
+	}
+
+	return "", errors.New("no zone found for " + domain)
+}
+
+// zone is a Cloudflare zone.
+type zone struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// dnsRecord is a Cloudflare DNS record.
+type dnsRecord struct {
+	ID      string `json:"id,omitempty"`
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	TTL     int    `json:"ttl,omitempty"`
+}
+
+// response is a Cloudflare API response.
+type response struct {
+	Success bool            `json:"success"`
+	Errors  []apiError      `json:"errors"`
+	Result  json.RawMessage `json:"result"`
+}
+
+// apiError is a Cloudflare API error.
+type apiError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// Error satisfies the error interface.
+func (err apiError) Error() string {
+	return fmt.Sprintf("%s (%d)", err.Message, err.Code)
+}
+
+// do performs an API request with the token, decoding the result into v.
+func (c *Client) do(ctxt context.Context, token, method, path string, body, v interface{}) error {
+	var r io.Reader
+	if body != nil {
+		buf, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(buf)
+	}
+
+	req, err := http.NewRequest(method, c.baseURL+path, r)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctxt)
+	req.Header.Set("Authorization", "Bearer "+token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	var cfres response
+	if err = json.NewDecoder(res.Body).Decode(&cfres); err != nil {
+		return fmt.Errorf("could not decode response (status %d): %w", res.StatusCode, err)
+	}
+	if !cfres.Success || res.StatusCode >= 300 {
+		if len(cfres.Errors) != 0 {
+			return cfres.Errors[0]
+		}
+		return fmt.Errorf("request failed with status %d", res.StatusCode)
+	}
+	if v != nil {
+		return json.Unmarshal(cfres.Result, v)
+	}
+	return nil
+}
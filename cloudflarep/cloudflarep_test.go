@@ -0,0 +1,232 @@
+package cloudflarep
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/brankas/autocertdns/propagation"
+	"github.com/brankas/autocertdns/provision"
+)
+
+func TestProvision(t *testing.T) {
+	s := newStandIn(t)
+	s.records["existing"] = dnsRecord{ID: "existing", Type: "TXT", Name: "_acme-challenge.example.com", Content: "existing"}
+
+	checker, err := propagation.New(
+		propagation.Resolvers(s.ns),
+		propagation.Nameservers(s.ns),
+		propagation.Timeout(5*time.Second),
+		propagation.Interval(10*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	c, err := New(BaseURL(s.url), Token("token"), Checker(checker))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	records, err := c.ProvisionRecords(context.Background(), []provision.Challenge{
+		{Name: "_acme-challenge.example.com.", Type: "TXT", Value: "a"},
+		{Name: "_acme-challenge.www.example.com", Type: "TXT", Value: "b"},
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if len(s.records) != 3 {
+		t.Errorf("expected 3 records, got: %d", len(s.records))
+	}
+	for _, r := range s.records {
+		if r.TTL != DefaultTTL && r.ID != "existing" {
+			t.Errorf("expected ttl %d, got: %d", DefaultTTL, r.TTL)
+		}
+	}
+	// the zone apex example.com is cached after the first lookup
+	if s.zoneLookups != 1 {
+		t.Errorf("expected 1 zone lookup, got: %d", s.zoneLookups)
+	}
+
+	if err = c.UnprovisionRecords(context.Background(), records); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if _, ok := s.records["existing"]; len(s.records) != 1 || !ok {
+		t.Errorf("expected only existing record, got: %v", s.records)
+	}
+
+	// v1
+	if err = c.Provision(context.Background(), "TXT", "_acme-challenge.example.com", "c"); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err = c.Unprovision(context.Background(), "TXT", "_acme-challenge.example.com", "c"); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if len(s.records) != 1 {
+		t.Errorf("expected 1 record, got: %d", len(s.records))
+	}
+
+	// errors
+	if err = c.Provision(context.Background(), "TXT", "_acme-challenge.example.org", "d"); err == nil {
+		t.Errorf("expected error for unknown zone")
+	}
+	if c, err = New(BaseURL(s.url), Token("bad"), Checker(checker)); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err = c.Provision(context.Background(), "TXT", "_acme-challenge.example.com", "e"); err == nil || !strings.Contains(err.Error(), "Invalid access token") {
+		t.Errorf("expected authentication error, got: %v", err)
+	}
+}
+
+func TestWaitsForPropagation(t *testing.T) {
+	tests := []struct {
+		opts []Option
+		exp  bool
+	}{
+		{nil, true},
+		{[]Option{PropagationWait(0)}, false},
+		{[]Option{PropagationWait(-1), ZoneID("zone")}, false},
+	}
+	for i, test := range tests {
+		c, err := New(append([]Option{Token("token")}, test.opts...)...)
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		if waits := c.WaitsForPropagation(); waits != test.exp {
+			t.Errorf("test %d expected %t, got: %t", i, test.exp, waits)
+		}
+		if c.zoneID == "" && c.resolver == nil {
+			t.Errorf("test %d expected resolver to be created", i)
+		}
+	}
+}
+
+// standIn is a local stand-in for the Cloudflare API, serving the zone
+// example.com.
+type standIn struct {
+	url         string
+	ns          string
+	records     map[string]dnsRecord
+	zoneLookups int
+	last        int
+	sync.Mutex
+}
+
+// newStandIn starts a Cloudflare API stand-in, and a nameserver serving its
+// records.
+func newStandIn(t *testing.T) *standIn {
+	s := &standIn{records: make(map[string]dnsRecord)}
+
+	// start nameserver
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(s.serveDNS)}
+	started := make(chan struct{})
+	srv.NotifyStartedFunc = func() { close(started) }
+	go srv.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { srv.Shutdown() })
+	s.ns = pc.LocalAddr().String()
+
+	// start api
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+	s.url = ts.URL + "/client/v4"
+	return s
+}
+
+func (s *standIn) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	if req.Header.Get("Authorization") != "Bearer token" {
+		res.WriteHeader(http.StatusForbidden)
+		s.write(res, false, nil, apiError{Code: 9109, Message: "Invalid access token"})
+		return
+	}
+
+	path := strings.TrimPrefix(req.URL.Path, "/client/v4")
+	switch {
+	case req.Method == "GET" && path == "/zones":
+		s.zoneLookups++
+		var zones []zone
+		if req.URL.Query().Get("name") == "example.com" {
+			zones = append(zones, zone{ID: "zone1", Name: "example.com"})
+		}
+		s.write(res, true, zones)
+	case req.Method == "GET" && path == "/zones/zone1/dns_records":
+		q := req.URL.Query()
+		var records []dnsRecord
+		for _, r := range s.records {
+			if r.Name == q.Get("name") && r.Content == q.Get("content") {
+				records = append(records, r)
+			}
+		}
+		s.write(res, true, records)
+	case req.Method == "POST" && path == "/zones/zone1/dns_records":
+		var r dnsRecord
+		if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+			res.WriteHeader(http.StatusBadRequest)
+			s.write(res, false, nil, apiError{Code: 1, Message: err.Error()})
+			return
+		}
+		s.last++
+		r.ID = fmt.Sprintf("record%d", s.last)
+		s.records[r.ID] = r
+		s.write(res, true, r)
+	case req.Method == "DELETE" && strings.HasPrefix(path, "/zones/zone1/dns_records/"):
+		id := strings.TrimPrefix(path, "/zones/zone1/dns_records/")
+		if _, ok := s.records[id]; !ok {
+			res.WriteHeader(http.StatusNotFound)
+			s.write(res, false, nil, apiError{Code: 81044, Message: "Record does not exist"})
+			return
+		}
+		delete(s.records, id)
+		s.write(res, true, map[string]string{"id": id})
+	default:
+		res.WriteHeader(http.StatusNotFound)
+		s.write(res, false, nil, apiError{Code: 7003, Message: "Could not route"})
+	}
+}
+
+func (s *standIn) write(res http.ResponseWriter, success bool, result interface{}, errs ...apiError) {
+	buf, _ := json.Marshal(result)
+	json.NewEncoder(res).Encode(response{Success: success, Errors: errs, Result: buf})
+}
+
+func (s *standIn) serveDNS(w dns.ResponseWriter, req *dns.Msg) {
+	s.Lock()
+	defer s.Unlock()
+
+	res := new(dns.Msg)
+	res.SetReply(req)
+	res.Authoritative = true
+	q := req.Question[0]
+	switch {
+	case q.Qtype == dns.TypeSOA && strings.EqualFold(q.Name, "example.com."):
+		res.Answer = append(res.Answer, &dns.SOA{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 10},
+			Ns:  "ns.example.com.", Mbox: "hostmaster.example.com.", Serial: 1,
+		})
+	case q.Qtype == dns.TypeTXT:
+		for _, r := range s.records {
+			if strings.EqualFold(r.Name+".", q.Name) {
+				res.Answer = append(res.Answer, &dns.TXT{
+					Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 10},
+					Txt: []string{r.Content},
+				})
+			}
+		}
+	}
+	w.WriteMsg(res)
+}
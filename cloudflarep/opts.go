@@ -0,0 +1,113 @@
+package cloudflarep
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/brankas/autocertdns/propagation"
+)
+
+// Option is the Client option type.
+type Option func(c *Client) error
+
+// Token is a Client option to set the scoped API token.
+func Token(token string) Option {
+	return func(c *Client) error {
+		c.token = token
+		return nil
+	}
+}
+
+// ZoneToken is a Client option to set a separate scoped API token, with the
+// Zone.Zone:Read permission, used to look up zone IDs.
+//
+// If not set, the API token is used.
+func ZoneToken(token string) Option {
+	return func(c *Client) error {
+		c.zoneToken = token
+		return nil
+	}
+}
+
+// ZoneID is a Client option to set the zone ID.
+//
+// If not set, the zone ID is looked up by the domain.
+func ZoneID(zoneID string) Option {
+	return func(c *Client) error {
+		c.zoneID = zoneID
+		return nil
+	}
+}
+
+// Domain is a Client option to set the domain.
+//
+// If not set, the domain is the zone apex of the provisioned name, as
+// determined by its SOA records.
+func Domain(domain string) Option {
+	return func(c *Client) error {
+		c.domain = domain
+		return nil
+	}
+}
+
+// TTL is a Client option to set the TTL of provisioned records.
+func TTL(ttl int) Option {
+	return func(c *Client) error {
+		c.ttl = ttl
+		return nil
+	}
+}
+
+// BaseURL is a Client option to set the Cloudflare API base URL.
+func BaseURL(baseURL string) Option {
+	return func(c *Client) error {
+		c.baseURL = baseURL
+		return nil
+	}
+}
+
+// HTTPClient is a Client option that sets the http.Client used.
+func HTTPClient(client *http.Client) Option {
+	return func(c *Client) error {
+		c.client = client
+		return nil
+	}
+}
+
+// Checker is a Client option to set the propagation checker used to wait for
+// provisioned records to propagate. The checker is also used to look up zone
+// apexes.
+func Checker(checker *propagation.Checker) Option {
+	return func(c *Client) error {
+		c.checker = checker
+		return nil
+	}
+}
+
+// PropagationWait is a Client option to wait up to d for provisioned records
+// to propagate to the zone's nameservers.
+//
+// If not set, records are waited on for DefaultPropagationWait. A zero or
+// negative d disables waiting for propagation.
+func PropagationWait(d time.Duration) Option {
+	return func(c *Client) error {
+		c.propagationWait = d
+		return nil
+	}
+}
+
+// Logf is a Client option to specify the logging function used.
+func Logf(f func(string, ...interface{})) Option {
+	return func(c *Client) error {
+		c.logf = f
+		return nil
+	}
+}
+
+// Errorf is a Client option to specify the error logging function used.
+func Errorf(f func(string, ...interface{})) Option {
+	return func(c *Client) error {
+		c.errf = f
+		return nil
+	}
+}
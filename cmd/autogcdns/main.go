@@ -20,16 +20,18 @@ import (
 	dns "google.golang.org/api/dns/v2beta1"
 
 	"github.com/brankas/autocertdns"
+	"github.com/brankas/autocertdns/certbotexp"
 	"github.com/brankas/autocertdns/gcdnsp"
 )
 
 var (
 	flagCreds   = flag.String("creds", "", "path to credentials")
 	flagDomain  = flag.String("d", "", "domain to generate a certificate for")
-	flagZone    = flag.String("z", "", "managed zone name")
+	flagZone    = flag.String("z", "", "managed zone name (default: determined from the domain)")
 	flagCerts   = flag.String("certs", "certs", "certificates path")
 	flagEmail   = flag.String("email", "", "registration email account")
 	flagProject = flag.String("project", "", "project id")
+	flagCertbot = flag.String("certbot", "", "export certificates to certbot layout in path")
 
 	flagWait    = flag.Duration("wait", 180*time.Second, "propagation wait")
 	flagDelay   = flag.Duration("delay", 20*time.Second, "provision delay")
@@ -88,21 +90,14 @@ func run(ctxt context.Context) error {
 		*flagProject = gsa.ProjectID
 	}
 
-	// determine the managed zone name
-	if *flagZone == "" {
-		if *flagZone, err = loadZone(ctxt, gsa, dnsService); err != nil {
-			return err
-		}
-	}
-
 	// force an email address
 	if *flagEmail == "" {
 		*flagEmail = "admin@" + *flagDomain
 	}
 
-	// create provisioner
+	// create provisioner, determining the managed zone from the zone apex of
+	// the domain when not specified
 	p, err := gcdnsp.New(
-		gcdnsp.Domain(*flagDomain),
 		gcdnsp.ManagedZone(*flagZone),
 		gcdnsp.ProjectID(*flagProject),
 		gcdnsp.DNSService(dnsService),
@@ -121,6 +116,19 @@ func run(ctxt context.Context) error {
 		return err
 	}
 
+	// create certbot layout exporter
+	var exporters []autocertdns.Exporter
+	if *flagCertbot != "" {
+		e, err := certbotexp.New(
+			certbotexp.Dir(*flagCertbot),
+			certbotexp.Logf(log.Printf),
+		)
+		if err != nil {
+			return err
+		}
+		exporters = append(exporters, e)
+	}
+
 	// create manager
 	m := &autocertdns.Manager{
 		Prompt:      autocert.AcceptTOS,
@@ -128,6 +136,7 @@ func run(ctxt context.Context) error {
 		Email:       *flagEmail,
 		CacheDir:    *flagCerts,
 		Provisioner: p,
+		Exporters:   exporters,
 		Logf:        log.Printf,
 		Errorf:      func(string, ...interface{}) {},
 	}
@@ -140,33 +149,6 @@ func run(ctxt context.Context) error {
 	return nil
 }
 
-// loadZone determines the managed zone for the provided domain and
-// credentials.
-func loadZone(ctxt context.Context, gsa *gserviceaccount.GServiceAccount, dnsService *dns.Service) (string, error) {
-	// list managed zones
-	res, err := dnsService.ManagedZones.List(*flagProject).Do()
-	if err != nil {
-		return "", err
-	}
-
-	if len(res.ManagedZones) == 0 {
-		return "", fmt.Errorf("no managed zones in project %q", *flagProject)
-	}
-
-	// find the managed zone with the longest dns name matching the domain flag
-	zone := res.ManagedZones[0]
-	for _, z := range res.ManagedZones {
-		if strings.HasSuffix(*flagDomain, zone.DnsName) && len(z.DnsName) > len(zone.DnsName) {
-			zone = z
-		}
-	}
-	if !strings.HasSuffix(*flagDomain, zone.DnsName) {
-		return "", fmt.Errorf("can not find the managed zone name in project %q for domain %q", *flagProject, *flagDomain)
-	}
-
-	return zone.Name, nil
-}
-
 // transportFromEnv builds a http transport from environment variables, adding
 // a HTTP proxy if HTTP_PROXY or HTTPS_PROXY has been set.
 func transportFromEnv() http.RoundTripper {
@@ -0,0 +1,364 @@
+// Package dnsserverp provides an embedded authoritative DNS server that
+// satisfies autocertdns.Provisioner and autocertdns.ProvisionerV2.
+//
+// The server answers TXT queries for provisioned challenges from memory, and
+// is intended for challenge names delegated (by NS or CNAME records) to the
+// host running the autocertdns.Manager. For example, with the zone
+// acme.example.com served by the Server on ns.acme.example.com:
+//
+//	acme.example.com.            NS     ns.acme.example.com.
+//	ns.acme.example.com.         A      192.0.2.1
+//	_acme-challenge.example.com. CNAME  example.com.acme.example.com.
+package dnsserverp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+
+	"github.com/brankas/autocertdns/provision"
+)
+
+const (
+	// allowedRecordType is the allowed record provisioning type.
+	allowedRecordType = "TXT"
+
+	// DefaultAddr is the default listen address.
+	DefaultAddr = ":53"
+
+	// DefaultTTL is the default TTL of served records.
+	DefaultTTL = 60
+)
+
+// record is a handle to a provisioned record.
+type record struct {
+	name  string
+	value string
+}
+
+// Server is an embedded authoritative DNS server.
+type Server struct {
+	addr       string
+	zone       string
+	nameserver string
+	mbox       string
+	ttl        uint32
+	logf       func(string, ...interface{})
+	errf       func(string, ...interface{})
+
+	udp *dns.Server
+	tcp *dns.Server
+
+	serial  uint32
+	records map[string][]string
+	mu      sync.RWMutex
+}
+
+// New creates and starts an embedded authoritative DNS server, listening for
+// UDP and TCP queries.
+func New(opts ...Option) (*Server, error) {
+	s := &Server{
+		addr:    DefaultAddr,
+		ttl:     DefaultTTL,
+		serial:  1,
+		records: make(map[string][]string),
+		logf:    func(string, ...interface{}) {},
+	}
+
+	// apply opts
+	for _, o := range opts {
+		if err := o(s); err != nil {
+			return nil, err
+		}
+	}
+
+	// ensure errf is set
+	if s.errf == nil {
+		s.errf = func(str string, v ...interface{}) {
+			s.logf("ERROR: "+str, v...)
+		}
+	}
+
+	if s.zone == "" {
+		return nil, errors.New("dnsserverp missing zone")
+	}
+	s.zone = dns.Fqdn(strings.ToLower(s.zone))
+	if s.nameserver == "" {
+		s.nameserver = "ns." + s.zone
+	}
+	s.nameserver = dns.Fqdn(strings.ToLower(s.nameserver))
+	if s.mbox == "" {
+		s.mbox = "hostmaster." + s.zone
+	}
+	s.mbox = dns.Fqdn(strings.Replace(s.mbox, "@", ".", 1))
+
+	if err := s.listen(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// listen starts the UDP and TCP servers on the same address.
+func (s *Server) listen() error {
+	pc, err := net.ListenPacket("udp", s.addr)
+	if err != nil {
+		return err
+	}
+
+	// use the same port for tcp when listening on an ephemeral port
+	addr := s.addr
+	if host, port, err := net.SplitHostPort(addr); err == nil && port == "0" {
+		addr = net.JoinHostPort(host, pcPort(pc))
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		pc.Close()
+		return err
+	}
+
+	s.udp = &dns.Server{PacketConn: pc, Handler: s}
+	s.tcp = &dns.Server{Listener: l, Handler: s}
+
+	if err := s.serve(s.udp); err != nil {
+		pc.Close()
+		l.Close()
+		return err
+	}
+	if err := s.serve(s.tcp); err != nil {
+		s.udp.Shutdown()
+		l.Close()
+		return err
+	}
+	s.logf("serving zone %s on %s", s.zone, pc.LocalAddr())
+
+	return nil
+}
+
+// serve starts srv in a goroutine, returning once it has started, or with
+// the error that stopped it from starting.
+func (s *Server) serve(srv *dns.Server) error {
+	started, errs := make(chan struct{}), make(chan error, 1)
+	srv.NotifyStartedFunc = func() { close(started) }
+	go func() {
+		err := srv.ActivateAndServe()
+		if err != nil {
+			s.errf("dns server stopped: %v", err)
+		}
+		errs <- err
+	}()
+	select {
+	case <-started:
+		return nil
+	case err := <-errs:
+		if err == nil {
+			err = errors.New("dns server stopped")
+		}
+		return err
+	}
+}
+
+// pcPort returns the port of the packet conn's local address.
+func pcPort(pc net.PacketConn) string {
+	_, port, _ := net.SplitHostPort(pc.LocalAddr().String())
+	return port
+}
+
+// Addr returns the address the server is listening on.
+func (s *Server) Addr() string {
+	return s.udp.PacketConn.LocalAddr().String()
+}
+
+// Close stops the server.
+func (s *Server) Close() error {
+	err := s.udp.Shutdown()
+	if e := s.tcp.Shutdown(); e != nil && err == nil {
+		err = e
+	}
+	return err
+}
+
+// Provision adds a DNS record of typ, for the specified domain name and with
+// the value in token, to the records served.
+func (s *Server) Provision(ctxt context.Context, typ, name, token string) error {
+	_, err := s.ProvisionRecords(ctxt, []provision.Challenge{{Type: typ, Name: name, Value: token}})
+	return err
+}
+
+// Unprovision removes the DNS record of typ, for the specified domain name,
+// and for the record with the specified token as the value, from the records
+// served.
+func (s *Server) Unprovision(ctxt context.Context, typ, name, token string) error {
+	if typ != allowedRecordType {
+		return errors.New("only TXT records are supported")
+	}
+	return s.UnprovisionRecords(ctxt, []provision.Record{&record{name: canonical(name), value: token}})
+}
+
+// ProvisionRecords adds the records for the challenges to the records served.
+func (s *Server) ProvisionRecords(_ context.Context, challenges []provision.Challenge) ([]provision.Record, error) {
+	// check names
+	for _, ch := range challenges {
+		if ch.Type != allowedRecordType {
+			return nil, errors.New("only TXT records are supported")
+		}
+		if !s.inZone(canonical(ch.Name)) {
+			return nil, errors.New("name " + ch.Name + " not in zone " + s.zone)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var records []provision.Record
+	for _, ch := range challenges {
+		r := &record{name: canonical(ch.Name), value: ch.Value}
+		s.logf("provisioning (type: %s, name: %s, token: %s)", allowedRecordType, r.name, r.value)
+		s.records[r.name] = append(s.records[r.name], r.value)
+		records = append(records, r)
+	}
+	s.serial++
+
+	return records, nil
+}
+
+// UnprovisionRecords removes the provisioned records from the records served.
+func (s *Server) UnprovisionRecords(_ context.Context, records []provision.Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var err error
+	for _, rec := range records {
+		r, ok := rec.(*record)
+		if !ok {
+			if err == nil {
+				err = provision.ErrUnknownRecord
+			}
+			continue
+		}
+
+		s.logf("unprovisioning (type: %s, name: %s, token: %s)", allowedRecordType, r.name, r.value)
+		values, found := s.records[r.name], false
+		for i, v := range values {
+			if v == r.value {
+				values, found = append(values[:i:i], values[i+1:]...), true
+				break
+			}
+		}
+		switch {
+		case !found:
+			if err == nil {
+				err = errors.New("record not found")
+			}
+		case len(values) == 0:
+			delete(s.records, r.name)
+		default:
+			s.records[r.name] = values
+		}
+	}
+	s.serial++
+
+	return err
+}
+
+// WaitsForPropagation satisfies the autocertdns.ProvisionerV2 interface.
+//
+// Records are served as soon as they are provisioned, so always returns true.
+func (s *Server) WaitsForPropagation() bool {
+	return true
+}
+
+// ServeDNS satisfies the dns.Handler interface.
+func (s *Server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	res := new(dns.Msg)
+	res.SetReply(req)
+	defer func() {
+		if err := w.WriteMsg(res); err != nil {
+			s.errf("could not write response: %v", err)
+		}
+	}()
+
+	if req.Opcode != dns.OpcodeQuery || len(req.Question) != 1 {
+		res.Rcode = dns.RcodeNotImplemented
+		return
+	}
+	q := req.Question[0]
+	name := canonical(q.Name)
+	if q.Qclass != dns.ClassINET || !s.inZone(name) {
+		res.Rcode = dns.RcodeRefused
+		return
+	}
+	res.Authoritative = true
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	switch {
+	case q.Qtype == dns.TypeTXT && len(s.records[name]) != 0:
+		for _, v := range s.records[name] {
+			res.Answer = append(res.Answer, &dns.TXT{
+				Hdr: s.hdr(q.Name, dns.TypeTXT),
+				Txt: []string{v},
+			})
+		}
+	case q.Qtype == dns.TypeSOA && name == s.zone:
+		res.Answer = append(res.Answer, s.soa())
+	case q.Qtype == dns.TypeNS && name == s.zone:
+		res.Answer = append(res.Answer, &dns.NS{
+			Hdr: s.hdr(s.zone, dns.TypeNS),
+			Ns:  s.nameserver,
+		})
+	case s.exists(name):
+		res.Ns = append(res.Ns, s.soa())
+	default:
+		res.Rcode = dns.RcodeNameError
+		res.Ns = append(res.Ns, s.soa())
+	}
+}
+
+// exists returns true when name is the zone apex, has records, or is an empty
+// non-terminal above a name with records.
+func (s *Server) exists(name string) bool {
+	if name == s.zone {
+		return true
+	}
+	for n := range s.records {
+		if n == name || strings.HasSuffix(n, "."+name) {
+			return true
+		}
+	}
+	return false
+}
+
+// inZone returns true when name is in the served zone.
+func (s *Server) inZone(name string) bool {
+	return name == s.zone || strings.HasSuffix(name, "."+s.zone)
+}
+
+// soa returns the SOA record for the zone.
+func (s *Server) soa() *dns.SOA {
+	return &dns.SOA{
+		Hdr:     s.hdr(s.zone, dns.TypeSOA),
+		Ns:      s.nameserver,
+		Mbox:    s.mbox,
+		Serial:  s.serial,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  s.ttl,
+	}
+}
+
+// hdr returns a record header.
+func (s *Server) hdr(name string, typ uint16) dns.RR_Header {
+	return dns.RR_Header{Name: name, Rrtype: typ, Class: dns.ClassINET, Ttl: s.ttl}
+}
+
+// canonical returns the lower case, fully qualified form of name.
+func canonical(name string) string {
+	return dns.Fqdn(strings.ToLower(name))
+}
@@ -0,0 +1,102 @@
+package dnsserverp
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/brankas/autocertdns/provision"
+)
+
+func TestServer(t *testing.T) {
+	s, err := New(Addr("127.0.0.1:0"), Zone("acme.example.com"))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	defer s.Close()
+
+	records, err := s.ProvisionRecords(context.Background(), []provision.Challenge{
+		{Name: "example.com.acme.example.com", Type: "TXT", Value: "a"},
+		{Name: "Example.com.acme.example.com.", Type: "TXT", Value: "b"},
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err = s.Provision(context.Background(), "TXT", "_acme-challenge.example.org", "c"); err == nil {
+		t.Errorf("expected error for name outside zone")
+	}
+
+	tests := []struct {
+		name    string
+		typ     uint16
+		rcode   int
+		answers int
+		soa     bool
+	}{
+		{"example.com.acme.example.com.", dns.TypeTXT, dns.RcodeSuccess, 2, false},
+		{"EXAMPLE.com.acme.example.com.", dns.TypeTXT, dns.RcodeSuccess, 2, false},
+		{"example.com.acme.example.com.", dns.TypeA, dns.RcodeSuccess, 0, true},
+		{"com.acme.example.com.", dns.TypeTXT, dns.RcodeSuccess, 0, true},
+		{"other.acme.example.com.", dns.TypeTXT, dns.RcodeNameError, 0, true},
+		{"acme.example.com.", dns.TypeSOA, dns.RcodeSuccess, 1, false},
+		{"acme.example.com.", dns.TypeNS, dns.RcodeSuccess, 1, false},
+		{"example.org.", dns.TypeTXT, dns.RcodeRefused, 0, false},
+	}
+	for _, network := range []string{"udp", "tcp"} {
+		client := &dns.Client{Net: network}
+		for i, test := range tests {
+			m := new(dns.Msg)
+			m.SetQuestion(test.name, test.typ)
+			res, _, err := client.Exchange(m, s.Addr())
+			if err != nil {
+				t.Fatalf("%s test %d expected no error, got: %v", network, i, err)
+			}
+			if res.Rcode != test.rcode {
+				t.Errorf("%s test %d expected rcode %s, got: %s", network, i, dns.RcodeToString[test.rcode], dns.RcodeToString[res.Rcode])
+			}
+			if len(res.Answer) != test.answers {
+				t.Errorf("%s test %d expected %d answers, got: %d", network, i, test.answers, len(res.Answer))
+			}
+			if soa := len(res.Ns) == 1 && res.Ns[0].Header().Rrtype == dns.TypeSOA; soa != test.soa {
+				t.Errorf("%s test %d expected soa %t, got: %t", network, i, test.soa, soa)
+			}
+		}
+	}
+
+	// unprovision
+	if err = s.UnprovisionRecords(context.Background(), records); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.acme.example.com.", dns.TypeTXT)
+	res, err := dns.Exchange(m, s.Addr())
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if res.Rcode != dns.RcodeNameError {
+		t.Errorf("expected NXDOMAIN, got: %s", dns.RcodeToString[res.Rcode])
+	}
+}
+
+func TestServeError(t *testing.T) {
+	s := &Server{
+		logf: func(string, ...interface{}) {},
+		errf: func(string, ...interface{}) {},
+	}
+
+	// server without a listener fails to start
+	errs := make(chan error, 1)
+	go func() {
+		errs <- s.serve(&dns.Server{Handler: s})
+	}()
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Errorf("expected error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected serve to return")
+	}
+}
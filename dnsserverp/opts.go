@@ -0,0 +1,70 @@
+package dnsserverp
+
+// Option is the Server option type.
+type Option func(s *Server) error
+
+// Addr is a Server option to set the UDP and TCP listen address.
+//
+// If not set, DefaultAddr is used. When the port is 0, the UDP and TCP
+// servers listen on the same ephemeral port, available from Server.Addr.
+func Addr(addr string) Option {
+	return func(s *Server) error {
+		s.addr = addr
+		return nil
+	}
+}
+
+// Zone is a Server option to set the zone the server is authoritative for.
+// Provisioned names must be in the zone.
+func Zone(zone string) Option {
+	return func(s *Server) error {
+		s.zone = zone
+		return nil
+	}
+}
+
+// Nameserver is a Server option to set the host name of the server, used in
+// the zone's SOA and NS records.
+//
+// If not set, ns.<zone> is used.
+func Nameserver(nameserver string) Option {
+	return func(s *Server) error {
+		s.nameserver = nameserver
+		return nil
+	}
+}
+
+// Hostmaster is a Server option to set the email address of the person
+// responsible for the zone, used in the zone's SOA record.
+//
+// If not set, hostmaster@<zone> is used.
+func Hostmaster(email string) Option {
+	return func(s *Server) error {
+		s.mbox = email
+		return nil
+	}
+}
+
+// TTL is a Server option to set the TTL of served records.
+func TTL(ttl uint32) Option {
+	return func(s *Server) error {
+		s.ttl = ttl
+		return nil
+	}
+}
+
+// Logf is a Server option to specify the logging function used.
+func Logf(f func(string, ...interface{})) Option {
+	return func(s *Server) error {
+		s.logf = f
+		return nil
+	}
+}
+
+// Errorf is a Server option to specify the error logging function used.
+func Errorf(f func(string, ...interface{})) Option {
+	return func(s *Server) error {
+		s.errf = f
+		return nil
+	}
+}
@@ -0,0 +1,302 @@
+// Package execp provides a provisioner that runs external commands to
+// provision DNS records, and that satisfies autocertdns.Provisioner and
+// autocertdns.ProvisionerV2.
+//
+// Similar to certbot's manual auth hooks, the present and cleanup commands are
+// run once for each record, with the record passed in the following
+// environment variables:
+//
+//	AUTOCERTDNS_ACTION  present or cleanup
+//	AUTOCERTDNS_TYPE    record type (TXT)
+//	AUTOCERTDNS_NAME    fully qualified record name, without trailing dot
+//	AUTOCERTDNS_TOKEN   record value
+//	AUTOCERTDNS_ZONE    zone apex of the record name, without trailing dot
+//	AUTOCERTDNS_RECORD  record name relative to the zone
+//	AUTOCERTDNS_DOMAIN  certificate domain being validated, when known
+//
+// The same variables, and only those, are expanded in the command arguments,
+// for example:
+//
+//	execp.Present("/usr/local/bin/dns-hook", "add", "$AUTOCERTDNS_NAME", "$AUTOCERTDNS_TOKEN")
+//
+// A command exiting with a non-zero exit code fails provisioning. The output
+// of each command is logged.
+package execp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/brankas/autocertdns/propagation"
+	"github.com/brankas/autocertdns/provision"
+)
+
+const (
+	// allowedRecordType is the allowed record provisioning type.
+	allowedRecordType = "TXT"
+
+	// DefaultTimeout is the default command timeout.
+	DefaultTimeout = 2 * time.Minute
+)
+
+// Actions passed to commands.
+const (
+	ActionPresent = "present"
+	ActionCleanup = "cleanup"
+)
+
+// record is a handle to a provisioned record.
+type record struct {
+	challenge provision.Challenge
+	zone      string
+}
+
+// Client runs external commands to provision DNS records.
+type Client struct {
+	present    []string
+	cleanup    []string
+	dir        string
+	env        []string
+	zone       string
+	timeout    time.Duration
+	checker    *propagation.Checker
+	propagates bool
+	logf       func(string, ...interface{})
+	errf       func(string, ...interface{})
+}
+
+// New creates a new exec hook provisioner.
+func New(opts ...Option) (*Client, error) {
+	c := &Client{
+		timeout: DefaultTimeout,
+		logf:    func(string, ...interface{}) {},
+	}
+
+	// apply opts
+	for _, o := range opts {
+		if err := o(c); err != nil {
+			return nil, err
+		}
+	}
+
+	// ensure errf is set
+	if c.errf == nil {
+		c.errf = func(s string, v ...interface{}) {
+			c.logf("ERROR: "+s, v...)
+		}
+	}
+
+	if len(c.present) == 0 {
+		return nil, errors.New("execp missing present command")
+	}
+	c.zone = strings.TrimSuffix(c.zone, ".")
+
+	return c, nil
+}
+
+// Provision runs the present command for a DNS record of typ, for the
+// specified domain name and with the value in token.
+func (c *Client) Provision(ctxt context.Context, typ, name, token string) error {
+	_, err := c.ProvisionRecords(ctxt, []provision.Challenge{{Type: typ, Name: name, Value: token}})
+	return err
+}
+
+// Unprovision runs the cleanup command for the DNS record of typ, for the
+// specified domain name, and for the record with the specified token as the
+// value.
+func (c *Client) Unprovision(ctxt context.Context, typ, name, token string) error {
+	if typ != allowedRecordType {
+		return errors.New("only TXT records are supported")
+	}
+	return c.UnprovisionRecords(ctxt, []provision.Record{&record{
+		challenge: provision.Challenge{Type: typ, Name: name, Value: token},
+		zone:      c.zoneFor(ctxt, name),
+	}})
+}
+
+// ProvisionRecords runs the present command for each challenge in turn.
+//
+// When the Client has a propagation checker, it waits for the records to
+// propagate.
+func (c *Client) ProvisionRecords(ctxt context.Context, challenges []provision.Challenge) ([]provision.Record, error) {
+	var records []provision.Record
+	for _, ch := range challenges {
+		if ch.Type != allowedRecordType {
+			return records, errors.New("only TXT records are supported")
+		}
+		r := &record{challenge: ch, zone: c.zoneFor(ctxt, ch.Name)}
+		c.logf("provisioning (type: %s, name: %s, token: %s)", ch.Type, ch.Name, ch.Value)
+		if err := c.run(ctxt, ActionPresent, c.present, r); err != nil {
+			return records, err
+		}
+		records = append(records, r)
+	}
+
+	// wait for propagation
+	if c.checker != nil {
+		for _, ch := range challenges {
+			if err := c.checker.Wait(ctxt, ch.Name, ch.Value); err != nil {
+				return records, err
+			}
+		}
+	}
+
+	return records, nil
+}
+
+// UnprovisionRecords runs the cleanup command for each record, returning the
+// first error encountered.
+func (c *Client) UnprovisionRecords(ctxt context.Context, records []provision.Record) error {
+	var err error
+	for _, rec := range records {
+		r, ok := rec.(*record)
+		if !ok {
+			if err == nil {
+				err = provision.ErrUnknownRecord
+			}
+			continue
+		}
+		if len(c.cleanup) == 0 {
+			continue
+		}
+		c.logf("unprovisioning (type: %s, name: %s, token: %s)", r.challenge.Type, r.challenge.Name, r.challenge.Value)
+		if e := c.run(ctxt, ActionCleanup, c.cleanup, r); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// WaitsForPropagation satisfies the autocertdns.ProvisionerV2 interface.
+//
+// Returns true when the Client was created with a propagation checker, or
+// with the HookWaits option.
+func (c *Client) WaitsForPropagation() bool {
+	return c.checker != nil || c.propagates
+}
+
+// run runs the command for the record, logging its output.
+func (c *Client) run(ctxt context.Context, action string, command []string, r *record) error {
+	vars := c.vars(action, r)
+	var pairs []string
+	for k, v := range vars {
+		pairs = append(pairs, "${"+k+"}", v, "$"+k, v)
+	}
+	expand := strings.NewReplacer(pairs...)
+	args := make([]string, len(command)-1)
+	for i, arg := range command[1:] {
+		args[i] = expand.Replace(arg)
+	}
+
+	// capture output in files, so that a killed command's children do not
+	// hold the command open
+	stdout, err := ioutil.TempFile("", "execp-stdout-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(stdout.Name())
+	defer stdout.Close()
+	stderr, err := ioutil.TempFile("", "execp-stderr-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(stderr.Name())
+	defer stderr.Close()
+
+	ctxt, cancel := context.WithTimeout(ctxt, c.timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctxt, command[0], args...)
+	cmd.Dir = c.dir
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	cmd.Env = append(os.Environ(), c.env...)
+	for k, v := range vars {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+
+	start := time.Now()
+	err = cmd.Run()
+	c.logOutput(action, "stdout", stdout)
+	c.logOutput(action, "stderr", stderr)
+
+	switch {
+	case ctxt.Err() == context.DeadlineExceeded:
+		err = fmt.Errorf("%s command %s timed out after %v", action, command[0], c.timeout)
+	case err != nil:
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			err = fmt.Errorf("%s command %s exited with code %d", action, command[0], exitErr.ExitCode())
+		} else {
+			err = fmt.Errorf("%s command %s: %w", action, command[0], err)
+		}
+	default:
+		c.logf("%s command %s completed in %v", action, command[0], time.Since(start))
+		return nil
+	}
+	c.errf("%v", err)
+	return err
+}
+
+// logOutput logs each line of the command output written to f.
+func (c *Client) logOutput(action, stream string, f *os.File) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		c.errf("could not read %s %s: %v", action, stream, err)
+		return
+	}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		c.logf("%s %s: %s", action, stream, s.Text())
+	}
+}
+
+// vars returns the environment variables for the record.
+func (c *Client) vars(action string, r *record) map[string]string {
+	name := strings.TrimSuffix(r.challenge.Name, ".")
+	rel := strings.TrimSuffix(name, "."+r.zone)
+	if r.zone == "" || rel == name {
+		rel = name
+	}
+	return map[string]string{
+		"AUTOCERTDNS_ACTION": action,
+		"AUTOCERTDNS_TYPE":   r.challenge.Type,
+		"AUTOCERTDNS_NAME":   name,
+		"AUTOCERTDNS_TOKEN":  r.challenge.Value,
+		"AUTOCERTDNS_ZONE":   r.zone,
+		"AUTOCERTDNS_RECORD": rel,
+		"AUTOCERTDNS_DOMAIN": r.challenge.Domain,
+	}
+}
+
+// zoneFor returns the zone for name.
+//
+// When the Client was not created with a zone, the zone is determined from
+// the zone apex of name. When the zone apex cannot be determined, the error
+// is logged and an empty zone is returned, leaving it to the commands to
+// determine the zone.
+func (c *Client) zoneFor(ctxt context.Context, name string) string {
+	if c.zone != "" {
+		return c.zone
+	}
+	checker := c.checker
+	if checker == nil {
+		var err error
+		if checker, err = propagation.New(propagation.Logf(c.logf), propagation.Errorf(c.errf)); err != nil {
+			c.errf("could not determine zone for %s: %v", name, err)
+			return ""
+		}
+	}
+	zone, err := checker.Zone(ctxt, name)
+	if err != nil {
+		c.errf("could not determine zone for %s: %v", name, err)
+		return ""
+	}
+	return strings.TrimSuffix(zone, ".")
+}
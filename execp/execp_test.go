@@ -0,0 +1,92 @@
+package execp
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/brankas/autocertdns/provision"
+)
+
+func TestExec(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not available")
+	}
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out")
+
+	var mu sync.Mutex
+	var logs []string
+	c, err := New(
+		Zone("example.com."),
+		Present("sh", "-c", `echo "$AUTOCERTDNS_ACTION $1 $AUTOCERTDNS_RECORD $AUTOCERTDNS_ZONE $AUTOCERTDNS_TOKEN" >> `+out+`; echo presented`, "sh", "$AUTOCERTDNS_NAME"),
+		Cleanup("sh", "-c", `echo "$AUTOCERTDNS_ACTION $AUTOCERTDNS_NAME $AUTOCERTDNS_DOMAIN" >> `+out),
+		Logf(func(s string, v ...interface{}) {
+			mu.Lock()
+			defer mu.Unlock()
+			logs = append(logs, fmt.Sprintf(s, v...))
+		}),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	records, err := c.ProvisionRecords(context.Background(), []provision.Challenge{
+		{Domain: "www.example.com", Name: "_acme-challenge.www.example.com.", Type: "TXT", Value: "a"},
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err = c.UnprovisionRecords(context.Background(), records); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	buf, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	exp := "present _acme-challenge.www.example.com _acme-challenge.www example.com a\n" +
+		"cleanup _acme-challenge.www.example.com www.example.com\n"
+	if s := string(buf); s != exp {
+		t.Errorf("expected:\n%s\ngot:\n%s", exp, s)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if s := strings.Join(logs, "\n"); !strings.Contains(s, "present stdout: presented") {
+		t.Errorf("expected command output to be logged, got:\n%s", s)
+	}
+}
+
+func TestExecErrors(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not available")
+	}
+
+	c, err := New(Zone("example.com"), Present("sh", "-c", "echo failed >&2; exit 3"))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	err = c.Provision(context.Background(), "TXT", "_acme-challenge.example.com", "a")
+	if err == nil || !strings.Contains(err.Error(), "code 3") {
+		t.Errorf("expected exit code error, got: %v", err)
+	}
+
+	c, err = New(Zone("example.com"), Present("sh", "-c", "sleep 10"), Timeout(50*time.Millisecond))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	start := time.Now()
+	err = c.Provision(context.Background(), "TXT", "_acme-challenge.example.com", "a")
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("expected timeout error, got: %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("expected command to be killed, took: %v", d)
+	}
+}
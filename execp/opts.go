@@ -0,0 +1,109 @@
+package execp
+
+import (
+	"errors"
+	"time"
+
+	"github.com/brankas/autocertdns/propagation"
+)
+
+// Option is the Client option type.
+type Option func(c *Client) error
+
+// Present is a Client option to set the command, and its arguments, run to
+// provision a record.
+func Present(cmd string, args ...string) Option {
+	return func(c *Client) error {
+		if cmd == "" {
+			return errors.New("execp empty present command")
+		}
+		c.present = append([]string{cmd}, args...)
+		return nil
+	}
+}
+
+// Cleanup is a Client option to set the command, and its arguments, run to
+// unprovision a record.
+//
+// If not set, unprovisioning does nothing.
+func Cleanup(cmd string, args ...string) Option {
+	return func(c *Client) error {
+		if cmd == "" {
+			return errors.New("execp empty cleanup command")
+		}
+		c.cleanup = append([]string{cmd}, args...)
+		return nil
+	}
+}
+
+// Dir is a Client option to set the working directory of the commands.
+func Dir(dir string) Option {
+	return func(c *Client) error {
+		c.dir = dir
+		return nil
+	}
+}
+
+// Env is a Client option to add environment variables (in the form
+// key=value) passed to the commands, in addition to the environment of the
+// current process.
+func Env(env ...string) Option {
+	return func(c *Client) error {
+		c.env = append(c.env, env...)
+		return nil
+	}
+}
+
+// Zone is a Client option to set the zone passed to the commands.
+//
+// If not set, the zone is determined by looking up the zone apex of the
+// provisioned name.
+func Zone(zone string) Option {
+	return func(c *Client) error {
+		c.zone = zone
+		return nil
+	}
+}
+
+// Timeout is a Client option to set how long each command is allowed to run
+// before it is killed.
+func Timeout(d time.Duration) Option {
+	return func(c *Client) error {
+		c.timeout = d
+		return nil
+	}
+}
+
+// HookWaits is a Client option to indicate that the present command waits for
+// the record to propagate before exiting.
+func HookWaits() Option {
+	return func(c *Client) error {
+		c.propagates = true
+		return nil
+	}
+}
+
+// Checker is a Client option to set the propagation checker used to wait for
+// provisioned records to propagate, and to determine zones.
+func Checker(checker *propagation.Checker) Option {
+	return func(c *Client) error {
+		c.checker = checker
+		return nil
+	}
+}
+
+// Logf is a Client option to specify the logging function used.
+func Logf(f func(string, ...interface{})) Option {
+	return func(c *Client) error {
+		c.logf = f
+		return nil
+	}
+}
+
+// Errorf is a Client option to specify the error logging function used.
+func Errorf(f func(string, ...interface{})) Option {
+	return func(c *Client) error {
+		c.errf = f
+		return nil
+	}
+}
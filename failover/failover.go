@@ -0,0 +1,233 @@
+// Package failover provides a composite autocertdns.Provisioner that
+// provisions challenges across redundant provisioners.
+package failover
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/brankas/autocertdns"
+	"github.com/brankas/autocertdns/propagation"
+	"github.com/brankas/autocertdns/provision"
+)
+
+// backend is a provisioner and the checker used to wait for its records.
+type backend struct {
+	provisioner autocertdns.ProvisionerV2
+	checker     *propagation.Checker
+}
+
+// record is a handle to records provisioned by one of the provisioners.
+type record struct {
+	provisioner autocertdns.ProvisionerV2
+	records     []provision.Record
+}
+
+// Failover is a composite provisioner for zones served by redundant DNS
+// providers.
+//
+// By default, challenges are provisioned with every provisioner, and
+// provisioning succeeds when at least one provisioner succeeds. When created
+// with the Ordered option, the provisioners are instead tried in order until
+// one succeeds.
+//
+// A provisioner has only succeeded once its records have propagated. Records
+// are waited on separately for each provisioner, with the checker set by the
+// ProvisionerChecker option or, when not set, the Failover's checker.
+//
+// Unprovisioning is always attempted with every provisioner.
+type Failover struct {
+	backends []backend
+	ordered  bool
+	checker  *propagation.Checker
+	logf     func(string, ...interface{})
+	errf     func(string, ...interface{})
+}
+
+// New creates a new failover provisioner.
+func New(opts ...Option) (*Failover, error) {
+	f := &Failover{
+		logf: func(string, ...interface{}) {},
+	}
+
+	// apply opts
+	for _, o := range opts {
+		if err := o(f); err != nil {
+			return nil, err
+		}
+	}
+
+	// ensure errf is set
+	if f.errf == nil {
+		f.errf = func(s string, v ...interface{}) {
+			f.logf("ERROR: "+s, v...)
+		}
+	}
+
+	if len(f.backends) == 0 {
+		return nil, errors.New("failover missing provisioners")
+	}
+
+	return f, nil
+}
+
+// Provision satisfies the autocertdns.Provisioner interface.
+func (f *Failover) Provision(ctxt context.Context, typ, name, token string) error {
+	_, err := f.ProvisionRecords(ctxt, []provision.Challenge{{Type: typ, Name: name, Value: token}})
+	return err
+}
+
+// Unprovision satisfies the autocertdns.Provisioner interface.
+//
+// Unprovisioning is attempted with every provisioner, and the first error
+// encountered is returned.
+func (f *Failover) Unprovision(ctxt context.Context, typ, name, token string) error {
+	var err error
+	for i, b := range f.backends {
+		if e := b.provisioner.Unprovision(ctxt, typ, name, token); e != nil {
+			f.errf("provisioner %d could not unprovision %s: %v", i, name, e)
+			if err == nil {
+				err = e
+			}
+		}
+	}
+	return err
+}
+
+// ProvisionRecords satisfies the autocertdns.ProvisionerV2 interface.
+func (f *Failover) ProvisionRecords(ctxt context.Context, challenges []provision.Challenge) ([]provision.Record, error) {
+	if f.ordered {
+		return f.provisionOrdered(ctxt, challenges)
+	}
+	return f.provisionAll(ctxt, challenges)
+}
+
+// provision provisions the challenges with the i'th provisioner, and waits
+// for the records to propagate to the provisioner's nameservers.
+func (f *Failover) provision(ctxt context.Context, i int, challenges []provision.Challenge) (*record, error) {
+	b := f.backends[i]
+	recs, err := b.provisioner.ProvisionRecords(ctxt, challenges)
+	var r *record
+	if len(recs) != 0 {
+		r = &record{provisioner: b.provisioner, records: recs}
+	}
+	if err != nil {
+		return r, err
+	}
+
+	// wait for propagation
+	checker := b.checker
+	if checker == nil {
+		checker = f.checker
+	}
+	if checker == nil || b.provisioner.WaitsForPropagation() {
+		return r, nil
+	}
+	for _, ch := range challenges {
+		if err := checker.Wait(ctxt, ch.Name, ch.Value); err != nil {
+			return r, err
+		}
+	}
+	return r, nil
+}
+
+// provisionAll provisions the challenges with every provisioner concurrently,
+// succeeding when at least one provisioner succeeds.
+func (f *Failover) provisionAll(ctxt context.Context, challenges []provision.Challenge) ([]provision.Record, error) {
+	results := make([]*record, len(f.backends))
+	errs := make([]error, len(f.backends))
+
+	var wg sync.WaitGroup
+	for i := range f.backends {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = f.provision(ctxt, i, challenges)
+		}(i)
+	}
+	wg.Wait()
+
+	var records []provision.Record
+	var err error
+	ok := false
+	for i := range f.backends {
+		if results[i] != nil {
+			records = append(records, results[i])
+		}
+		if errs[i] != nil {
+			f.errf("provisioner %d could not provision: %v", i, errs[i])
+			if err == nil {
+				err = errs[i]
+			}
+			continue
+		}
+		ok = true
+	}
+	if !ok {
+		return records, err
+	}
+	return records, nil
+}
+
+// provisionOrdered provisions the challenges with each provisioner in turn
+// until one succeeds, unprovisioning any records left by a failed
+// provisioner.
+func (f *Failover) provisionOrdered(ctxt context.Context, challenges []provision.Challenge) ([]provision.Record, error) {
+	var err error
+	for i := range f.backends {
+		r, e := f.provision(ctxt, i, challenges)
+		if e == nil {
+			return []provision.Record{r}, nil
+		}
+		f.errf("provisioner %d could not provision, trying next: %v", i, e)
+		if err == nil {
+			err = e
+		}
+
+		// clean up partially provisioned records
+		if r != nil {
+			if e := r.provisioner.UnprovisionRecords(ctxt, r.records); e != nil {
+				f.errf("provisioner %d could not unprovision: %v", i, e)
+			}
+		}
+	}
+	return nil, err
+}
+
+// UnprovisionRecords satisfies the autocertdns.ProvisionerV2 interface.
+//
+// Unprovisioning is attempted for all records, and the first error
+// encountered is returned.
+func (f *Failover) UnprovisionRecords(ctxt context.Context, records []provision.Record) error {
+	var err error
+	for _, rec := range records {
+		r, ok := rec.(*record)
+		if !ok {
+			if err == nil {
+				err = provision.ErrUnknownRecord
+			}
+			continue
+		}
+		if e := r.provisioner.UnprovisionRecords(ctxt, r.records); e != nil {
+			f.errf("could not unprovision records: %v", e)
+			if err == nil {
+				err = e
+			}
+		}
+	}
+	return err
+}
+
+// WaitsForPropagation satisfies the autocertdns.ProvisionerV2 interface.
+//
+// Returns true when every provisioner either waits for propagation, or has a
+// checker to wait with.
+func (f *Failover) WaitsForPropagation() bool {
+	for _, b := range f.backends {
+		if b.checker == nil && f.checker == nil && !b.provisioner.WaitsForPropagation() {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,202 @@
+package failover
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/brankas/autocertdns/propagation"
+	"github.com/brankas/autocertdns/provision"
+)
+
+func TestAll(t *testing.T) {
+	a, b, down := new(provisioner), new(provisioner), &provisioner{fail: true}
+	f, err := New(Provisioner(a), Provisioner(down), Provisioner(b))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	records, err := f.ProvisionRecords(context.Background(), []provision.Challenge{
+		{Name: "_acme-challenge.example.com", Type: "TXT", Value: "a"},
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if a.count() != 1 || b.count() != 1 {
+		t.Errorf("expected records with all available provisioners, got: %d, %d", a.count(), b.count())
+	}
+	if err = f.UnprovisionRecords(context.Background(), records); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if a.count() != 0 || b.count() != 0 {
+		t.Errorf("expected no records, got: %d, %d", a.count(), b.count())
+	}
+
+	// all down
+	if f, err = New(Provisioner(down), Provisioner(&provisioner{fail: true})); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err = f.Provision(context.Background(), "TXT", "_acme-challenge.example.com", "b"); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestAllPropagation(t *testing.T) {
+	a, down := new(provisioner), &provisioner{fail: true}
+	f, err := New(
+		ProvisionerChecker(a, newChecker(t, serveNS(t, a))),
+		ProvisionerChecker(down, newChecker(t, serveNS(t, down))),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if !f.WaitsForPropagation() {
+		t.Errorf("expected failover to wait for propagation")
+	}
+
+	ctxt, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	records, err := f.ProvisionRecords(ctxt, []provision.Challenge{
+		{Name: "_acme-challenge.example.com", Type: "TXT", Value: "a"},
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if len(records) != 1 {
+		t.Errorf("expected 1 record, got: %d", len(records))
+	}
+
+	// not propagated
+	b := &provisioner{hidden: true}
+	if f, err = New(Ordered(), ProvisionerChecker(b, newChecker(t, serveNS(t, b))), Provisioner(a)); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if _, err = f.ProvisionRecords(ctxt, []provision.Challenge{
+		{Name: "_acme-challenge.example.com", Type: "TXT", Value: "b"},
+	}); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if b.count() != 0 || a.count() != 2 {
+		t.Errorf("expected record with second provisioner only, got: %d, %d", b.count(), a.count())
+	}
+}
+
+func TestOrdered(t *testing.T) {
+	a, b, down := new(provisioner), new(provisioner), &provisioner{fail: true}
+	f, err := New(Ordered(), Provisioner(down), Provisioner(a), Provisioner(b))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	records, err := f.ProvisionRecords(context.Background(), []provision.Challenge{
+		{Name: "_acme-challenge.example.com", Type: "TXT", Value: "a"},
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if a.count() != 1 || b.count() != 0 {
+		t.Errorf("expected record with first available provisioner only, got: %d, %d", a.count(), b.count())
+	}
+	if err = f.UnprovisionRecords(context.Background(), records); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if a.count() != 0 {
+		t.Errorf("expected no records, got: %d", a.count())
+	}
+
+	// unprovision is best-effort on all provisioners
+	if err = f.Unprovision(context.Background(), "TXT", "_acme-challenge.example.com", "b"); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+// provisioner is a Provisioner that stores values in memory.
+type provisioner struct {
+	fail   bool
+	hidden bool
+	v      []string
+	sync.Mutex
+}
+
+func (p *provisioner) Provision(_ context.Context, _, _, token string) error {
+	if p.fail {
+		return errors.New("unavailable")
+	}
+	p.Lock()
+	defer p.Unlock()
+	p.v = append(p.v, token)
+	return nil
+}
+
+func (p *provisioner) Unprovision(_ context.Context, _, _, token string) error {
+	if p.fail {
+		return errors.New("unavailable")
+	}
+	p.Lock()
+	defer p.Unlock()
+	for i, v := range p.v {
+		if v == token {
+			p.v = append(p.v[:i], p.v[i+1:]...)
+			return nil
+		}
+	}
+	return errors.New("not found")
+}
+
+func (p *provisioner) count() int {
+	p.Lock()
+	defer p.Unlock()
+	return len(p.v)
+}
+
+func (p *provisioner) serveDNS(w dns.ResponseWriter, req *dns.Msg) {
+	p.Lock()
+	defer p.Unlock()
+
+	res := new(dns.Msg)
+	res.SetReply(req)
+	res.Authoritative = true
+	if q := req.Question[0]; !p.hidden && strings.EqualFold(q.Name, "_acme-challenge.example.com.") {
+		for _, v := range p.v {
+			res.Answer = append(res.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 10},
+				Txt: []string{v},
+			})
+		}
+	}
+	w.WriteMsg(res)
+}
+
+// serveNS starts a nameserver serving the records of the provisioner.
+func serveNS(t *testing.T, p *provisioner) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(p.serveDNS)}
+	started := make(chan struct{})
+	srv.NotifyStartedFunc = func() { close(started) }
+	go srv.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { srv.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+// newChecker creates a checker for the nameserver.
+func newChecker(t *testing.T, ns string) *propagation.Checker {
+	checker, err := propagation.New(
+		propagation.Nameservers(ns),
+		propagation.Timeout(200*time.Millisecond),
+		propagation.Interval(10*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	return checker
+}
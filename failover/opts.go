@@ -0,0 +1,82 @@
+package failover
+
+import (
+	"errors"
+
+	"github.com/brankas/autocertdns"
+	"github.com/brankas/autocertdns/propagation"
+)
+
+// Option is the Failover option type.
+type Option func(f *Failover) error
+
+// Provisioner is a Failover option to add a provisioner.
+//
+// Provisioners are tried in the order added when the Ordered option is used.
+func Provisioner(p autocertdns.Provisioner) Option {
+	return func(f *Failover) error {
+		if p == nil {
+			return errors.New("failover missing provisioner")
+		}
+		f.backends = append(f.backends, backend{provisioner: autocertdns.AsProvisionerV2(p)})
+		return nil
+	}
+}
+
+// ProvisionerChecker is a Failover option to add a provisioner whose records
+// are waited on with checker, instead of the Failover's checker.
+//
+// As the checker only needs to see the records on the nameservers of the
+// provisioner's DNS provider, it is typically created with the
+// propagation.Nameservers option.
+func ProvisionerChecker(p autocertdns.Provisioner, checker *propagation.Checker) Option {
+	return func(f *Failover) error {
+		if p == nil {
+			return errors.New("failover missing provisioner")
+		}
+		if checker == nil {
+			return errors.New("failover missing checker")
+		}
+		f.backends = append(f.backends, backend{provisioner: autocertdns.AsProvisionerV2(p), checker: checker})
+		return nil
+	}
+}
+
+// Ordered is a Failover option to try the provisioners in order, falling back
+// to the next provisioner on error, instead of provisioning with all of them.
+func Ordered() Option {
+	return func(f *Failover) error {
+		f.ordered = true
+		return nil
+	}
+}
+
+// Checker is a Failover option to set the propagation checker used to wait
+// for records provisioned by provisioners that do not wait for propagation,
+// and that were not added with the ProvisionerChecker option.
+//
+// Unless created with the propagation.Nameservers option, the checker waits
+// for the records on all of the zone's nameservers, including those of any
+// provider that failed.
+func Checker(checker *propagation.Checker) Option {
+	return func(f *Failover) error {
+		f.checker = checker
+		return nil
+	}
+}
+
+// Logf is a Failover option to specify the logging function used.
+func Logf(f func(string, ...interface{})) Option {
+	return func(v *Failover) error {
+		v.logf = f
+		return nil
+	}
+}
+
+// Errorf is a Failover option to specify the error logging function used.
+func Errorf(f func(string, ...interface{})) Option {
+	return func(v *Failover) error {
+		v.errf = f
+		return nil
+	}
+}
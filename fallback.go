@@ -0,0 +1,79 @@
+package autocertdns
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// fallback sets the current certificate to a stale cached certificate or, if
+// no cached certificate is available, a self-signed placeholder certificate.
+//
+// The next renewal is not scheduled, causing a certificate to be issued
+// immediately.
+func (m *Manager) fallback() {
+	m.rw.Lock()
+	defer m.rw.Unlock()
+
+	domain := strings.TrimSuffix(m.Domain, ".")
+
+	cert, err := m.readStaleCert(domain)
+	if err == nil {
+		m.log("using stale certificate until renewed (domain: %s, expired: %s)", domain, cert.Leaf.NotAfter.Format(time.RFC3339))
+		m.cert = cert
+		return
+	}
+
+	cert, err = selfSigned(domain)
+	if err != nil {
+		_ = m.errf("could not create self-signed certificate: %v", err)
+		return
+	}
+
+	m.log("using self-signed certificate until issued (domain: %s)", domain)
+	m.cert = cert
+}
+
+// selfSigned generates a self-signed placeholder certificate for domain.
+func selfSigned(domain string) (*tls.Certificate, error) {
+	key, err := generateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	tpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: domain},
+		DNSNames:              []string{domain},
+		NotBefore:             now.Add(-1 * time.Hour),
+		NotAfter:              now.Add(7 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{der},
+		Leaf:        leaf,
+		PrivateKey:  key,
+	}, nil
+}
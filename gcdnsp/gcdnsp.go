@@ -1,5 +1,5 @@
 // Package gcdnsp provides a Google Cloud DNS client that satisfies
-// autocertdns.Provisioner.
+// autocertdns.Provisioner and autocertdns.ProvisionerV2.
 package gcdnsp
 
 import (
@@ -7,11 +7,13 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
-	dnsr "github.com/miekg/dns"
-	"golang.org/x/sync/errgroup"
 	dns "google.golang.org/api/dns/v2beta1"
+
+	"github.com/brankas/autocertdns/propagation"
+	"github.com/brankas/autocertdns/provision"
 )
 
 const (
@@ -26,6 +28,10 @@ const (
 
 	// DefaultProvisionDelay is the default after provision wait delay.
 	DefaultProvisionDelay = 10 * time.Second
+
+	// DefaultPollInterval is the default delay between checks of a pending
+	// change.
+	DefaultPollInterval = 1 * time.Second
 )
 
 // Client wraps a Google Cloud DNS service.
@@ -38,9 +44,27 @@ type Client struct {
 	propagationWait         time.Duration
 	checkDelay              time.Duration
 	provisionDelay          time.Duration
+	pollInterval            time.Duration
 	ignorePropagationErrors bool
+	checker                 *propagation.Checker
 	logf                    func(string, ...interface{})
 	errf                    func(string, ...interface{})
+
+	// zones are the resolved managed zones, keyed by domain.
+	zones map[string]*zone
+	mu    sync.Mutex
+}
+
+// zone is a resolved managed zone.
+type zone struct {
+	// managedZone is the managed zone name.
+	managedZone string
+
+	// domain is the managed zone's DNS name (without the trailing .).
+	domain string
+
+	// nameservers are the nameservers (host:port) to check for propagation.
+	nameservers []string
 }
 
 // New wraps a Google Cloud DNS Service in order to handle DNS provisioning
@@ -53,6 +77,8 @@ func New(opts ...Option) (*Client, error) {
 		propagationWait: DefaultPropagationWait,
 		checkDelay:      DefaultCheckDelay,
 		provisionDelay:  DefaultProvisionDelay,
+		pollInterval:    DefaultPollInterval,
+		zones:           make(map[string]*zone),
 	}
 
 	// apply opts
@@ -69,8 +95,8 @@ func New(opts ...Option) (*Client, error) {
 		}
 	}
 
-	if c.managedZone == "" || c.domain == "" || c.dnsService == nil {
-		return nil, errors.New("gcdnsp missing managed zone, domain, or dns service")
+	if c.dnsService == nil {
+		return nil, errors.New("gcdnsp missing dns service")
 	}
 
 	// force end .
@@ -79,198 +105,369 @@ func New(opts ...Option) (*Client, error) {
 	return c, nil
 }
 
+// record is a handle to a provisioned record.
+type record struct {
+	zone  *zone
+	name  string
+	value string
+}
+
 // Provision creates a DNS record of typ, for the specified domain name and
 // with the value in token.
 func (c *Client) Provision(ctxt context.Context, typ, name, token string) error {
+	_, err := c.ProvisionRecords(ctxt, []provision.Challenge{{Type: typ, Name: name, Value: token}})
+	return err
+}
+
+// Unprovision deletes the DNS record of typ, for the specified domain name,
+// and for the record with the specified token as the value.
+func (c *Client) Unprovision(ctxt context.Context, typ, name, token string) error {
 	if typ != allowedRecordType {
 		return errors.New("only TXT records are supported")
 	}
 
-	// check name
-	if !strings.HasSuffix(name, "."+c.domain) {
-		return errors.New("invalid domain")
+	// determine managed zone
+	z, err := c.zoneFor(ctxt, name)
+	if err != nil {
+		return err
 	}
-	if n := strings.TrimSuffix(name, "."+c.domain); n == "" {
-		return errors.New("invalid name")
+
+	return c.UnprovisionRecords(ctxt, []provision.Record{
+		&record{zone: z, name: strings.TrimSuffix(name, ".") + ".", value: token},
+	})
+}
+
+// ProvisionRecords creates the DNS records for the challenges, adding the
+// values to any existing record sets, and waits for the records to
+// propagate.
+//
+// The records for each managed zone are created in a single change.
+func (c *Client) ProvisionRecords(ctxt context.Context, challenges []provision.Challenge) ([]provision.Record, error) {
+	// group by managed zone
+	var zones []*zone
+	additions := make(map[*zone][]*record)
+	for _, ch := range challenges {
+		if ch.Type != allowedRecordType {
+			return nil, errors.New("only TXT records are supported")
+		}
+
+		// determine managed zone
+		z, err := c.zoneFor(ctxt, ch.Name)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := additions[z]; !ok {
+			zones = append(zones, z)
+		}
+		additions[z] = append(additions[z], &record{
+			zone:  z,
+			name:  strings.TrimSuffix(ch.Name, ".") + ".",
+			value: ch.Value,
+		})
 	}
-	name += "."
 
-	// no nameservers supplied, use the nameservers from the managed zone
-	if c.nameservers == nil {
-		mz, err := c.dnsService.ManagedZones.Get(c.projectID, c.managedZone).Context(ctxt).Do()
+	// create dns records
+	var records []provision.Record
+	for _, z := range zones {
+		for _, r := range additions[z] {
+			c.logf("provisioning (type: %s, name: %s, token: %s)", allowedRecordType, r.name, r.value)
+		}
+		changed, err := c.change(ctxt, z, additions[z], nil)
+		if changed {
+			for _, r := range additions[z] {
+				records = append(records, r)
+			}
+		}
+		if err != nil {
+			return records, err
+		}
+	}
+
+	// wait for propagation
+	for _, z := range zones {
+		checker, err := c.propagationChecker(z)
 		if err != nil {
-			return fmt.Errorf("could not retrieve nameservers for %s/%s: %v", c.projectID, c.managedZone, err)
+			return records, err
+		}
+		for _, r := range additions[z] {
+			if err = checker.Wait(ctxt, r.name, r.value); err != nil && !c.ignorePropagationErrors {
+				return records, err
+			} else if err != nil {
+				c.errf("ignored propagated error: %v", err)
+			}
 		}
+	}
 
-		// add port to nameservers
-		ns := make([]string, len(mz.NameServers))
-		for i, n := range mz.NameServers {
-			ns[i] = n + ":53"
+	select {
+	case <-ctxt.Done():
+		return records, ctxt.Err()
+	case <-time.After(c.provisionDelay):
+	}
+
+	return records, nil
+}
+
+// UnprovisionRecords deletes the values of the provisioned records from their
+// record sets, removing any record sets left empty.
+func (c *Client) UnprovisionRecords(ctxt context.Context, records []provision.Record) error {
+	// group by managed zone
+	var zones []*zone
+	deletions := make(map[*zone][]*record)
+	for _, rec := range records {
+		r, ok := rec.(*record)
+		if !ok {
+			return provision.ErrUnknownRecord
+		}
+		if _, ok := deletions[r.zone]; !ok {
+			zones = append(zones, r.zone)
+		}
+		deletions[r.zone] = append(deletions[r.zone], r)
+	}
+
+	var err error
+	for _, z := range zones {
+		for _, r := range deletions[z] {
+			c.logf("unprovisioning (type: %s, name: %s, token: %s)", allowedRecordType, r.name, r.value)
+		}
+		if _, e := c.change(ctxt, z, nil, deletions[z]); e != nil && err == nil {
+			err = e
 		}
-		c.nameservers = ns
 	}
+	return err
+}
 
-	// create dns record
-	c.logf("provisioning (type: %s, name: %s, token: %s)", typ, name, token)
+// WaitsForPropagation satisfies the autocertdns.ProvisionerV2 interface.
+func (c *Client) WaitsForPropagation() bool {
+	return true
+}
 
-	// build deletions
-	deletions, err := c.buildDeletions(ctxt, typ, name)
-	if err != nil {
-		return err
+// change adds and removes record values in the managed zone as a single
+// change, merging with the values of the existing record sets, and waits for
+// the change to be applied. Reports whether the record sets hold the requested
+// values, as the change is not undone when waiting for it fails.
+func (c *Client) change(ctxt context.Context, z *zone, add, remove []*record) (bool, error) {
+	// collect names
+	var names []string
+	values := make(map[string][]string)
+	for _, r := range append(add, remove...) {
+		if _, ok := values[r.name]; !ok {
+			names = append(names, r.name)
+			values[r.name] = nil
+		}
+	}
+
+	// build change
+	chg := new(dns.Change)
+	for _, name := range names {
+		existing, err := c.rrset(ctxt, z, name)
+		if err != nil {
+			return false, err
+		}
+
+		// merge values
+		var rrdatas []string
+		if existing != nil {
+			chg.Deletions = append(chg.Deletions, existing)
+			for _, v := range existing.Rrdatas {
+				if !containsRecord(remove, name, v) {
+					rrdatas = append(rrdatas, v)
+				}
+			}
+		}
+		for _, r := range add {
+			if r.name == name && !containsValue(rrdatas, r.value) {
+				rrdatas = append(rrdatas, r.value)
+			}
+		}
+		if len(rrdatas) != 0 {
+			chg.Additions = append(chg.Additions, &dns.ResourceRecordSet{
+				Type:    allowedRecordType,
+				Name:    name,
+				Rrdatas: rrdatas,
+				Ttl:     1,
+			})
+		}
+	}
+	if len(chg.Deletions) == 0 && len(chg.Additions) == 0 {
+		return true, nil
 	}
 
 	// do change
-	var chg *dns.Change
-	chg, err = c.dnsService.Changes.Create(
-		c.projectID, c.managedZone,
-		&dns.Change{
-			Deletions: deletions,
-			Additions: []*dns.ResourceRecordSet{
-				&dns.ResourceRecordSet{
-					Type:    typ,
-					Name:    name,
-					Rrdatas: []string{token},
-					Ttl:     1,
-				},
-			},
-		},
-	).Context(ctxt).Do()
+	chg, err := c.dnsService.Changes.Create(c.projectID, z.managedZone, chg).Context(ctxt).Do()
 	if err != nil {
-		c.errf("unable to provision (type: %s, name: %s, token: %s): %v", typ, name, token, err)
-		return err
-	} /*else {
-		c.logf("successfully provisioned (type: %s, name: %s, token: %s)", typ, name, token)
-	}*/
+		c.errf("unable to change records in %s/%s: %v", c.projectID, z.managedZone, err)
+		return false, err
+	}
 
 	// check pending status
 	for chg.Status == "pending" {
-		time.Sleep(1 * time.Second)
-		chg, err = c.dnsService.Changes.Get(c.projectID, c.managedZone, chg.Id).Context(ctxt).Do()
+		select {
+		case <-ctxt.Done():
+			return true, ctxt.Err()
+		case <-time.After(c.pollInterval):
+		}
+		chg, err = c.dnsService.Changes.Get(c.projectID, z.managedZone, chg.Id).Context(ctxt).Do()
 		if err != nil {
-			return err
+			return true, err
 		}
 	}
 
-	var cancel func()
-	ctxt, cancel = context.WithTimeout(ctxt, c.propagationWait)
-	defer cancel()
-
-	eg, ctxt := errgroup.WithContext(ctxt)
-	for _, nn := range c.nameservers {
-		ns := nn
-		eg.Go(func() error {
-			// create dnsr client and question
-			cl, m := new(dnsr.Client), new(dnsr.Msg)
-			m.SetQuestion(name, dnsr.TypeTXT)
-			for {
-				select {
-				case <-ctxt.Done():
-					return ctxt.Err()
-				default:
-					// query nameserver
-					res, _, err := cl.Exchange(m, ns)
-					if err == nil && len(res.Answer) > 0 {
-						for _, a := range res.Answer {
-							if txtRecord, ok := a.(*dnsr.TXT); ok && contains(txtRecord.Txt, token) {
-								c.logf("%s has propagated to %s", name, ns)
-								return nil
-							}
-						}
-					}
-					time.Sleep(c.checkDelay)
-				}
-			}
+	return true, nil
+}
 
-			return nil
-		})
+// zoneFor returns the managed zone for the FQDN name.
+//
+// When the Client was not created with a domain, the domain is determined
+// from the zone apex of name. When the Client was not created with a managed
+// zone, the managed zone is found by the domain. Names outside of the managed
+// zone's DNS name are rejected.
+func (c *Client) zoneFor(ctxt context.Context, name string) (*zone, error) {
+	name = strings.TrimSuffix(name, ".")
+
+	// determine domain
+	domain := c.domain
+	if domain == "" {
+		checker, err := c.propagationChecker(nil)
+		if err != nil {
+			return nil, err
+		}
+		apex, err := checker.Zone(ctxt, name)
+		if err != nil {
+			return nil, err
+		}
+		domain = strings.TrimSuffix(apex, ".")
 	}
 
-	if err = eg.Wait(); err != nil && !c.ignorePropagationErrors {
-		return err
-	} else if err != nil {
-		c.errf("ignored propagated error: %v", err)
+	// check name
+	if !strings.HasSuffix(name, "."+domain) {
+		return nil, errors.New("invalid domain")
+	}
+	if n := strings.TrimSuffix(name, "."+domain); n == "" {
+		return nil, errors.New("invalid name")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	z, ok := c.zones[domain]
+	if !ok {
+		var err error
+		if z, err = c.managedZoneFor(ctxt, domain); err != nil {
+			return nil, err
+		}
+		c.zones[domain] = z
 	}
 
-	time.Sleep(c.provisionDelay)
+	// check name against the managed zone
+	if n := strings.ToLower(name); n != z.domain && !strings.HasSuffix(n, "."+z.domain) {
+		return nil, errors.New("invalid domain")
+	}
 
-	return nil
+	return z, nil
 }
 
-// Unprovision deletes the DNS record of typ, for the specified domain name,
-// and for the record with the specified token as the value.
-func (c *Client) Unprovision(ctxt context.Context, typ, name, token string) error {
-	var err error
+// managedZoneFor retrieves the managed zone for the domain, or the managed
+// zone the Client was created with.
+func (c *Client) managedZoneFor(ctxt context.Context, domain string) (*zone, error) {
 
-	if typ != allowedRecordType {
-		return errors.New("only TXT records are supported")
+	// retrieve managed zone
+	var mz *dns.ManagedZone
+	if c.managedZone != "" {
+		var err error
+		mz, err = c.dnsService.ManagedZones.Get(c.projectID, c.managedZone).Context(ctxt).Do()
+		if err != nil {
+			return nil, fmt.Errorf("could not retrieve managed zone %s/%s: %v", c.projectID, c.managedZone, err)
+		}
+	} else {
+		res, err := c.dnsService.ManagedZones.List(c.projectID).DnsName(domain + ".").Context(ctxt).Do()
+		if err != nil {
+			return nil, fmt.Errorf("could not list managed zones for %s in %s: %v", domain, c.projectID, err)
+		}
+		if len(res.ManagedZones) == 0 {
+			return nil, fmt.Errorf("no managed zone for %s in %s", domain, c.projectID)
+		}
+		mz = res.ManagedZones[0]
 	}
 
-	// check name
-	if !strings.HasSuffix(name, "."+c.domain) {
-		return errors.New("invalid domain")
-	}
-	if n := strings.TrimSuffix(name, "."+c.domain); n == "" {
-		return errors.New("invalid name")
+	z := &zone{
+		managedZone: mz.Name,
+		domain:      strings.ToLower(strings.TrimSuffix(mz.DnsName, ".")),
+		nameservers: c.nameservers,
 	}
-	name += "."
 
-	// get rrsets to delete
-	deletions, err := c.buildDeletions(ctxt, typ, name)
-	if err != nil {
-		return err
-	}
-	if len(deletions) < 1 {
-		return nil
+	// no nameservers supplied, use the nameservers from the managed zone
+	if z.nameservers == nil {
+		// add port to nameservers
+		z.nameservers = make([]string, len(mz.NameServers))
+		for i, n := range mz.NameServers {
+			z.nameservers[i] = n + ":53"
+		}
 	}
 
-	c.logf("unprovisioning (type: %s, name: %s, token: %s)", typ, name, token)
-	_, err = c.dnsService.Changes.Create(
-		c.projectID, c.managedZone,
-		&dns.Change{
-			Deletions: deletions,
-		},
-	).Context(ctxt).Do()
-	if err != nil {
-		c.errf("unable to unprovision (type: %s, name: %s, token: %s): %v", typ, name, token, err)
-		return err
-	} /* else {
-		c.logf("successfully unprovisioned (type: %s, name: %s, token: %s)", typ, name, token)
-	}*/
-	return nil
+	c.logf("using managed zone %s for %s", z.managedZone, domain)
+
+	return z, nil
 }
 
-// buildDeletions builds list of record sets to delete.
-func (c *Client) buildDeletions(ctxt context.Context, typ, name string) ([]*dns.ResourceRecordSet, error) {
-	// get current records
-	//c.logf("retrieving records (type: %s, name: %s, token: %s)", typ, name, token)
-	req := c.dnsService.ResourceRecordSets.List(
-		c.projectID, c.managedZone,
+// propagationChecker returns the propagation checker for the Client, creating
+// a checker for the managed zone's nameservers if a checker was not provided.
+func (c *Client) propagationChecker(z *zone) (*propagation.Checker, error) {
+	if c.checker != nil {
+		return c.checker, nil
+	}
+	var nameservers []string
+	if z != nil {
+		nameservers = z.nameservers
+	}
+	return propagation.New(
+		propagation.Nameservers(nameservers...),
+		propagation.Timeout(c.propagationWait),
+		propagation.Interval(c.checkDelay),
+		propagation.Logf(c.logf),
+		propagation.Errorf(c.errf),
 	)
+}
 
-	var deletions []*dns.ResourceRecordSet
-	if err := req.Pages(ctxt, func(page *dns.ResourceRecordSetsListResponse) error {
-		for _, rrSet := range page.Rrsets {
-			//log.Printf(">>>> name: %s, type: %s, rrdatas: %v", rrSet.Name, rrSet.Type, rrSet.Rrdatas)
-			if rrSet.Name != name || rrSet.Type != allowedRecordType {
-				continue
-			}
-			deletions = append(deletions, rrSet)
+// rrset retrieves the TXT record set for name in the managed zone, returning
+// nil if the record set does not exist.
+func (c *Client) rrset(ctxt context.Context, z *zone, name string) (*dns.ResourceRecordSet, error) {
+	res, err := c.dnsService.ResourceRecordSets.List(
+		c.projectID, z.managedZone,
+	).Name(name).Type(allowedRecordType).Context(ctxt).Do()
+	if err != nil {
+		c.errf("could not retrieve records (type: %s, name: %s): %v", allowedRecordType, name, err)
+		return nil, err
+	}
+	for _, rrSet := range res.Rrsets {
+		if rrSet.Name == name && rrSet.Type == allowedRecordType {
+			return rrSet, nil
 		}
-		return nil
+	}
+	return nil, nil
+}
 
-	}); err != nil {
-		c.errf("could not retrieve records (type: %s, name: %s): %v", typ, name, err)
-		return nil, err
+// containsRecord returns true if records contains a record for name with the
+// value v.
+func containsRecord(records []*record, name, v string) bool {
+	for _, r := range records {
+		if r.name == name && r.value == unquote(v) {
+			return true
+		}
 	}
-	return deletions, nil
+	return false
 }
 
-// contains returns true if haystack contains needle.
-func contains(haystack []string, needle string) bool {
-	for _, s := range haystack {
-		if needle == strings.TrimFunc(s, func(r rune) bool { return r == '"' }) {
+// containsValue returns true if rrdatas contains the value v.
+func containsValue(rrdatas []string, v string) bool {
+	for _, s := range rrdatas {
+		if unquote(s) == v {
 			return true
 		}
 	}
 	return false
 }
+
+// unquote removes the quotes surrounding a TXT record value.
+func unquote(s string) string {
+	return strings.TrimFunc(s, func(r rune) bool { return r == '"' })
+}
@@ -0,0 +1,256 @@
+package gcdnsp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	gdns "google.golang.org/api/dns/v2beta1"
+
+	"github.com/brankas/autocertdns/provision"
+)
+
+func TestProvision(t *testing.T) {
+	s := newStandIn(t)
+	s.rrsets["_acme-challenge.example.com."] = []string{`"existing"`}
+
+	c, err := New(
+		DNSService(s.service),
+		ProjectID("project"),
+		ManagedZone("zone"),
+		Domain("example.com"),
+		Nameservers(s.ns),
+		PropagationWait(5*time.Second),
+		CheckDelay(10*time.Millisecond),
+		PollInterval(time.Millisecond),
+		ProvisionDelay(0),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	records, err := c.ProvisionRecords(context.Background(), []provision.Challenge{
+		{Name: "_acme-challenge.example.com", Type: "TXT", Value: "a"},
+		{Name: "_acme-challenge.example.com.", Type: "TXT", Value: "b"},
+		{Name: "_acme-challenge.www.example.com", Type: "TXT", Value: "c"},
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if v := s.values("_acme-challenge.example.com."); v != `"existing" a b` {
+		t.Errorf("expected existing value to be preserved, got: %s", v)
+	}
+	if v := s.values("_acme-challenge.www.example.com."); v != "c" {
+		t.Errorf("expected c, got: %s", v)
+	}
+	if s.changes != 1 {
+		t.Errorf("expected 1 change, got: %d", s.changes)
+	}
+
+	// delete by value
+	if err = c.UnprovisionRecords(context.Background(), records[:1]); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if v := s.values("_acme-challenge.example.com."); v != `"existing" b` {
+		t.Errorf("expected only a to be removed, got: %s", v)
+	}
+	if err = c.UnprovisionRecords(context.Background(), records[1:]); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if v := s.values("_acme-challenge.example.com."); v != `"existing"` {
+		t.Errorf("expected existing, got: %s", v)
+	}
+	if _, ok := s.rrsets["_acme-challenge.www.example.com."]; ok {
+		t.Errorf("expected record set to be deleted")
+	}
+	if s.changes != 3 {
+		t.Errorf("expected 3 changes, got: %d", s.changes)
+	}
+
+	// failed status check after the change was created
+	s.failStatus = true
+	records, err = c.ProvisionRecords(context.Background(), []provision.Challenge{
+		{Name: "_acme-challenge.example.com", Type: "TXT", Value: "e"},
+	})
+	if err == nil {
+		t.Errorf("expected error, got nil")
+	}
+	if len(records) != 1 {
+		t.Fatalf("expected created record to be returned, got: %v", records)
+	}
+	s.failStatus = false
+	if err = c.UnprovisionRecords(context.Background(), records); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if v := s.values("_acme-challenge.example.com."); v != `"existing"` {
+		t.Errorf("expected existing, got: %s", v)
+	}
+
+	// name outside of the managed zone
+	mc, err := New(
+		DNSService(s.service),
+		ProjectID("project"),
+		ManagedZone("zone"),
+		Domain("example.org"),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err = mc.Provision(context.Background(), "TXT", "_acme-challenge.example.org", "d"); err == nil || err.Error() != "invalid domain" {
+		t.Errorf("expected invalid domain error, got: %v", err)
+	}
+	if s.changes != 5 {
+		t.Errorf("expected 5 changes, got: %d", s.changes)
+	}
+
+	// provision delay honors the context
+	c.provisionDelay = time.Hour
+	ctxt, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err = c.ProvisionRecords(ctxt, []provision.Challenge{
+		{Name: "_acme-challenge.example.com", Type: "TXT", Value: "d"},
+	}); err != context.DeadlineExceeded {
+		t.Errorf("expected context.DeadlineExceeded, got: %v", err)
+	}
+}
+
+// standIn is a local stand-in for the Google Cloud DNS API, serving a single
+// managed zone for example.com.
+type standIn struct {
+	service *gdns.Service
+	ns      string
+	rrsets  map[string][]string
+	changes int
+
+	failStatus bool
+	sync.Mutex
+}
+
+// newStandIn starts a Google Cloud DNS API stand-in, and a nameserver serving
+// its records.
+func newStandIn(t *testing.T) *standIn {
+	s := &standIn{rrsets: make(map[string][]string)}
+
+	// start nameserver
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(s.serveDNS)}
+	started := make(chan struct{})
+	srv.NotifyStartedFunc = func() { close(started) }
+	go srv.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { srv.Shutdown() })
+	s.ns = pc.LocalAddr().String()
+
+	// start api
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+	if s.service, err = gdns.New(ts.Client()); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	s.service.BasePath = ts.URL + "/"
+
+	return s
+}
+
+func (s *standIn) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	path := strings.TrimPrefix(req.URL.Path, "/dns/v2beta1/projects/project/managedZones/")
+	var v interface{}
+	switch {
+	case path == "zone":
+		v = &gdns.ManagedZone{Name: "zone", DnsName: "example.com."}
+	case path == "zone/rrsets":
+		name, resp := req.URL.Query().Get("name"), new(gdns.ResourceRecordSetsListResponse)
+		if values, ok := s.rrsets[name]; ok {
+			resp.Rrsets = []*gdns.ResourceRecordSet{{Name: name, Type: "TXT", Ttl: 1, Rrdatas: values}}
+		}
+		v = resp
+	case path == "zone/changes" && req.Method == "POST":
+		var chg gdns.Change
+		if err := json.NewDecoder(req.Body).Decode(&chg); err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, rrset := range chg.Deletions {
+			if !equal(s.rrsets[rrset.Name], rrset.Rrdatas) {
+				http.Error(res, "deletion does not match", http.StatusPreconditionFailed)
+				return
+			}
+			delete(s.rrsets, rrset.Name)
+		}
+		for _, rrset := range chg.Additions {
+			if _, ok := s.rrsets[rrset.Name]; ok {
+				http.Error(res, "already exists", http.StatusConflict)
+				return
+			}
+			s.rrsets[rrset.Name] = rrset.Rrdatas
+		}
+		s.changes++
+		v = &gdns.Change{Id: fmt.Sprint(s.changes), Status: "pending"}
+	case strings.HasPrefix(path, "zone/changes/") && s.failStatus:
+		http.Error(res, "backend error", http.StatusInternalServerError)
+		return
+	case strings.HasPrefix(path, "zone/changes/"):
+		v = &gdns.Change{Id: strings.TrimPrefix(path, "zone/changes/"), Status: "done"}
+	default:
+		http.Error(res, "not found", http.StatusNotFound)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(res).Encode(v); err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (s *standIn) serveDNS(w dns.ResponseWriter, req *dns.Msg) {
+	s.Lock()
+	defer s.Unlock()
+
+	res := new(dns.Msg)
+	res.SetReply(req)
+	res.Authoritative = true
+	q := req.Question[0]
+	for _, v := range s.rrsets[strings.ToLower(q.Name)] {
+		res.Answer = append(res.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 1},
+			Txt: []string{strings.Trim(v, `"`)},
+		})
+	}
+	w.WriteMsg(res)
+}
+
+func (s *standIn) values(name string) string {
+	s.Lock()
+	defer s.Unlock()
+	v := append([]string(nil), s.rrsets[name]...)
+	sort.Strings(v)
+	return strings.Join(v, " ")
+}
+
+// equal returns true when a and b contain the same values.
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -14,6 +14,8 @@ import (
 	"github.com/kenshaw/jwt/gserviceaccount"
 
 	dns "google.golang.org/api/dns/v2beta1"
+
+	"github.com/brankas/autocertdns/propagation"
 )
 
 // Option represents a Google Cloud DNS Client option.
@@ -28,6 +30,9 @@ func ProjectID(projectID string) Option {
 }
 
 // ManagedZone is a Client option to set the managed zone.
+//
+// If not set, the managed zone is found by the DNS name of the zone containing
+// the provisioned name.
 func ManagedZone(managedZone string) Option {
 	return func(c *Client) error {
 		c.managedZone = managedZone
@@ -36,6 +41,9 @@ func ManagedZone(managedZone string) Option {
 }
 
 // Domain is a Client option to set the domain.
+//
+// If not set, the domain is determined by looking up the zone apex of the
+// provisioned name.
 func Domain(domain string) Option {
 	return func(c *Client) error {
 		c.domain = domain
@@ -68,6 +76,18 @@ func CheckDelay(d time.Duration) Option {
 	}
 }
 
+// Checker is a Client option to set the propagation checker used to wait for
+// provisioned records to propagate.
+//
+// When set, the PropagationWait, CheckDelay and Nameservers options are
+// ignored.
+func Checker(checker *propagation.Checker) Option {
+	return func(c *Client) error {
+		c.checker = checker
+		return nil
+	}
+}
+
 // ProvisionDelay is a Client option to set the delay after a successful
 // provision and name propagation.
 func ProvisionDelay(d time.Duration) Option {
@@ -77,6 +97,15 @@ func ProvisionDelay(d time.Duration) Option {
 	}
 }
 
+// PollInterval is a Client option to set the delay between checks of a
+// pending change's status.
+func PollInterval(d time.Duration) Option {
+	return func(c *Client) error {
+		c.pollInterval = d
+		return nil
+	}
+}
+
 // DNSService is an option that sets the Google Cloud DNS service to use.
 func DNSService(dnsService *dns.Service) Option {
 	return func(c *Client) error {
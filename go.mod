@@ -4,13 +4,16 @@ go 1.15
 
 require (
 	cloud.google.com/go v0.65.0
+	github.com/aws/aws-sdk-go v1.35.5
 	github.com/digitalocean/godo v1.46.0
 	github.com/kenshaw/jwt v0.0.0-20200927061736-eab32ea15277
 	github.com/kenshaw/pemutil v0.0.0-20200927061650-336cb0a26b96
+	github.com/libdns/libdns v0.2.1
 	github.com/miekg/dns v1.1.31
 	golang.org/x/crypto v0.0.0-20201002170205-7f63de1d35b0
 	golang.org/x/net v0.0.0-20201006153459-a7d1128ccaa0 // indirect
 	golang.org/x/oauth2 v0.0.0-20200902213428-5d25da1a8d43
-	golang.org/x/sync v0.0.0-20200625203802-6e8e738ad208
+	golang.org/x/sys v0.0.0-20200930185726-fdedc70b468f
 	google.golang.org/api v0.30.0
+	software.sslmate.com/src/go-pkcs12 v0.0.0-20201103104416-57fc603b7f52
 )
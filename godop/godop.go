@@ -1,26 +1,39 @@
 // Package godop provides a godo (DigitalOcean API) compatible
-// autocertdns.Provisioner.
+// autocertdns.Provisioner and autocertdns.ProvisionerV2.
 package godop
 
 import (
 	"context"
 	"errors"
 	"strings"
+	"time"
 
 	"github.com/digitalocean/godo"
+
+	"github.com/brankas/autocertdns/propagation"
+	"github.com/brankas/autocertdns/provision"
 )
 
 const (
 	// allowedRecordType is the allowed record provisioning type.
 	allowedRecordType = "TXT"
+
+	// DefaultPropagationWait is the default propagation waiting time.
+	DefaultPropagationWait = 60 * time.Second
 )
 
 // Client wraps a DigitalOcean godo.Client.
 type Client struct {
-	client *godo.Client
-	domain string
-	logf   func(string, ...interface{})
-	errf   func(string, ...interface{})
+	client          *godo.Client
+	domain          string
+	checker         *propagation.Checker
+	propagationWait time.Duration
+	logf            func(string, ...interface{})
+	errf            func(string, ...interface{})
+
+	// resolver is the checker used to look up the zone apex when no domain
+	// was specified.
+	resolver *propagation.Checker
 }
 
 // New wraps a godo.Client with a Client that can also handle DNS provisioning
@@ -29,7 +42,8 @@ func New(opts ...Option) (*Client, error) {
 	var err error
 
 	c := &Client{
-		logf: func(string, ...interface{}) {},
+		propagationWait: DefaultPropagationWait,
+		logf:            func(string, ...interface{}) {},
 	}
 
 	// apply opts
@@ -47,66 +61,143 @@ func New(opts ...Option) (*Client, error) {
 		}
 	}
 
-	if c.domain == "" || c.client == nil {
-		return nil, errors.New("godop missing domain or godo client")
+	if c.client == nil {
+		return nil, errors.New("godop missing godo client")
+	}
+
+	// force end .
+	c.domain = strings.TrimSuffix(c.domain, ".")
+
+	// create propagation checker
+	if c.checker == nil && c.propagationWait > 0 {
+		if c.checker, err = propagation.New(
+			propagation.Timeout(c.propagationWait),
+			propagation.Logf(c.logf),
+			propagation.Errorf(c.errf),
+		); err != nil {
+			return nil, err
+		}
+	}
+
+	// create resolver for zone apex lookups
+	c.resolver = c.checker
+	if c.resolver == nil && c.domain == "" {
+		if c.resolver, err = propagation.New(propagation.Logf(c.logf), propagation.Errorf(c.errf)); err != nil {
+			return nil, err
+		}
 	}
 
 	return c, nil
 }
 
+// record is a handle to a provisioned record.
+type record struct {
+	domain string
+	id     int
+	name   string
+	value  string
+}
+
 // Provision creates a DNS record of typ, for the specified domain name and
 // with the value in token.
 func (c *Client) Provision(ctxt context.Context, typ, name, token string) error {
-	if typ != allowedRecordType {
-		return errors.New("only TXT records are supported")
-	}
+	_, err := c.ProvisionRecords(ctxt, []provision.Challenge{{Type: typ, Name: name, Value: token}})
+	return err
+}
 
-	// check name
-	if !strings.HasSuffix(name, "."+c.domain) {
-		return errors.New("invalid domain")
+// ProvisionRecords creates the DNS records for the challenges and, unless
+// propagation waiting was disabled, waits for the records to propagate.
+//
+// The records created before an error are returned along with the error.
+func (c *Client) ProvisionRecords(ctxt context.Context, challenges []provision.Challenge) ([]provision.Record, error) {
+	var records []provision.Record
+	for _, ch := range challenges {
+		if ch.Type != allowedRecordType {
+			return records, errors.New("only TXT records are supported")
+		}
+
+		// check name
+		domain, name, err := c.split(ctxt, ch.Name)
+		if err != nil {
+			return records, err
+		}
+
+		// create dns record
+		c.logf("provisioning (type: %s, name: %s, token: %s)", ch.Type, name, ch.Value)
+		rec, _, err := c.client.Domains.CreateRecord(ctxt, domain, &godo.DomainRecordEditRequest{
+			Type: allowedRecordType,
+			Name: name,
+			Data: ch.Value,
+		})
+		if err != nil {
+			c.errf("unable to provision (type: %s, name: %s, token: %s): %v", ch.Type, name, ch.Value, err)
+			return records, err
+		}
+		records = append(records, &record{domain: domain, id: rec.ID, name: name, value: ch.Value})
 	}
-	name = strings.TrimSuffix(name, "."+c.domain)
-	if name == "" {
-		return errors.New("invalid name")
+
+	// wait for propagation
+	if c.checker != nil {
+		for _, rec := range records {
+			r := rec.(*record)
+			if err := c.checker.Wait(ctxt, r.name+"."+r.domain, r.value); err != nil {
+				return records, err
+			}
+		}
 	}
 
-	// create dns record
-	c.logf("provisioning (type: %s, name: %s, token: %s)", typ, name, token)
-	_, _, err := c.client.Domains.CreateRecord(ctxt, c.domain, &godo.DomainRecordEditRequest{
-		Type: allowedRecordType,
-		Name: name,
-		Data: token,
-	})
-	if err != nil {
-		c.errf("unable to provision (type: %s, name: %s, token: %s): %v", typ, name, token, err)
-	} /*else {
-		c.logf("successfully provisioned (type: %s, name: %s, token: %s)", typ, name, token)
-	}*/
+	return records, nil
+}
+
+// UnprovisionRecords deletes the provisioned records by their IDs.
+//
+// Deletion is attempted for every record, and the first error encountered is
+// returned.
+func (c *Client) UnprovisionRecords(ctxt context.Context, records []provision.Record) error {
+	var err error
+	for _, rec := range records {
+		r, ok := rec.(*record)
+		if !ok {
+			if err == nil {
+				err = provision.ErrUnknownRecord
+			}
+			continue
+		}
 
+		c.logf("unprovisioning (type: %s, name: %s, token: %s)", allowedRecordType, r.name, r.value)
+		if _, e := c.client.Domains.DeleteRecord(ctxt, r.domain, r.id); e != nil {
+			c.errf("unable to unprovision (type: %s, name: %s, token: %s): %v", allowedRecordType, r.name, r.value, e)
+			if err == nil {
+				err = e
+			}
+		}
+	}
 	return err
 }
 
+// WaitsForPropagation satisfies the autocertdns.ProvisionerV2 interface.
+//
+// Returns true unless propagation waiting was disabled.
+func (c *Client) WaitsForPropagation() bool {
+	return c.checker != nil
+}
+
 // Unprovision deletes the DNS record of typ, for the specified domain name,
 // and for the record with the specified token as the value.
 func (c *Client) Unprovision(ctxt context.Context, typ, name, token string) error {
-	var err error
-
 	if typ != allowedRecordType {
 		return errors.New("only TXT records are supported")
 	}
 
 	// check name
-	if !strings.HasSuffix(name, "."+c.domain) {
-		return errors.New("invalid domain")
-	}
-	name = strings.TrimSuffix(name, "."+c.domain)
-	if name == "" {
-		return errors.New("invalid name")
+	domain, name, err := c.split(ctxt, name)
+	if err != nil {
+		return err
 	}
 
 	// get current records
 	//c.logf("retrieving records (type: %s, name: %s, token: %s)", typ, name, token)
-	records, _, err := c.client.Domains.Records(ctxt, c.domain, &godo.ListOptions{PerPage: 10000})
+	records, _, err := c.client.Domains.Records(ctxt, domain, &godo.ListOptions{PerPage: 10000})
 	if err != nil {
 		c.errf("could not retrieve records (type: %s, name: %s, token: %s): %v", typ, name, token, err)
 		return err
@@ -120,7 +211,7 @@ func (c *Client) Unprovision(ctxt context.Context, typ, name, token string) erro
 		}
 
 		c.logf("unprovisioning (type: %s, name: %s, token: %s)", typ, name, token)
-		_, err = c.client.Domains.DeleteRecord(ctxt, c.domain, record.ID)
+		_, err = c.client.Domains.DeleteRecord(ctxt, domain, record.ID)
 		if err != nil {
 			c.errf("unable to unprovision (type: %s, name: %s, token: %s): %v", typ, name, token, err)
 		} /*else {
@@ -133,3 +224,31 @@ func (c *Client) Unprovision(ctxt context.Context, typ, name, token string) erro
 
 	return errors.New("record not deleted")
 }
+
+// split splits the FQDN name into the domain and the record name relative to
+// the domain.
+//
+// When the Client was not created with a domain, the domain is determined
+// from the zone apex of name.
+func (c *Client) split(ctxt context.Context, name string) (string, string, error) {
+	name = strings.TrimSuffix(name, ".")
+
+	domain := c.domain
+	if domain == "" {
+		apex, err := c.resolver.Zone(ctxt, name)
+		if err != nil {
+			return "", "", err
+		}
+		domain = strings.TrimSuffix(apex, ".")
+	}
+
+	if !strings.HasSuffix(name, "."+domain) {
+		return "", "", errors.New("invalid domain")
+	}
+	name = strings.TrimSuffix(name, "."+domain)
+	if name == "" {
+		return "", "", errors.New("invalid name")
+	}
+
+	return domain, name, nil
+}
@@ -0,0 +1,236 @@
+package godop
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/digitalocean/godo"
+	"github.com/miekg/dns"
+
+	"github.com/brankas/autocertdns/propagation"
+	"github.com/brankas/autocertdns/provision"
+)
+
+func TestProvision(t *testing.T) {
+	s := newStandIn(t)
+	s.add("_acme-challenge", "existing")
+
+	checker, err := propagation.New(
+		propagation.Nameservers(s.ns),
+		propagation.Timeout(5*time.Second),
+		propagation.Interval(10*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	c, err := New(
+		GodoClient(s.client),
+		Domain("example.com"),
+		Checker(checker),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	records, err := c.ProvisionRecords(context.Background(), []provision.Challenge{
+		{Name: "_acme-challenge.example.com", Type: "TXT", Value: "a"},
+		{Name: "_acme-challenge.example.com.", Type: "TXT", Value: "b"},
+		{Name: "_acme-challenge.www.example.com", Type: "TXT", Value: "c"},
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if v := s.values("_acme-challenge"); v != "a b existing" {
+		t.Errorf("expected existing value to be preserved, got: %s", v)
+	}
+	if v := s.values("_acme-challenge.www"); v != "c" {
+		t.Errorf("expected c, got: %s", v)
+	}
+
+	// delete by id
+	if err = c.UnprovisionRecords(context.Background(), records); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if v := s.values("_acme-challenge"); v != "existing" {
+		t.Errorf("expected existing, got: %s", v)
+	}
+	if v := s.values("_acme-challenge.www"); v != "" {
+		t.Errorf("expected no values, got: %s", v)
+	}
+
+	// delete by value
+	if err = c.Provision(context.Background(), "TXT", "_acme-challenge.example.com", "d"); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err = c.Unprovision(context.Background(), "TXT", "_acme-challenge.example.com", "d"); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if v := s.values("_acme-challenge"); v != "existing" {
+		t.Errorf("expected existing, got: %s", v)
+	}
+	if err = c.Unprovision(context.Background(), "TXT", "_acme-challenge.example.com", "d"); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+
+	// record from another provisioner
+	if err = c.UnprovisionRecords(context.Background(), []provision.Record{"other"}); err != provision.ErrUnknownRecord {
+		t.Errorf("expected provision.ErrUnknownRecord, got: %v", err)
+	}
+}
+
+func TestWaitsForPropagation(t *testing.T) {
+	tests := []struct {
+		opts []Option
+		exp  bool
+	}{
+		{nil, true},
+		{[]Option{PropagationWait(0)}, false},
+		{[]Option{PropagationWait(-1), Domain("example.com")}, false},
+	}
+	for i, test := range tests {
+		c, err := New(append([]Option{GodoClient(godo.NewClient(nil))}, test.opts...)...)
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		if waits := c.WaitsForPropagation(); waits != test.exp {
+			t.Errorf("test %d expected %t, got: %t", i, test.exp, waits)
+		}
+		if c.domain == "" && c.resolver == nil {
+			t.Errorf("test %d expected resolver to be created", i)
+		}
+	}
+}
+
+// standIn is a local stand-in for the DigitalOcean domain records API,
+// serving the example.com domain.
+type standIn struct {
+	client  *godo.Client
+	ns      string
+	records []godo.DomainRecord
+	id      int
+	sync.Mutex
+}
+
+// newStandIn starts a DigitalOcean API stand-in, and a nameserver serving its
+// records.
+func newStandIn(t *testing.T) *standIn {
+	s := new(standIn)
+
+	// start nameserver
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(s.serveDNS)}
+	started := make(chan struct{})
+	srv.NotifyStartedFunc = func() { close(started) }
+	go srv.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { srv.Shutdown() })
+	s.ns = pc.LocalAddr().String()
+
+	// start api
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+	s.client = godo.NewClient(ts.Client())
+	if s.client.BaseURL, err = url.Parse(ts.URL + "/"); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	return s
+}
+
+func (s *standIn) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	path := strings.TrimPrefix(req.URL.Path, "/v2/domains/example.com/records")
+	var v interface{}
+	switch {
+	case path == "" && req.Method == "GET":
+		v = map[string]interface{}{"domain_records": s.records, "meta": map[string]int{"total": len(s.records)}}
+	case path == "" && req.Method == "POST":
+		var r godo.DomainRecordEditRequest
+		if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+		v = map[string]interface{}{"domain_record": s.addRecord(r.Type, r.Name, r.Data)}
+	case req.Method == "DELETE":
+		id, _ := strconv.Atoi(strings.TrimPrefix(path, "/"))
+		for i, r := range s.records {
+			if r.ID == id {
+				s.records = append(s.records[:i], s.records[i+1:]...)
+				res.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		http.Error(res, `{"id":"not_found","message":"not found"}`, http.StatusNotFound)
+		return
+	default:
+		http.Error(res, `{"id":"not_found","message":"not found"}`, http.StatusNotFound)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(res).Encode(v); err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (s *standIn) serveDNS(w dns.ResponseWriter, req *dns.Msg) {
+	s.Lock()
+	defer s.Unlock()
+
+	res := new(dns.Msg)
+	res.SetReply(req)
+	res.Authoritative = true
+	q := req.Question[0]
+	for _, r := range s.records {
+		if strings.EqualFold(r.Name+".example.com.", q.Name) {
+			res.Answer = append(res.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 1},
+				Txt: []string{r.Data},
+			})
+		}
+	}
+	w.WriteMsg(res)
+}
+
+// add adds a TXT record.
+func (s *standIn) add(name, data string) {
+	s.Lock()
+	defer s.Unlock()
+	s.addRecord("TXT", name, data)
+}
+
+// addRecord adds a record. The caller must hold the lock.
+func (s *standIn) addRecord(typ, name, data string) godo.DomainRecord {
+	s.id++
+	r := godo.DomainRecord{ID: s.id, Type: typ, Name: name, Data: data}
+	s.records = append(s.records, r)
+	return r
+}
+
+func (s *standIn) values(name string) string {
+	s.Lock()
+	defer s.Unlock()
+	var v []string
+	for _, r := range s.records {
+		if r.Name == name {
+			v = append(v, r.Data)
+		}
+	}
+	sort.Strings(v)
+	return strings.Join(v, " ")
+}
@@ -4,15 +4,21 @@ import (
 	"bytes"
 	"context"
 	"io/ioutil"
+	"time"
 
 	"github.com/digitalocean/godo"
 	"golang.org/x/oauth2"
+
+	"github.com/brankas/autocertdns/propagation"
 )
 
 // Option is the Client option type.
 type Option func(c *Client) error
 
 // Domain is a Client option to set the domain.
+//
+// If not set, the domain is determined by looking up the zone apex of the
+// provisioned name.
 func Domain(domain string) Option {
 	return func(c *Client) error {
 		c.domain = domain
@@ -56,6 +62,27 @@ func GodoClientTokenFile(ctxt context.Context, filename string) Option {
 	}
 }
 
+// Checker is a Client option to set the propagation checker used to wait for
+// provisioned records to propagate to the domain's nameservers.
+func Checker(checker *propagation.Checker) Option {
+	return func(c *Client) error {
+		c.checker = checker
+		return nil
+	}
+}
+
+// PropagationWait is a Client option to wait up to d for provisioned records
+// to propagate to the domain's nameservers.
+//
+// If not set, records are waited on for DefaultPropagationWait. A zero or
+// negative d disables waiting for propagation.
+func PropagationWait(d time.Duration) Option {
+	return func(c *Client) error {
+		c.propagationWait = d
+		return nil
+	}
+}
+
 // Logf is a Client option to specify the logging function used.
 func Logf(f func(string, ...interface{})) Option {
 	return func(c *Client) error {
@@ -0,0 +1,95 @@
+// Package atomicfile provides atomic, crash-safe file writes.
+package atomicfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// WriteFile atomically writes buf to filename with mode perm.
+//
+// The data is first written to a temporary file in the same directory as
+// filename, which is then synced to disk and renamed over filename. A crash
+// at any point leaves either the previous or the new contents of filename,
+// never a partially written file.
+func WriteFile(filename string, buf []byte, perm os.FileMode) error {
+	return WriteFileOwner(filename, buf, perm, -1, -1)
+}
+
+// WriteFileOwner atomically writes buf to filename with mode perm, owned by
+// uid and gid, as with WriteFile.
+//
+// The ownership of the temporary file is changed before it is renamed over
+// filename. A uid or gid of -1 leaves that id unchanged.
+func WriteFileOwner(filename string, buf []byte, perm os.FileMode, uid, gid int) error {
+	dir, base := filepath.Split(filename)
+	if dir == "" {
+		dir = "."
+	}
+
+	f, err := ioutil.TempFile(dir, "."+base+".tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+
+	// remove the temporary file on any error
+	var ok bool
+	defer func() {
+		if !ok {
+			f.Close()
+			os.Remove(tmp)
+		}
+	}()
+
+	if _, err = f.Write(buf); err != nil {
+		return err
+	}
+	if err = f.Chmod(perm); err != nil {
+		return err
+	}
+	if uid != -1 || gid != -1 {
+		if err = f.Chown(uid, gid); err != nil {
+			return err
+		}
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, filename); err != nil {
+		return err
+	}
+	ok = true
+
+	return SyncDir(dir)
+}
+
+// Rename renames oldpath to newpath, syncing the parent directory of newpath
+// so that the rename is durable.
+func Rename(oldpath, newpath string) error {
+	if err := os.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+	return SyncDir(filepath.Dir(newpath))
+}
+
+// SyncDir syncs the directory dir to disk, ensuring any entries created,
+// renamed or removed in dir are durable.
+func SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	// windows does not support syncing directories
+	if err = d.Sync(); err != nil && runtime.GOOS != "windows" {
+		return err
+	}
+	return nil
+}
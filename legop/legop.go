@@ -0,0 +1,238 @@
+// Package legop provides an adapter for go-acme/lego DNS providers that
+// satisfies autocertdns.Provisioner and autocertdns.ProvisionerV2.
+//
+// Any lego challenge.Provider can be wrapped without this package importing
+// lego, as the Provider and ProviderTimeout interfaces match lego's:
+//
+//	p, err := cloudns.NewDNSProvider()
+//	if err != nil {
+//		return err
+//	}
+//	client, err := legop.New(p)
+//
+// lego providers derive the record name and value from the domain and the
+// ACME key authorization, so only challenges from the autocertdns.Manager
+// (which carry the key authorization) can be provisioned.
+package legop
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/brankas/autocertdns/propagation"
+	"github.com/brankas/autocertdns/provision"
+)
+
+const (
+	// allowedRecordType is the allowed record provisioning type.
+	allowedRecordType = "TXT"
+
+	// DefaultTimeout is the default propagation timeout, used when the
+	// provider does not implement ProviderTimeout.
+	DefaultTimeout = 60 * time.Second
+
+	// DefaultInterval is the default propagation check interval, used when
+	// the provider does not implement ProviderTimeout.
+	DefaultInterval = 2 * time.Second
+)
+
+// ErrKeyAuthRequired is the error returned when provisioning a record without
+// the ACME key authorization.
+var ErrKeyAuthRequired = errors.New("legop: key authorization required")
+
+// Provider is the lego challenge.Provider interface.
+type Provider interface {
+	Present(domain, token, keyAuth string) error
+	CleanUp(domain, token, keyAuth string) error
+}
+
+// ProviderTimeout is the lego challenge.ProviderTimeout interface, for
+// providers that need a custom propagation timeout and check interval.
+type ProviderTimeout interface {
+	Provider
+	Timeout() (timeout, interval time.Duration)
+}
+
+// Client is a lego DNS provider adapter.
+type Client struct {
+	provider Provider
+	checker  *propagation.Checker
+	logf     func(string, ...interface{})
+	errf     func(string, ...interface{})
+}
+
+// record is a handle to a provisioned record.
+type record struct {
+	domain  string
+	token   string
+	keyAuth string
+}
+
+// New creates an adapter for the lego DNS provider that can handle DNS
+// provisioning requests for use with the autocertdns.Manager.
+//
+// Unless a propagation checker is passed, one is created using the provider's
+// timeout and interval.
+func New(provider Provider, opts ...Option) (*Client, error) {
+	var err error
+
+	c := &Client{
+		provider: provider,
+		logf:     func(string, ...interface{}) {},
+	}
+
+	// apply opts
+	for _, o := range opts {
+		if err = o(c); err != nil {
+			return nil, err
+		}
+	}
+
+	// ensure errf is set
+	if c.errf == nil {
+		c.errf = func(s string, v ...interface{}) {
+			c.logf("ERROR: "+s, v...)
+		}
+	}
+
+	if c.provider == nil {
+		return nil, errors.New("legop missing provider")
+	}
+
+	// create propagation checker
+	if c.checker == nil {
+		timeout, interval := DefaultTimeout, DefaultInterval
+		if p, ok := c.provider.(ProviderTimeout); ok {
+			timeout, interval = p.Timeout()
+		}
+		if c.checker, err = propagation.New(
+			propagation.Timeout(timeout),
+			propagation.Interval(interval),
+			propagation.Logf(c.logf),
+			propagation.Errorf(c.errf),
+		); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// Provision satisfies the autocertdns.Provisioner interface.
+//
+// Always returns ErrKeyAuthRequired, as lego providers cannot provision an
+// already computed value.
+func (c *Client) Provision(ctxt context.Context, typ, name, token string) error {
+	_, err := c.ProvisionRecords(ctxt, []provision.Challenge{{Type: typ, Name: name, Value: token}})
+	return err
+}
+
+// Unprovision satisfies the autocertdns.Provisioner interface.
+//
+// Always returns ErrKeyAuthRequired, as lego providers cannot unprovision an
+// already computed value.
+func (c *Client) Unprovision(ctxt context.Context, typ, name, token string) error {
+	if typ != allowedRecordType {
+		return errors.New("only TXT records are supported")
+	}
+	return ErrKeyAuthRequired
+}
+
+// ProvisionRecords presents each challenge with the provider, and waits for
+// the records to propagate.
+func (c *Client) ProvisionRecords(ctxt context.Context, challenges []provision.Challenge) ([]provision.Record, error) {
+	// build records
+	var recs []*record
+	for _, ch := range challenges {
+		if ch.Type != allowedRecordType {
+			return nil, errors.New("only TXT records are supported")
+		}
+		if ch.KeyAuth == "" {
+			return nil, ErrKeyAuthRequired
+		}
+		if ch.Value != "" && ch.Value != value(ch.KeyAuth) {
+			return nil, fmt.Errorf("value for %s does not match key authorization", ch.Name)
+		}
+		recs = append(recs, &record{domain: domain(ch), token: ch.Token, keyAuth: ch.KeyAuth})
+	}
+
+	// present
+	var records []provision.Record
+	for _, r := range recs {
+		if err := ctxt.Err(); err != nil {
+			return records, err
+		}
+		c.logf("provisioning (type: %s, name: %s, token: %s)", allowedRecordType, name(r.domain), value(r.keyAuth))
+		if err := c.provider.Present(r.domain, r.token, r.keyAuth); err != nil {
+			c.errf("unable to provision record for %s: %v", r.domain, err)
+			return records, err
+		}
+		records = append(records, r)
+	}
+
+	// wait for propagation
+	for i, ch := range challenges {
+		n := ch.Name
+		if n == "" {
+			n = name(recs[i].domain)
+		}
+		if err := c.checker.Wait(ctxt, n, value(recs[i].keyAuth)); err != nil {
+			return records, err
+		}
+	}
+
+	return records, nil
+}
+
+// UnprovisionRecords cleans up each provisioned record with the provider.
+func (c *Client) UnprovisionRecords(ctxt context.Context, records []provision.Record) error {
+	var err error
+	for _, rec := range records {
+		r, ok := rec.(*record)
+		if !ok {
+			if err == nil {
+				err = provision.ErrUnknownRecord
+			}
+			continue
+		}
+		c.logf("unprovisioning (type: %s, name: %s, token: %s)", allowedRecordType, name(r.domain), value(r.keyAuth))
+		if e := c.provider.CleanUp(r.domain, r.token, r.keyAuth); e != nil {
+			c.errf("unable to unprovision record for %s: %v", r.domain, e)
+			if err == nil {
+				err = e
+			}
+		}
+	}
+	return err
+}
+
+// WaitsForPropagation satisfies the autocertdns.ProvisionerV2 interface.
+func (c *Client) WaitsForPropagation() bool {
+	return true
+}
+
+// domain returns the domain to present for the challenge, without any
+// wildcard prefix, as passed by lego.
+func domain(ch provision.Challenge) string {
+	d := ch.Domain
+	if d == "" {
+		d = strings.TrimPrefix(strings.TrimSuffix(ch.Name, "."), "_acme-challenge.")
+	}
+	return strings.TrimPrefix(strings.TrimSuffix(d, "."), "*.")
+}
+
+// name returns the challenge record name for domain.
+func name(domain string) string {
+	return "_acme-challenge." + domain + "."
+}
+
+// value returns the challenge record value for the key authorization.
+func value(keyAuth string) string {
+	h := sha256.Sum256([]byte(keyAuth))
+	return base64.RawURLEncoding.EncodeToString(h[:])
+}
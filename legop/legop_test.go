@@ -0,0 +1,99 @@
+package legop
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/brankas/autocertdns/dnsserverp"
+	"github.com/brankas/autocertdns/propagation"
+	"github.com/brankas/autocertdns/provision"
+)
+
+func TestClient(t *testing.T) {
+	s, err := dnsserverp.New(dnsserverp.Addr("127.0.0.1:0"), dnsserverp.Zone("example.com"))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	defer s.Close()
+
+	checker, err := propagation.New(
+		propagation.Nameservers(s.Addr()),
+		propagation.Timeout(2*time.Second),
+		propagation.Interval(10*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	p := &testProvider{s: s, records: make(map[string][]provision.Record)}
+	c, err := New(p, Checker(checker), Logf(t.Logf))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	challenges := []provision.Challenge{
+		{Domain: "example.com", Name: "_acme-challenge.example.com.", Type: "TXT", Token: "a", KeyAuth: "a.thumb"},
+		{Domain: "*.example.com", Name: "_acme-challenge.example.com", Type: "TXT", Token: "b", KeyAuth: "b.thumb"},
+		{Name: "_acme-challenge.www.example.com", Type: "TXT", Token: "c", KeyAuth: "c.thumb"},
+	}
+	for i := range challenges {
+		challenges[i].Value = value(challenges[i].KeyAuth)
+	}
+	records, err := c.ProvisionRecords(context.Background(), challenges)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if exp := []string{"example.com a a.thumb", "example.com b b.thumb", "www.example.com c c.thumb"}; !reflect.DeepEqual(p.presented, exp) {
+		t.Errorf("expected %v, got: %v", exp, p.presented)
+	}
+
+	if err = c.UnprovisionRecords(context.Background(), records); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if len(p.records) != 0 {
+		t.Errorf("expected records to be cleaned up, got: %v", p.records)
+	}
+
+	// errors
+	if err = c.Provision(context.Background(), "TXT", "_acme-challenge.example.com", "value"); err != ErrKeyAuthRequired {
+		t.Errorf("expected ErrKeyAuthRequired, got: %v", err)
+	}
+	if _, err = c.ProvisionRecords(context.Background(), []provision.Challenge{
+		{Domain: "example.com", Name: "_acme-challenge.example.com", Type: "TXT", Value: "value", KeyAuth: "a.thumb"},
+	}); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+}
+
+// testProvider is a lego style provider that provisions records on a
+// dnsserverp.Server.
+type testProvider struct {
+	s         *dnsserverp.Server
+	presented []string
+	records   map[string][]provision.Record
+}
+
+func (p *testProvider) Present(domain, token, keyAuth string) error {
+	p.presented = append(p.presented, domain+" "+token+" "+keyAuth)
+	h := sha256.Sum256([]byte(keyAuth))
+	records, err := p.s.ProvisionRecords(context.Background(), []provision.Challenge{{
+		Name:  "_acme-challenge." + domain + ".",
+		Type:  "TXT",
+		Value: base64.RawURLEncoding.EncodeToString(h[:]),
+	}})
+	if err != nil {
+		return err
+	}
+	p.records[token] = records
+	return nil
+}
+
+func (p *testProvider) CleanUp(domain, token, keyAuth string) error {
+	err := p.s.UnprovisionRecords(context.Background(), p.records[token])
+	delete(p.records, token)
+	return err
+}
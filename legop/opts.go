@@ -0,0 +1,34 @@
+package legop
+
+import (
+	"github.com/brankas/autocertdns/propagation"
+)
+
+// Option is the Client option type.
+type Option func(c *Client) error
+
+// Checker is a Client option to set the propagation checker used to wait for
+// provisioned records to propagate, instead of one created using the
+// provider's timeout.
+func Checker(checker *propagation.Checker) Option {
+	return func(c *Client) error {
+		c.checker = checker
+		return nil
+	}
+}
+
+// Logf is a Client option to specify the logging function used.
+func Logf(f func(string, ...interface{})) Option {
+	return func(c *Client) error {
+		c.logf = f
+		return nil
+	}
+}
+
+// Errorf is a Client option to specify the error logging function used.
+func Errorf(f func(string, ...interface{})) Option {
+	return func(c *Client) error {
+		c.errf = f
+		return nil
+	}
+}
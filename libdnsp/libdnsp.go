@@ -0,0 +1,275 @@
+// Package libdnsp provides adapters between libdns providers and autocertdns
+// provisioners.
+//
+// Client wraps any libdns provider implementing libdns.RecordAppender and
+// libdns.RecordDeleter (such as those in the Caddy ecosystem), and satisfies
+// autocertdns.Provisioner and autocertdns.ProvisionerV2.
+//
+// Provider wraps any autocertdns.ProvisionerV2 (such as gcdnsp.Client and
+// godop.Client), and satisfies libdns.RecordAppender and
+// libdns.RecordDeleter.
+package libdnsp
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/libdns/libdns"
+
+	"github.com/brankas/autocertdns/propagation"
+	"github.com/brankas/autocertdns/provision"
+)
+
+const (
+	// allowedRecordType is the allowed record provisioning type.
+	allowedRecordType = "TXT"
+
+	// DefaultTTL is the default TTL of provisioned records.
+	DefaultTTL = 60 * time.Second
+
+	// DefaultPropagationWait is the default propagation waiting time.
+	DefaultPropagationWait = 60 * time.Second
+)
+
+// RecordProvider is the interface for libdns providers that can be wrapped by
+// a Client.
+type RecordProvider interface {
+	libdns.RecordAppender
+	libdns.RecordDeleter
+}
+
+// Client is a libdns provider adapter.
+type Client struct {
+	provider        RecordProvider
+	zone            string
+	ttl             time.Duration
+	checker         *propagation.Checker
+	propagationWait time.Duration
+	logf            func(string, ...interface{})
+	errf            func(string, ...interface{})
+
+	// resolver is the checker used to look up the zone apex when no zone was
+	// specified.
+	resolver *propagation.Checker
+}
+
+// record is a handle to a provisioned record.
+type record struct {
+	zone string
+	rec  libdns.Record
+}
+
+// New creates an adapter for the libdns provider that can handle DNS
+// provisioning requests for use with the autocertdns.Manager.
+func New(provider RecordProvider, opts ...Option) (*Client, error) {
+	var err error
+
+	c := &Client{
+		provider:        provider,
+		ttl:             DefaultTTL,
+		propagationWait: DefaultPropagationWait,
+		logf:            func(string, ...interface{}) {},
+	}
+
+	// apply opts
+	for _, o := range opts {
+		if err = o(c); err != nil {
+			return nil, err
+		}
+	}
+
+	// ensure errf is set
+	if c.errf == nil {
+		c.errf = func(s string, v ...interface{}) {
+			c.logf("ERROR: "+s, v...)
+		}
+	}
+
+	if c.provider == nil {
+		return nil, errors.New("libdnsp missing provider")
+	}
+	if c.zone != "" {
+		c.zone = fqdn(c.zone)
+	}
+
+	// create propagation checker
+	if c.checker == nil && c.propagationWait > 0 {
+		if c.checker, err = propagation.New(
+			propagation.Timeout(c.propagationWait),
+			propagation.Logf(c.logf),
+			propagation.Errorf(c.errf),
+		); err != nil {
+			return nil, err
+		}
+	}
+
+	// create resolver for zone apex lookups
+	c.resolver = c.checker
+	if c.resolver == nil && c.zone == "" {
+		if c.resolver, err = propagation.New(propagation.Logf(c.logf), propagation.Errorf(c.errf)); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// Provision creates a DNS record of typ, for the specified domain name and
+// with the value in token.
+func (c *Client) Provision(ctxt context.Context, typ, name, token string) error {
+	_, err := c.ProvisionRecords(ctxt, []provision.Challenge{{Type: typ, Name: name, Value: token}})
+	return err
+}
+
+// Unprovision deletes the DNS record of typ, for the specified domain name,
+// and for the record with the specified token as the value.
+func (c *Client) Unprovision(ctxt context.Context, typ, name, token string) error {
+	if typ != allowedRecordType {
+		return errors.New("only TXT records are supported")
+	}
+	zone, err := c.zoneFor(ctxt, name)
+	if err != nil {
+		return err
+	}
+	return c.UnprovisionRecords(ctxt, []provision.Record{&record{
+		zone: zone,
+		rec: libdns.Record{
+			Type:  allowedRecordType,
+			Name:  libdns.RelativeName(fqdn(name), zone),
+			Value: token,
+		},
+	}})
+}
+
+// ProvisionRecords appends the records for the challenges, with a single
+// call to the provider for each zone.
+//
+// When the Client has a propagation checker, it waits for the records to
+// propagate.
+func (c *Client) ProvisionRecords(ctxt context.Context, challenges []provision.Challenge) ([]provision.Record, error) {
+	// group by zone
+	var zones []string
+	additions := make(map[string][]libdns.Record)
+	for _, ch := range challenges {
+		if ch.Type != allowedRecordType {
+			return nil, errors.New("only TXT records are supported")
+		}
+		zone, err := c.zoneFor(ctxt, ch.Name)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := additions[zone]; !ok {
+			zones = append(zones, zone)
+		}
+		additions[zone] = append(additions[zone], libdns.Record{
+			Type:  allowedRecordType,
+			Name:  libdns.RelativeName(fqdn(ch.Name), zone),
+			Value: ch.Value,
+			TTL:   c.ttl,
+		})
+	}
+
+	// append records
+	var records []provision.Record
+	for _, zone := range zones {
+		for _, r := range additions[zone] {
+			c.logf("provisioning (type: %s, name: %s, token: %s)", allowedRecordType, libdns.AbsoluteName(r.Name, zone), r.Value)
+		}
+		recs, err := c.provider.AppendRecords(ctxt, zone, additions[zone])
+		if err != nil {
+			c.errf("unable to provision records in %s: %v", zone, err)
+			return records, err
+		}
+		// use the created records, which may have provider IDs, when the
+		// provider returns all of them
+		if len(recs) != len(additions[zone]) {
+			recs = additions[zone]
+		}
+		for _, r := range recs {
+			records = append(records, &record{zone: zone, rec: r})
+		}
+	}
+
+	// wait for propagation
+	if c.checker != nil {
+		for _, ch := range challenges {
+			if err := c.checker.Wait(ctxt, ch.Name, ch.Value); err != nil {
+				return records, err
+			}
+		}
+	}
+
+	return records, nil
+}
+
+// UnprovisionRecords deletes the provisioned records, with a single call to
+// the provider for each zone.
+func (c *Client) UnprovisionRecords(ctxt context.Context, records []provision.Record) error {
+	// group by zone
+	var err error
+	var zones []string
+	deletions := make(map[string][]libdns.Record)
+	for _, rec := range records {
+		r, ok := rec.(*record)
+		if !ok {
+			if err == nil {
+				err = provision.ErrUnknownRecord
+			}
+			continue
+		}
+		if _, ok := deletions[r.zone]; !ok {
+			zones = append(zones, r.zone)
+		}
+		deletions[r.zone] = append(deletions[r.zone], r.rec)
+	}
+
+	// delete records
+	for _, zone := range zones {
+		for _, r := range deletions[zone] {
+			c.logf("unprovisioning (type: %s, name: %s, token: %s)", allowedRecordType, libdns.AbsoluteName(r.Name, zone), r.Value)
+		}
+		if _, e := c.provider.DeleteRecords(ctxt, zone, deletions[zone]); e != nil {
+			c.errf("unable to unprovision records in %s: %v", zone, e)
+			if err == nil {
+				err = e
+			}
+		}
+	}
+	return err
+}
+
+// WaitsForPropagation satisfies the autocertdns.ProvisionerV2 interface.
+//
+// Returns true unless waiting for propagation was disabled with a zero or
+// negative PropagationWait.
+func (c *Client) WaitsForPropagation() bool {
+	return c.checker != nil
+}
+
+// zoneFor returns the zone for name.
+//
+// When the Client was not created with a zone, the zone is determined from
+// the zone apex of name.
+func (c *Client) zoneFor(ctxt context.Context, name string) (string, error) {
+	name = fqdn(name)
+
+	zone := c.zone
+	if zone == "" {
+		var err error
+		if zone, err = c.resolver.Zone(ctxt, name); err != nil {
+			return "", err
+		}
+	}
+
+	if !strings.HasSuffix(strings.ToLower(name), "."+strings.ToLower(zone)) {
+		return "", errors.New("invalid zone")
+	}
+	return zone, nil
+}
+
+// fqdn returns name with a trailing dot.
+func fqdn(name string) string {
+	return strings.TrimSuffix(name, ".") + "."
+}
@@ -0,0 +1,128 @@
+package libdnsp
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libdns/libdns"
+	"github.com/miekg/dns"
+
+	"github.com/brankas/autocertdns/dnsserverp"
+	"github.com/brankas/autocertdns/gcdnsp"
+	"github.com/brankas/autocertdns/godop"
+	"github.com/brankas/autocertdns/propagation"
+	"github.com/brankas/autocertdns/provision"
+)
+
+var (
+	_ RecordProvider = NewProvider((*gcdnsp.Client)(nil))
+	_ RecordProvider = NewProvider((*godop.Client)(nil))
+)
+
+func TestClient(t *testing.T) {
+	s, err := dnsserverp.New(dnsserverp.Addr("127.0.0.1:0"), dnsserverp.Zone("example.com"))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	defer s.Close()
+
+	checker, err := propagation.New(
+		propagation.Resolvers(s.Addr()),
+		propagation.Nameservers(s.Addr()),
+		propagation.Timeout(2*time.Second),
+		propagation.Interval(10*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	// wrap the server as a libdns provider, and back again
+	p := &testProvider{RecordProvider: NewProvider(s)}
+	c, err := New(p, Checker(checker), Logf(t.Logf))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	records, err := c.ProvisionRecords(context.Background(), []provision.Challenge{
+		{Name: "_acme-challenge.example.com", Type: "TXT", Value: "a"},
+		{Name: "_acme-challenge.www.example.com.", Type: "TXT", Value: "b"},
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if p.zone != "example.com." {
+		t.Errorf("expected zone example.com., got: %s", p.zone)
+	}
+	if len(p.names) != 2 || p.names[0] != "_acme-challenge" || p.names[1] != "_acme-challenge.www" {
+		t.Errorf("expected relative names, got: %v", p.names)
+	}
+
+	if err = c.UnprovisionRecords(context.Background(), records); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err = c.Provision(context.Background(), "TXT", "_acme-challenge.example.com", "c"); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err = c.Unprovision(context.Background(), "TXT", "_acme-challenge.example.com", "c"); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("_acme-challenge.example.com.", dns.TypeTXT)
+	res, err := dns.Exchange(m, s.Addr())
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if res.Rcode != dns.RcodeNameError {
+		t.Errorf("expected NXDOMAIN, got: %s", dns.RcodeToString[res.Rcode])
+	}
+
+	// errors
+	if _, err = c.ProvisionRecords(context.Background(), []provision.Challenge{
+		{Name: "_acme-challenge.example.org", Type: "TXT", Value: "d"},
+	}); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+	if _, err = p.AppendRecords(context.Background(), "example.com", []libdns.Record{{Type: "A", Name: "www", Value: "192.0.2.1"}}); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+}
+
+func TestWaitsForPropagation(t *testing.T) {
+	tests := []struct {
+		opts []Option
+		exp  bool
+	}{
+		{nil, true},
+		{[]Option{PropagationWait(0)}, false},
+		{[]Option{PropagationWait(-1), Zone("example.com")}, false},
+	}
+	for i, test := range tests {
+		c, err := New(&testProvider{}, test.opts...)
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		if waits := c.WaitsForPropagation(); waits != test.exp {
+			t.Errorf("test %d expected %t, got: %t", i, test.exp, waits)
+		}
+		if c.zone == "" && c.resolver == nil {
+			t.Errorf("test %d expected resolver to be created", i)
+		}
+	}
+}
+
+// testProvider records the zone and names passed to a libdns provider.
+type testProvider struct {
+	RecordProvider
+	zone  string
+	names []string
+}
+
+func (p *testProvider) AppendRecords(ctxt context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	p.zone = zone
+	for _, rec := range recs {
+		p.names = append(p.names, rec.Name)
+	}
+	return p.RecordProvider.AppendRecords(ctxt, zone, recs)
+}
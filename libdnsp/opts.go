@@ -0,0 +1,67 @@
+package libdnsp
+
+import (
+	"time"
+
+	"github.com/brankas/autocertdns/propagation"
+)
+
+// Option is the Client option type.
+type Option func(c *Client) error
+
+// Zone is a Client option to set the zone passed to the provider.
+//
+// If not set, the zone is determined by looking up the zone apex of the
+// provisioned name.
+func Zone(zone string) Option {
+	return func(c *Client) error {
+		c.zone = zone
+		return nil
+	}
+}
+
+// TTL is a Client option to set the TTL of provisioned records.
+func TTL(ttl time.Duration) Option {
+	return func(c *Client) error {
+		c.ttl = ttl
+		return nil
+	}
+}
+
+// Checker is a Client option to set the propagation checker used to wait for
+// provisioned records to propagate to the zone's nameservers, and to look up
+// zones.
+func Checker(checker *propagation.Checker) Option {
+	return func(c *Client) error {
+		c.checker = checker
+		return nil
+	}
+}
+
+// PropagationWait is a Client option to wait up to d for provisioned records
+// to propagate to the zone's nameservers.
+//
+// If not set, records are waited on for DefaultPropagationWait. A zero or
+// negative d disables waiting for propagation.
+func PropagationWait(d time.Duration) Option {
+	return func(c *Client) error {
+		c.propagationWait = d
+		return nil
+	}
+}
+
+// Logf is a Client option to specify the logging function used.
+func Logf(f func(string, ...interface{})) Option {
+	return func(c *Client) error {
+		c.logf = f
+		return nil
+	}
+}
+
+// Errorf is a Client option to specify the error logging function used.
+func Errorf(f func(string, ...interface{})) Option {
+	return func(c *Client) error {
+		c.errf = f
+		return nil
+	}
+}
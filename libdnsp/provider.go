@@ -0,0 +1,101 @@
+package libdnsp
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/libdns/libdns"
+
+	"github.com/brankas/autocertdns"
+	"github.com/brankas/autocertdns/provision"
+)
+
+// Provider is a libdns provider for an autocertdns.ProvisionerV2, such as
+// gcdnsp.Client or godop.Client.
+//
+// Only TXT records are supported. Each record is provisioned separately, so
+// that the record handles returned by the provisioner can be used when the
+// record is deleted.
+type Provider struct {
+	p autocertdns.ProvisionerV2
+
+	// records are the handles of appended records, by name and value.
+	records map[string][]provision.Record
+	mu      sync.Mutex
+}
+
+// NewProvider creates a libdns provider for the provisioner.
+func NewProvider(p autocertdns.ProvisionerV2) *Provider {
+	return &Provider{
+		p:       p,
+		records: make(map[string][]provision.Record),
+	}
+}
+
+// AppendRecords satisfies the libdns.RecordAppender interface.
+func (p *Provider) AppendRecords(ctxt context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	for _, rec := range recs {
+		if rec.Type != allowedRecordType {
+			return nil, errors.New("only TXT records are supported")
+		}
+	}
+
+	var appended []libdns.Record
+	for _, rec := range recs {
+		name := libdns.AbsoluteName(rec.Name, fqdn(zone))
+		records, err := p.p.ProvisionRecords(ctxt, []provision.Challenge{{
+			Name:  name,
+			Type:  allowedRecordType,
+			Value: rec.Value,
+		}})
+		if len(records) != 0 {
+			p.mu.Lock()
+			k := key(name, rec.Value)
+			p.records[k] = append(p.records[k], records...)
+			p.mu.Unlock()
+		}
+		if err != nil {
+			return appended, err
+		}
+		appended = append(appended, rec)
+	}
+	return appended, nil
+}
+
+// DeleteRecords satisfies the libdns.RecordDeleter interface.
+//
+// Records not appended with the Provider are unprovisioned by name and value.
+func (p *Provider) DeleteRecords(ctxt context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	var deleted []libdns.Record
+	for _, rec := range recs {
+		if rec.Type != allowedRecordType {
+			return deleted, errors.New("only TXT records are supported")
+		}
+		name := libdns.AbsoluteName(rec.Name, fqdn(zone))
+		k := key(name, rec.Value)
+
+		p.mu.Lock()
+		records := p.records[k]
+		delete(p.records, k)
+		p.mu.Unlock()
+
+		var err error
+		if len(records) != 0 {
+			err = p.p.UnprovisionRecords(ctxt, records)
+		} else {
+			err = p.p.Unprovision(ctxt, allowedRecordType, name, rec.Value)
+		}
+		if err != nil {
+			return deleted, err
+		}
+		deleted = append(deleted, rec)
+	}
+	return deleted, nil
+}
+
+// key returns the records key for the name and value.
+func key(name, value string) string {
+	return strings.ToLower(name) + " " + value
+}
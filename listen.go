@@ -0,0 +1,99 @@
+package autocertdns
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// TLSConfig returns a tls.Config that serves the Manager's current
+// certificate, requiring TLS 1.2 or newer, and negotiating HTTP/2 and
+// HTTP/1.1 via ALPN.
+func (m *Manager) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: m.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+}
+
+// Listener runs the Manager (see Run), and then returns a TLS net.Listener on
+// the TCP address addr using the Manager's TLSConfig.
+func (m *Manager) Listener(ctxt context.Context, addr string) (net.Listener, error) {
+	if err := m.Run(ctxt); err != nil {
+		return nil, err
+	}
+	return tls.Listen("tcp", addr, m.TLSConfig())
+}
+
+// ListenAndServeTLS runs the Manager (see Run), and then serves HTTPS
+// requests on the TCP address addr with handler until the context is closed.
+//
+// If addr is empty, ":https" is used. If RedirectAddr is set, plain HTTP
+// requests on RedirectAddr are redirected to HTTPS.
+//
+// Always returns a non-nil error. After the context has been closed, the
+// returned error is http.ErrServerClosed.
+func (m *Manager) ListenAndServeTLS(ctxt context.Context, addr string, handler http.Handler) error {
+	if addr == "" {
+		addr = ":https"
+	}
+
+	l, err := m.Listener(ctxt, addr)
+	if err != nil {
+		return err
+	}
+
+	servers := []*http.Server{
+		{Handler: handler, TLSConfig: m.TLSConfig()},
+	}
+	errc := make(chan error, 2)
+	go func() {
+		errc <- servers[0].Serve(l)
+	}()
+
+	// start redirect listener
+	if m.RedirectAddr != "" {
+		s := &http.Server{Addr: m.RedirectAddr, Handler: redirectHandler(addr)}
+		servers = append(servers, s)
+		go func() {
+			errc <- s.ListenAndServe()
+		}()
+	}
+
+	select {
+	case err = <-errc:
+	case <-ctxt.Done():
+		m.log("context done: %v", ctxt.Err())
+		err = http.ErrServerClosed
+	}
+
+	for _, s := range servers {
+		s.Close()
+	}
+
+	return err
+}
+
+// redirectHandler returns a http.Handler that redirects all requests to HTTPS
+// on the port of the TCP address addr.
+func redirectHandler(addr string) http.Handler {
+	_, port, _ := net.SplitHostPort(addr)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		host, _, err := net.SplitHostPort(req.Host)
+		if err != nil {
+			host = strings.TrimSuffix(strings.TrimPrefix(req.Host, "["), "]")
+		}
+		switch {
+		case port != "" && port != "443" && port != "https":
+			host = net.JoinHostPort(host, port)
+		case strings.Contains(host, ":"):
+			host = "[" + host + "]"
+		}
+		u := *req.URL
+		u.Scheme, u.Host = "https", host
+		http.Redirect(w, req, u.String(), http.StatusFound)
+	})
+}
@@ -0,0 +1,145 @@
+package autocertdns
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTLSConfig(t *testing.T) {
+	t.Parallel()
+
+	m := &Manager{}
+	conf := m.TLSConfig()
+	if conf.MinVersion != tls.VersionTLS12 {
+		t.Errorf("expected MinVersion %d, got: %d", tls.VersionTLS12, conf.MinVersion)
+	}
+	if exp := []string{"h2", "http/1.1"}; !reflect.DeepEqual(conf.NextProtos, exp) {
+		t.Errorf("expected NextProtos %v, got: %v", exp, conf.NextProtos)
+	}
+	if conf.GetCertificate == nil {
+		t.Errorf("expected GetCertificate to be set")
+	}
+}
+
+func TestListener(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "autocertdns")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctxt, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const domain = "listener.example.com"
+	if err := writeTestCert(dir, domain, domain, true); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	m := &Manager{
+		CacheDir:     dir,
+		Domain:       domain,
+		RenewBefore:  time.Minute,
+		DisableWatch: true,
+	}
+	l, err := m.Listener(ctxt, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.(*tls.Conn).Handshake()
+			}()
+		}
+	}()
+
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"h2"},
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	defer conn.Close()
+	state := conn.ConnectionState()
+	if state.NegotiatedProtocol != "h2" {
+		t.Errorf("expected h2, got: %q", state.NegotiatedProtocol)
+	}
+	cert, _ := m.GetCertificate(nil)
+	if len(state.PeerCertificates) == 0 || !reflect.DeepEqual(state.PeerCertificates[0].Raw, cert.Certificate[0]) {
+		t.Errorf("expected Manager certificate to be served")
+	}
+}
+
+func TestListenAndServeTLS(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "autocertdns")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	const domain = "serve.example.com"
+	if err := writeTestCert(dir, domain, domain, true); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	m := &Manager{
+		CacheDir:     dir,
+		Domain:       domain,
+		RenewBefore:  time.Minute,
+		DisableWatch: true,
+	}
+
+	ctxt, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := m.ListenAndServeTLS(ctxt, "127.0.0.1:0", http.NotFoundHandler()); err != http.ErrServerClosed {
+		t.Errorf("expected http.ErrServerClosed, got: %v", err)
+	}
+}
+
+func TestRedirectHandler(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		addr, host, target, exp string
+	}{
+		{":https", "example.com", "/", "https://example.com/"},
+		{":443", "example.com:80", "/path?q=1", "https://example.com/path?q=1"},
+		{"", "example.com:8080", "/", "https://example.com/"},
+		{":8443", "example.com", "/", "https://example.com:8443/"},
+		{":8443", "example.com:8080", "/path", "https://example.com:8443/path"},
+		{"127.0.0.1:8443", "example.com", "/", "https://example.com:8443/"},
+		{":https", "[::1]", "/", "https://[::1]/"},
+		{":https", "[::1]:80", "/", "https://[::1]/"},
+		{":8443", "[::1]", "/", "https://[::1]:8443/"},
+		{":8443", "[2001:db8::1]:8080", "/path", "https://[2001:db8::1]:8443/path"},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", test.target, nil)
+		req.Host = test.host
+		w := httptest.NewRecorder()
+		redirectHandler(test.addr).ServeHTTP(w, req)
+		if w.Code != http.StatusFound {
+			t.Errorf("test %d expected status %d, got: %d", i, http.StatusFound, w.Code)
+		}
+		if loc := w.Header().Get("Location"); loc != test.exp {
+			t.Errorf("test %d expected %s, got: %s", i, test.exp, loc)
+		}
+	}
+}
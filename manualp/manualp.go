@@ -0,0 +1,265 @@
+// Package manualp provides an interactive provisioner for zones that cannot
+// be automated, and that satisfies autocertdns.Provisioner and
+// autocertdns.ProvisionerV2.
+//
+// Similar to certbot's --manual mode, the records to create (or remove) are
+// printed to a writer, and provisioning blocks until the operator confirms on
+// a reader, or until a propagation checker sees the change.
+package manualp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/brankas/autocertdns/propagation"
+	"github.com/brankas/autocertdns/provision"
+)
+
+const (
+	// allowedRecordType is the allowed record provisioning type.
+	allowedRecordType = "TXT"
+
+	// DefaultTTL is the default suggested TTL.
+	DefaultTTL = 60
+)
+
+// ErrNoConfirmation is the error returned when the reader is closed before
+// the operator confirms, and there is no propagation checker.
+var ErrNoConfirmation = errors.New("manualp: no confirmation")
+
+// record is a handle to a provisioned record.
+type record struct {
+	name  string
+	value string
+}
+
+// Client is an interactive provisioner.
+type Client struct {
+	w       io.Writer
+	r       io.Reader
+	ttl     int
+	checker *propagation.Checker
+	logf    func(string, ...interface{})
+	errf    func(string, ...interface{})
+
+	// lines are the lines read from r.
+	lines chan string
+	once  sync.Once
+
+	// mu serializes prompts.
+	mu sync.Mutex
+}
+
+// New creates a new interactive provisioner.
+//
+// If not set, the writer and reader default to os.Stdout and os.Stdin.
+func New(opts ...Option) (*Client, error) {
+	c := &Client{
+		w:    os.Stdout,
+		r:    os.Stdin,
+		ttl:  DefaultTTL,
+		logf: func(string, ...interface{}) {},
+	}
+
+	// apply opts
+	for _, o := range opts {
+		if err := o(c); err != nil {
+			return nil, err
+		}
+	}
+
+	// ensure errf is set
+	if c.errf == nil {
+		c.errf = func(s string, v ...interface{}) {
+			c.logf("ERROR: "+s, v...)
+		}
+	}
+
+	if c.r == nil && c.checker == nil {
+		return nil, errors.New("manualp requires a reader or a propagation checker")
+	}
+
+	return c, nil
+}
+
+// Provision prompts for a DNS record of typ, for the specified domain name and
+// with the value in token, to be created.
+func (c *Client) Provision(ctxt context.Context, typ, name, token string) error {
+	_, err := c.ProvisionRecords(ctxt, []provision.Challenge{{Type: typ, Name: name, Value: token}})
+	return err
+}
+
+// Unprovision prompts for the DNS record of typ, for the specified domain
+// name, and for the record with the specified token as the value, to be
+// removed.
+func (c *Client) Unprovision(ctxt context.Context, typ, name, token string) error {
+	if typ != allowedRecordType {
+		return errors.New("only TXT records are supported")
+	}
+	return c.UnprovisionRecords(ctxt, []provision.Record{&record{name: fqdn(name), value: token}})
+}
+
+// ProvisionRecords prints the records for the challenges, and blocks until
+// the operator confirms they were created, or until the propagation checker
+// sees all the records.
+func (c *Client) ProvisionRecords(ctxt context.Context, challenges []provision.Challenge) ([]provision.Record, error) {
+	var records []*record
+	for _, ch := range challenges {
+		if ch.Type != allowedRecordType {
+			return nil, errors.New("only TXT records are supported")
+		}
+		records = append(records, &record{name: fqdn(ch.Name), value: ch.Value})
+	}
+
+	if err := c.prompt(ctxt, "Create", records, true); err != nil {
+		return nil, err
+	}
+
+	var res []provision.Record
+	for _, r := range records {
+		res = append(res, r)
+	}
+	return res, nil
+}
+
+// UnprovisionRecords prints the provisioned records, and blocks until the
+// operator confirms they were removed, or until the propagation checker no
+// longer sees the records.
+func (c *Client) UnprovisionRecords(ctxt context.Context, records []provision.Record) error {
+	var recs []*record
+	for _, rec := range records {
+		r, ok := rec.(*record)
+		if !ok {
+			return provision.ErrUnknownRecord
+		}
+		recs = append(recs, r)
+	}
+	return c.prompt(ctxt, "Remove", recs, false)
+}
+
+// WaitsForPropagation satisfies the autocertdns.ProvisionerV2 interface.
+//
+// Always returns false, as the operator may confirm before the records have
+// propagated, leaving the wait to the Manager's propagation checker.
+func (c *Client) WaitsForPropagation() bool {
+	return false
+}
+
+// prompt prints the action for the records, and waits for confirmation or
+// for the propagation checker to see the records present (or removed).
+func (c *Client) prompt(ctxt context.Context, action string, records []*record, present bool) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// discard lines entered before the prompt
+	lines := c.readLines()
+	for drained := false; !drained; {
+		select {
+		case _, ok := <-lines:
+			drained = !ok
+		default:
+			drained = true
+		}
+	}
+
+	// print records
+	var b strings.Builder
+	fmt.Fprintf(&b, "\n%s the following DNS record(s):\n\n", action)
+	for _, r := range records {
+		fmt.Fprintf(&b, "\t%s %d IN %s %q\n", r.name, c.ttl, allowedRecordType, r.value)
+	}
+	switch {
+	case lines != nil && c.checker != nil:
+		fmt.Fprintf(&b, "\nPress Enter once done, or wait for the change to be detected...\n")
+	case lines != nil:
+		fmt.Fprintf(&b, "\nPress Enter once done...\n")
+	default:
+		fmt.Fprintf(&b, "\nWaiting for the change to be detected...\n")
+	}
+	if _, err := io.WriteString(c.w, b.String()); err != nil {
+		return err
+	}
+
+	// check propagation
+	ctxt, cancel := context.WithCancel(ctxt)
+	defer cancel()
+	checked := make(chan error, 1)
+	if c.checker != nil {
+		go func() {
+			for _, r := range records {
+				var err error
+				if present {
+					err = c.checker.Wait(ctxt, r.name, r.value)
+				} else {
+					err = c.checker.WaitRemoved(ctxt, r.name, r.value)
+				}
+				if err != nil {
+					checked <- err
+					return
+				}
+			}
+			checked <- nil
+		}()
+	}
+
+	for {
+		select {
+		case <-ctxt.Done():
+			return ctxt.Err()
+		case _, ok := <-lines:
+			if ok {
+				c.logf("%s confirmed", strings.ToLower(action))
+				return nil
+			}
+			if c.checker == nil {
+				return ErrNoConfirmation
+			}
+			lines = nil
+		case err := <-checked:
+			if err == nil {
+				c.logf("%s detected", strings.ToLower(action))
+				return nil
+			}
+			if lines == nil {
+				return err
+			}
+			c.errf("%v, waiting for confirmation", err)
+			checked = nil
+		}
+	}
+}
+
+// readLines starts reading lines from the reader, returning the channel of
+// lines read. The channel is closed when the reader is closed, and is nil when
+// the Client has no reader.
+func (c *Client) readLines() <-chan string {
+	if c.r == nil {
+		return nil
+	}
+	c.once.Do(func() {
+		c.lines = make(chan string)
+		go func() {
+			defer close(c.lines)
+			s := bufio.NewScanner(c.r)
+			for s.Scan() {
+				c.lines <- s.Text()
+			}
+		}()
+	})
+	return c.lines
+}
+
+// fqdn returns name with a trailing dot.
+func fqdn(name string) string {
+	return strings.TrimSuffix(name, ".") + "."
+}
@@ -0,0 +1,127 @@
+package manualp
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brankas/autocertdns/dnsserverp"
+	"github.com/brankas/autocertdns/propagation"
+	"github.com/brankas/autocertdns/provision"
+)
+
+func TestConfirm(t *testing.T) {
+	r, pw := io.Pipe()
+	w := newPromptWriter()
+	c, err := New(Writer(w), Reader(r), TTL(300))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	// confirm each prompt
+	go func() {
+		for range w.prompts {
+			io.WriteString(pw, "\n")
+		}
+	}()
+
+	records, err := c.ProvisionRecords(context.Background(), []provision.Challenge{
+		{Name: "_acme-challenge.example.com", Type: "TXT", Value: "a"},
+		{Name: "_acme-challenge.example.com.", Type: "TXT", Value: "b"},
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got: %d", len(records))
+	}
+	if err = c.UnprovisionRecords(context.Background(), records); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	out := w.b.String()
+	for _, s := range []string{
+		"Create the following DNS record(s):",
+		`_acme-challenge.example.com. 300 IN TXT "a"`,
+		`_acme-challenge.example.com. 300 IN TXT "b"`,
+		"Remove the following DNS record(s):",
+	} {
+		if !strings.Contains(out, s) {
+			t.Errorf("expected output to contain %q, got:\n%s", s, out)
+		}
+	}
+
+	// no confirmation
+	pw.Close()
+	if err = c.Provision(context.Background(), "TXT", "_acme-challenge.example.com", "c"); err != ErrNoConfirmation {
+		t.Errorf("expected ErrNoConfirmation, got: %v", err)
+	}
+	if err = c.Provision(context.Background(), "A", "example.com", "c"); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+}
+
+func TestChecker(t *testing.T) {
+	s, err := dnsserverp.New(dnsserverp.Addr("127.0.0.1:0"), dnsserverp.Zone("example.com"))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	defer s.Close()
+
+	checker, err := propagation.New(
+		propagation.Nameservers(s.Addr()),
+		propagation.Timeout(5*time.Second),
+		propagation.Interval(10*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	// the operator never confirms, but creates and removes the record
+	r, pw := io.Pipe()
+	defer pw.Close()
+	w := newPromptWriter()
+	c, err := New(Writer(w), Reader(r), Checker(checker))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	ch := provision.Challenge{Name: "_acme-challenge.example.com", Type: "TXT", Value: "token"}
+	var handles []provision.Record
+	go func() {
+		<-w.prompts
+		var err error
+		if handles, err = s.ProvisionRecords(context.Background(), []provision.Challenge{ch}); err != nil {
+			t.Errorf("expected no error, got: %v", err)
+		}
+		<-w.prompts
+		if err := s.UnprovisionRecords(context.Background(), handles); err != nil {
+			t.Errorf("expected no error, got: %v", err)
+		}
+	}()
+
+	records, err := c.ProvisionRecords(context.Background(), []provision.Challenge{ch})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err = c.UnprovisionRecords(context.Background(), records); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+}
+
+// promptWriter is a writer that signals when a prompt has been written.
+type promptWriter struct {
+	b       strings.Builder
+	prompts chan struct{}
+}
+
+func newPromptWriter() *promptWriter {
+	return &promptWriter{prompts: make(chan struct{}, 8)}
+}
+
+func (w *promptWriter) Write(buf []byte) (int, error) {
+	n, err := w.b.Write(buf)
+	w.prompts <- struct{}{}
+	return n, err
+}
@@ -0,0 +1,60 @@
+package manualp
+
+import (
+	"io"
+
+	"github.com/brankas/autocertdns/propagation"
+)
+
+// Option is the Client option type.
+type Option func(c *Client) error
+
+// Writer is a Client option to set the writer the records are printed to.
+func Writer(w io.Writer) Option {
+	return func(c *Client) error {
+		c.w = w
+		return nil
+	}
+}
+
+// Reader is a Client option to set the reader the operator confirms on. A nil
+// reader disables confirmation, and requires a propagation checker.
+func Reader(r io.Reader) Option {
+	return func(c *Client) error {
+		c.r = r
+		return nil
+	}
+}
+
+// TTL is a Client option to set the suggested TTL of the records.
+func TTL(ttl int) Option {
+	return func(c *Client) error {
+		c.ttl = ttl
+		return nil
+	}
+}
+
+// Checker is a Client option to set the propagation checker used to detect
+// when the records have been created or removed.
+func Checker(checker *propagation.Checker) Option {
+	return func(c *Client) error {
+		c.checker = checker
+		return nil
+	}
+}
+
+// Logf is a Client option to specify the logging function used.
+func Logf(f func(string, ...interface{})) Option {
+	return func(c *Client) error {
+		c.logf = f
+		return nil
+	}
+}
+
+// Errorf is a Client option to specify the error logging function used.
+func Errorf(f func(string, ...interface{})) Option {
+	return func(c *Client) error {
+		c.errf = f
+		return nil
+	}
+}
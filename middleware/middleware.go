@@ -0,0 +1,278 @@
+// Package middleware provides decorators for autocertdns.Provisioner
+// implementations, adding retries, timeouts, logging and tracing around any
+// provisioner.
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/brankas/autocertdns"
+	"github.com/brankas/autocertdns/provision"
+)
+
+// Operation names passed to middleware.
+const (
+	OpProvision          = "Provision"
+	OpUnprovision        = "Unprovision"
+	OpProvisionRecords   = "ProvisionRecords"
+	OpUnprovisionRecords = "UnprovisionRecords"
+)
+
+// Middleware is a provisioner decorator.
+type Middleware func(autocertdns.ProvisionerV2) autocertdns.ProvisionerV2
+
+// Wrap wraps p with the middleware. The first middleware is the outermost,
+// and is called first.
+//
+// For example, the following retries each call up to 5 times, with each
+// attempt limited to 30 seconds and logged:
+//
+//	p := middleware.Wrap(
+//		client,
+//		middleware.Retry(5, time.Second),
+//		middleware.Timeout(30*time.Second),
+//		middleware.Log(log.Printf),
+//	)
+func Wrap(p autocertdns.Provisioner, mw ...Middleware) autocertdns.ProvisionerV2 {
+	v2 := autocertdns.AsProvisionerV2(p)
+	for i := len(mw) - 1; i >= 0; i-- {
+		v2 = mw[i](v2)
+	}
+	return v2
+}
+
+// call is a call to a provisioner.
+type call struct {
+	op    string
+	names []string
+
+	// do performs the call.
+	do func(context.Context) error
+
+	// undo reverts the effects of a failed call, before it is retried.
+	undo func(context.Context)
+}
+
+// handler handles a call.
+type handler func(context.Context, *call) error
+
+// middleware creates a Middleware that passes each call to h.
+func middleware(h handler) Middleware {
+	return func(next autocertdns.ProvisionerV2) autocertdns.ProvisionerV2 {
+		return &provisioner{next: next, h: h}
+	}
+}
+
+// provisioner is a provisioner that passes calls to a handler.
+type provisioner struct {
+	next autocertdns.ProvisionerV2
+	h    handler
+}
+
+// Provision satisfies the autocertdns.Provisioner interface.
+func (p *provisioner) Provision(ctxt context.Context, typ, name, token string) error {
+	return p.h(ctxt, &call{
+		op:    OpProvision,
+		names: []string{name},
+		do: func(ctxt context.Context) error {
+			return p.next.Provision(ctxt, typ, name, token)
+		},
+		undo: func(context.Context) {},
+	})
+}
+
+// Unprovision satisfies the autocertdns.Provisioner interface.
+func (p *provisioner) Unprovision(ctxt context.Context, typ, name, token string) error {
+	return p.h(ctxt, &call{
+		op:    OpUnprovision,
+		names: []string{name},
+		do: func(ctxt context.Context) error {
+			return p.next.Unprovision(ctxt, typ, name, token)
+		},
+		undo: func(context.Context) {},
+	})
+}
+
+// ProvisionRecords satisfies the autocertdns.ProvisionerV2 interface.
+func (p *provisioner) ProvisionRecords(ctxt context.Context, challenges []provision.Challenge) ([]provision.Record, error) {
+	var names []string
+	for _, ch := range challenges {
+		names = append(names, ch.Name)
+	}
+	var records []provision.Record
+	err := p.h(ctxt, &call{
+		op:    OpProvisionRecords,
+		names: names,
+		do: func(ctxt context.Context) error {
+			var err error
+			records, err = p.next.ProvisionRecords(ctxt, challenges)
+			return err
+		},
+		undo: func(ctxt context.Context) {
+			if len(records) != 0 {
+				_ = p.next.UnprovisionRecords(ctxt, records)
+				records = nil
+			}
+		},
+	})
+	return records, err
+}
+
+// UnprovisionRecords satisfies the autocertdns.ProvisionerV2 interface.
+func (p *provisioner) UnprovisionRecords(ctxt context.Context, records []provision.Record) error {
+	return p.h(ctxt, &call{
+		op: OpUnprovisionRecords,
+		do: func(ctxt context.Context) error {
+			return p.next.UnprovisionRecords(ctxt, records)
+		},
+		undo: func(context.Context) {},
+	})
+}
+
+// WaitsForPropagation satisfies the autocertdns.ProvisionerV2 interface.
+func (p *provisioner) WaitsForPropagation() bool {
+	return p.next.WaitsForPropagation()
+}
+
+// Retry is a middleware that retries calls failing with a retryable error (see
+// IsRetryable), up to a total of attempts. The delay between attempts starts
+// at backoff and doubles after each attempt.
+func Retry(attempts int, backoff time.Duration) Middleware {
+	return RetryIf(attempts, backoff, IsRetryable)
+}
+
+// RetryIf is a middleware that retries calls failing with an error for which
+// retryable returns true, up to a total of attempts. The delay between
+// attempts starts at backoff and doubles after each attempt.
+//
+// Records provisioned by a failed ProvisionRecords call are unprovisioned
+// before the call is retried.
+func RetryIf(attempts int, backoff time.Duration, retryable func(error) bool) Middleware {
+	return middleware(func(ctxt context.Context, c *call) error {
+		var err error
+		for i := 0; ; i++ {
+			if err = c.do(ctxt); err == nil || i >= attempts-1 || !retryable(err) {
+				return err
+			}
+			c.undo(ctxt)
+
+			select {
+			case <-ctxt.Done():
+				return err
+			case <-time.After(backoff << uint(i)):
+			}
+		}
+	})
+}
+
+// Timeout is a middleware that limits each call to the duration d.
+//
+// When used with Retry, Timeout should be inside Retry (ie, passed after
+// Retry to Wrap), so that each attempt has its own timeout.
+func Timeout(d time.Duration) Middleware {
+	return middleware(func(ctxt context.Context, c *call) error {
+		ctxt, cancel := context.WithTimeout(ctxt, d)
+		defer cancel()
+		return c.do(ctxt)
+	})
+}
+
+// Log is a middleware that logs each call, its duration and its result.
+func Log(logf func(string, ...interface{})) Middleware {
+	return middleware(func(ctxt context.Context, c *call) error {
+		start := time.Now()
+		logf("%s %v", c.op, c.names)
+		err := c.do(ctxt)
+		if err != nil {
+			logf("%s %v failed after %v: %v", c.op, c.names, time.Since(start), err)
+		} else {
+			logf("%s %v completed in %v", c.op, c.names, time.Since(start))
+		}
+		return err
+	})
+}
+
+// TraceFunc starts a trace span for a call with the operation op and the
+// challenge names, returning the context for the call and a func that ends the
+// span with the call's result.
+type TraceFunc func(ctxt context.Context, op string, names []string) (context.Context, func(error))
+
+// Trace is a middleware that traces each call with f, allowing integration
+// with any tracing library.
+func Trace(f TraceFunc) Middleware {
+	return middleware(func(ctxt context.Context, c *call) error {
+		ctxt, end := f(ctxt, c.op, c.names)
+		err := c.do(ctxt)
+		end(err)
+		return err
+	})
+}
+
+// permanentError is an error that is not retried.
+type permanentError struct {
+	err error
+}
+
+// Error satisfies the error interface.
+func (err *permanentError) Error() string {
+	return err.err.Error()
+}
+
+// Unwrap returns the wrapped error.
+func (err *permanentError) Unwrap() error {
+	return err.err
+}
+
+// Permanent wraps err so that it is not retried by Retry.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err}
+}
+
+// IsRetryable returns true when err is a transient error worth retrying:
+// deadline exceeded and timeout errors, errors with a Temporary method
+// returning true (as temporary network errors), and errors with a StatusCode
+// method returning a 429 or 5xx status code. Errors wrapped with Permanent,
+// and context cancellation, are never retryable.
+//
+// Provider specific errors that do not satisfy these interfaces can be
+// classified with RetryIf.
+func IsRetryable(err error) bool {
+	var perr *permanentError
+	switch {
+	case err == nil, errors.As(err, &perr), errors.Is(err, context.Canceled):
+		return false
+	case errors.Is(err, context.DeadlineExceeded):
+		return true
+	}
+
+	// status errors
+	var serr interface{ StatusCode() int }
+	if errors.As(err, &serr) {
+		return retryableStatus(serr.StatusCode())
+	}
+
+	// network and temporary errors
+	var nerr net.Error
+	if errors.As(err, &nerr) {
+		return nerr.Timeout() || nerr.Temporary()
+	}
+	var terr interface{ Temporary() bool }
+	if errors.As(err, &terr) {
+		return terr.Temporary()
+	}
+
+	return false
+}
+
+// retryableStatus returns true for HTTP status codes indicating a transient
+// error.
+func retryableStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= 500
+}
@@ -0,0 +1,189 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+
+	"github.com/brankas/autocertdns/provision"
+)
+
+func TestRetry(t *testing.T) {
+	tests := []struct {
+		err      error
+		attempts int
+	}{
+		{nil, 1},
+		{statusError(http.StatusServiceUnavailable), 3},
+		{statusError(http.StatusTooManyRequests), 3},
+		{statusError(http.StatusForbidden), 1},
+		{fmt.Errorf("wrapped: %w", statusError(http.StatusBadGateway)), 3},
+		{temporaryError(true), 3},
+		{temporaryError(false), 1},
+		{fmt.Errorf("wrapped: %w", context.DeadlineExceeded), 3},
+		{Permanent(context.DeadlineExceeded), 1},
+		{errors.New("other"), 1},
+	}
+	for i, test := range tests {
+		p := &testProvisioner{err: test.err}
+		err := Wrap(p, Retry(3, time.Millisecond)).Provision(context.Background(), "TXT", "example.com", "a")
+		if !errors.Is(err, test.err) {
+			t.Errorf("test %d expected %v, got: %v", i, test.err, err)
+		}
+		if p.calls != test.attempts {
+			t.Errorf("test %d expected %d attempts, got: %d", i, test.attempts, p.calls)
+		}
+	}
+}
+
+func TestRetryIf(t *testing.T) {
+	// googleapi.Error has no StatusCode method, so is classified by the caller
+	retryable := func(err error) bool {
+		var gerr *googleapi.Error
+		if errors.As(err, &gerr) {
+			return gerr.Code >= 500
+		}
+		return IsRetryable(err)
+	}
+	tests := []struct {
+		err      error
+		attempts int
+	}{
+		{&googleapi.Error{Code: http.StatusServiceUnavailable}, 3},
+		{&googleapi.Error{Code: http.StatusForbidden}, 1},
+		{statusError(http.StatusServiceUnavailable), 3},
+	}
+	for i, test := range tests {
+		p := &testProvisioner{err: test.err}
+		err := Wrap(p, RetryIf(3, time.Millisecond, retryable)).Provision(context.Background(), "TXT", "example.com", "a")
+		if !errors.Is(err, test.err) {
+			t.Errorf("test %d expected %v, got: %v", i, test.err, err)
+		}
+		if p.calls != test.attempts {
+			t.Errorf("test %d expected %d attempts, got: %d", i, test.attempts, p.calls)
+		}
+	}
+}
+
+func TestRetryUndo(t *testing.T) {
+	p := &testProvisioner{err: statusError(http.StatusBadGateway), partial: true}
+	_, err := Wrap(p, Retry(2, time.Millisecond)).ProvisionRecords(context.Background(), []provision.Challenge{
+		{Name: "a.example.com", Type: "TXT", Value: "a"},
+		{Name: "b.example.com", Type: "TXT", Value: "b"},
+	})
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+	if p.calls != 2 {
+		t.Errorf("expected 2 attempts, got: %d", p.calls)
+	}
+	if p.unprovisioned != 1 {
+		t.Errorf("expected partial records to be unprovisioned once, got: %d", p.unprovisioned)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	p := &testProvisioner{block: true}
+	start := time.Now()
+	err := Wrap(p, Retry(2, time.Millisecond), Timeout(10*time.Millisecond)).Provision(context.Background(), "TXT", "example.com", "a")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got: %v", err)
+	}
+	if p.calls != 2 {
+		t.Errorf("expected 2 attempts, got: %d", p.calls)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("expected timeout, took: %v", d)
+	}
+}
+
+func TestLogTrace(t *testing.T) {
+	var logs int
+	var ops []string
+	var ended error
+	trace := func(ctxt context.Context, op string, names []string) (context.Context, func(error)) {
+		ops = append(ops, op)
+		return ctxt, func(err error) { ended = err }
+	}
+	p := &testProvisioner{err: errors.New("failed")}
+	w := Wrap(p, Log(func(string, ...interface{}) { logs++ }), Trace(trace))
+	if err := w.Unprovision(context.Background(), "TXT", "example.com", "a"); err == nil {
+		t.Fatalf("expected error")
+	}
+	if logs != 2 {
+		t.Errorf("expected 2 log lines, got: %d", logs)
+	}
+	if len(ops) != 1 || ops[0] != OpUnprovision {
+		t.Errorf("expected %s to be traced, got: %v", OpUnprovision, ops)
+	}
+	if ended != p.err {
+		t.Errorf("expected span to end with %v, got: %v", p.err, ended)
+	}
+}
+
+// testProvisioner is a test provisioner.
+// statusError is an API error with a status code.
+type statusError int
+
+func (err statusError) Error() string {
+	return http.StatusText(int(err))
+}
+
+func (err statusError) StatusCode() int {
+	return int(err)
+}
+
+// temporaryError is an error that may be temporary.
+type temporaryError bool
+
+func (err temporaryError) Error() string {
+	return fmt.Sprintf("temporary: %t", bool(err))
+}
+
+func (err temporaryError) Temporary() bool {
+	return bool(err)
+}
+
+type testProvisioner struct {
+	err           error
+	block         bool
+	partial       bool
+	calls         int
+	unprovisioned int
+}
+
+func (p *testProvisioner) Provision(ctxt context.Context, _, _, _ string) error {
+	p.calls++
+	if p.block {
+		<-ctxt.Done()
+		return ctxt.Err()
+	}
+	return p.err
+}
+
+func (p *testProvisioner) Unprovision(context.Context, string, string, string) error {
+	p.calls++
+	return p.err
+}
+
+func (p *testProvisioner) ProvisionRecords(_ context.Context, challenges []provision.Challenge) ([]provision.Record, error) {
+	p.calls++
+	if p.partial {
+		return []provision.Record{challenges[0]}, p.err
+	}
+	return nil, p.err
+}
+
+func (p *testProvisioner) UnprovisionRecords(context.Context, []provision.Record) error {
+	p.unprovisioned++
+	return nil
+}
+
+func (p *testProvisioner) WaitsForPropagation() bool {
+	return false
+}
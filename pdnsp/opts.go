@@ -0,0 +1,121 @@
+package pdnsp
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/brankas/autocertdns/propagation"
+)
+
+// Option is the Client option type.
+type Option func(c *Client) error
+
+// BaseURL is a Client option to set the PowerDNS API base URL (for example,
+// http://localhost:8081).
+func BaseURL(baseURL string) Option {
+	return func(c *Client) error {
+		c.baseURL = baseURL
+		return nil
+	}
+}
+
+// ServerID is a Client option to set the PowerDNS server ID.
+//
+// If not set, DefaultServerID is used.
+func ServerID(serverID string) Option {
+	return func(c *Client) error {
+		c.serverID = serverID
+		return nil
+	}
+}
+
+// APIKey is a Client option to set the API key.
+func APIKey(apiKey string) Option {
+	return func(c *Client) error {
+		c.apiKey = apiKey
+		return nil
+	}
+}
+
+// Zone is a Client option to set the zone.
+//
+// If not set, the zone is the server's zone for the apex of the provisioned
+// name, as found from its SOA records.
+func Zone(zone string) Option {
+	return func(c *Client) error {
+		c.zone = zone
+		return nil
+	}
+}
+
+// TTL is a Client option to set the TTL of provisioned records.
+func TTL(ttl int) Option {
+	return func(c *Client) error {
+		c.ttl = ttl
+		return nil
+	}
+}
+
+// Notify is a Client option to send a NOTIFY to the zone's secondaries after
+// each change.
+func Notify() Option {
+	return func(c *Client) error {
+		c.notify = true
+		return nil
+	}
+}
+
+// Rectify is a Client option to rectify the zone after each change, as
+// needed for DNSSEC signed zones not using API-RECTIFY.
+func Rectify() Option {
+	return func(c *Client) error {
+		c.rectify = true
+		return nil
+	}
+}
+
+// HTTPClient is a Client option that sets the http.Client used.
+func HTTPClient(client *http.Client) Option {
+	return func(c *Client) error {
+		c.client = client
+		return nil
+	}
+}
+
+// Checker is a Client option to set the propagation checker used to wait for
+// provisioned records to propagate. The checker is also used to look up zone
+// apexes.
+func Checker(checker *propagation.Checker) Option {
+	return func(c *Client) error {
+		c.checker = checker
+		return nil
+	}
+}
+
+// PropagationWait is a Client option to wait up to d for provisioned records
+// to propagate to the zone's nameservers.
+//
+// If not set, records are waited on for DefaultPropagationWait. A zero or
+// negative d disables waiting for propagation.
+func PropagationWait(d time.Duration) Option {
+	return func(c *Client) error {
+		c.propagationWait = d
+		return nil
+	}
+}
+
+// Logf is a Client option to specify the logging function used.
+func Logf(f func(string, ...interface{})) Option {
+	return func(c *Client) error {
+		c.logf = f
+		return nil
+	}
+}
+
+// Errorf is a Client option to specify the error logging function used.
+func Errorf(f func(string, ...interface{})) Option {
+	return func(c *Client) error {
+		c.errf = f
+		return nil
+	}
+}
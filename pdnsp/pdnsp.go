@@ -0,0 +1,482 @@
+// Package pdnsp provides a PowerDNS Authoritative HTTP API client that
+// satisfies autocertdns.Provisioner and autocertdns.ProvisionerV2.
+package pdnsp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brankas/autocertdns/propagation"
+	"github.com/brankas/autocertdns/provision"
+)
+
+const (
+	// allowedRecordType is the allowed record provisioning type.
+	allowedRecordType = "TXT"
+
+	// DefaultServerID is the default PowerDNS server ID.
+	DefaultServerID = "localhost"
+
+	// DefaultTTL is the default TTL of provisioned records.
+	DefaultTTL = 60
+
+	// DefaultPropagationWait is the default propagation waiting time.
+	DefaultPropagationWait = 60 * time.Second
+)
+
+// Client is a PowerDNS Authoritative HTTP API client.
+type Client struct {
+	client          *http.Client
+	baseURL         string
+	serverID        string
+	apiKey          string
+	zone            string
+	ttl             int
+	notify          bool
+	rectify         bool
+	checker         *propagation.Checker
+	propagationWait time.Duration
+	logf            func(string, ...interface{})
+	errf            func(string, ...interface{})
+
+	// resolver is the checker used to look up the zone apex when no zone was
+	// specified.
+	resolver *propagation.Checker
+
+	// zones are the server's zones, loaded on first use.
+	zones []*zone
+	mu    sync.Mutex
+}
+
+// zone is a PowerDNS zone.
+type zone struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// record is a handle to a provisioned record.
+type record struct {
+	zone  *zone
+	name  string
+	value string
+}
+
+// New creates a PowerDNS client that can handle DNS provisioning requests for
+// use with the autocertdns.Manager.
+func New(opts ...Option) (*Client, error) {
+	var err error
+
+	c := &Client{
+		client:          http.DefaultClient,
+		serverID:        DefaultServerID,
+		ttl:             DefaultTTL,
+		propagationWait: DefaultPropagationWait,
+		logf:            func(string, ...interface{}) {},
+	}
+
+	// apply opts
+	for _, o := range opts {
+		if err = o(c); err != nil {
+			return nil, err
+		}
+	}
+
+	// ensure errf is set
+	if c.errf == nil {
+		c.errf = func(s string, v ...interface{}) {
+			c.logf("ERROR: "+s, v...)
+		}
+	}
+
+	if c.baseURL == "" {
+		return nil, errors.New("pdnsp missing base url")
+	}
+	c.baseURL = strings.TrimSuffix(c.baseURL, "/")
+	if !strings.HasSuffix(c.baseURL, "/api/v1") {
+		c.baseURL += "/api/v1"
+	}
+	if c.zone != "" {
+		c.zone = fqdn(c.zone)
+	}
+
+	// create propagation checker
+	if c.checker == nil && c.propagationWait > 0 {
+		if c.checker, err = propagation.New(
+			propagation.Timeout(c.propagationWait),
+			propagation.Logf(c.logf),
+			propagation.Errorf(c.errf),
+		); err != nil {
+			return nil, err
+		}
+	}
+
+	// create resolver for zone apex lookups
+	c.resolver = c.checker
+	if c.resolver == nil && c.zone == "" {
+		if c.resolver, err = propagation.New(propagation.Logf(c.logf), propagation.Errorf(c.errf)); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// Provision creates a DNS record of typ, for the specified domain name and
+// with the value in token.
+func (c *Client) Provision(ctxt context.Context, typ, name, token string) error {
+	_, err := c.ProvisionRecords(ctxt, []provision.Challenge{{Type: typ, Name: name, Value: token}})
+	return err
+}
+
+// Unprovision deletes the DNS record of typ, for the specified domain name,
+// and for the record with the specified token as the value.
+func (c *Client) Unprovision(ctxt context.Context, typ, name, token string) error {
+	if typ != allowedRecordType {
+		return errors.New("only TXT records are supported")
+	}
+	z, err := c.zoneFor(ctxt, name)
+	if err != nil {
+		return err
+	}
+	return c.UnprovisionRecords(ctxt, []provision.Record{&record{zone: z, name: fqdn(name), value: token}})
+}
+
+// ProvisionRecords adds the values of the challenges to the TXT rrsets,
+// keeping any other values, with a single PATCH for each zone.
+//
+// When the Client has a propagation checker, it waits for the records to
+// propagate.
+func (c *Client) ProvisionRecords(ctxt context.Context, challenges []provision.Challenge) ([]provision.Record, error) {
+	// group by zone
+	var zones []*zone
+	additions := make(map[*zone][]*record)
+	for _, ch := range challenges {
+		if ch.Type != allowedRecordType {
+			return nil, errors.New("only TXT records are supported")
+		}
+		z, err := c.zoneFor(ctxt, ch.Name)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := additions[z]; !ok {
+			zones = append(zones, z)
+		}
+		additions[z] = append(additions[z], &record{zone: z, name: fqdn(ch.Name), value: ch.Value})
+	}
+
+	// patch zones
+	var records []provision.Record
+	for _, z := range zones {
+		for _, r := range additions[z] {
+			c.logf("provisioning (type: %s, name: %s, token: %s)", allowedRecordType, r.name, r.value)
+		}
+		patched, err := c.patch(ctxt, z, additions[z], nil)
+		if patched {
+			for _, r := range additions[z] {
+				records = append(records, r)
+			}
+		}
+		if err != nil {
+			c.errf("unable to provision records in %s: %v", z.Name, err)
+			return records, err
+		}
+	}
+
+	// wait for propagation
+	if c.checker != nil {
+		for _, ch := range challenges {
+			if err := c.checker.Wait(ctxt, ch.Name, ch.Value); err != nil {
+				return records, err
+			}
+		}
+	}
+
+	return records, nil
+}
+
+// UnprovisionRecords removes the values of the provisioned records from their
+// rrsets, with a single PATCH for each zone, deleting any rrsets left empty.
+func (c *Client) UnprovisionRecords(ctxt context.Context, records []provision.Record) error {
+	// group by zone
+	var err error
+	var zones []*zone
+	deletions := make(map[*zone][]*record)
+	for _, rec := range records {
+		r, ok := rec.(*record)
+		if !ok {
+			if err == nil {
+				err = provision.ErrUnknownRecord
+			}
+			continue
+		}
+		if _, ok := deletions[r.zone]; !ok {
+			zones = append(zones, r.zone)
+		}
+		deletions[r.zone] = append(deletions[r.zone], r)
+	}
+
+	// patch zones
+	for _, z := range zones {
+		for _, r := range deletions[z] {
+			c.logf("unprovisioning (type: %s, name: %s, token: %s)", allowedRecordType, r.name, r.value)
+		}
+		if _, e := c.patch(ctxt, z, nil, deletions[z]); e != nil {
+			c.errf("unable to unprovision records in %s: %v", z.Name, e)
+			if err == nil {
+				err = e
+			}
+		}
+	}
+	return err
+}
+
+// WaitsForPropagation satisfies the autocertdns.ProvisionerV2 interface.
+//
+// Returns true unless waiting for propagation was disabled with a zero or
+// negative PropagationWait.
+func (c *Client) WaitsForPropagation() bool {
+	return c.checker != nil
+}
+
+// rrset is a PowerDNS rrset.
+type rrset struct {
+	Name       string       `json:"name"`
+	Type       string       `json:"type"`
+	TTL        int          `json:"ttl,omitempty"`
+	ChangeType string       `json:"changetype,omitempty"`
+	Records    []pdnsRecord `json:"records"`
+}
+
+// pdnsRecord is a PowerDNS record.
+type pdnsRecord struct {
+	Content  string `json:"content"`
+	Disabled bool   `json:"disabled"`
+}
+
+// patch adds and removes values in the zone's TXT rrsets, merging with the
+// existing values, and triggers a NOTIFY or rectify when configured. Reports
+// whether the rrsets hold the requested values, as a failed rectify or NOTIFY
+// does not undo the PATCH.
+func (c *Client) patch(ctxt context.Context, z *zone, add, remove []*record) (bool, error) {
+	// collect names
+	var names []string
+	seen := make(map[string]bool)
+	for _, r := range append(add, remove...) {
+		if !seen[r.name] {
+			names, seen[r.name] = append(names, r.name), true
+		}
+	}
+
+	// build changes
+	var changes []rrset
+	for _, name := range names {
+		existing, err := c.rrset(ctxt, z, name)
+		if err != nil {
+			return false, err
+		}
+
+		// merge values
+		change := rrset{Name: name, Type: allowedRecordType, TTL: c.ttl, ChangeType: "REPLACE"}
+		if existing != nil {
+			if len(add) == 0 && existing.TTL != 0 {
+				change.TTL = existing.TTL
+			}
+			for _, rec := range existing.Records {
+				if !containsRecord(remove, name, rec.Content) {
+					change.Records = append(change.Records, rec)
+				}
+			}
+		}
+		for _, r := range add {
+			if r.name == name && !containsValue(change.Records, r.value) {
+				change.Records = append(change.Records, pdnsRecord{Content: quote(r.value)})
+			}
+		}
+		if len(change.Records) == 0 {
+			if existing == nil {
+				continue
+			}
+			change = rrset{Name: name, Type: allowedRecordType, ChangeType: "DELETE"}
+		}
+		changes = append(changes, change)
+	}
+	if len(changes) == 0 {
+		return true, nil
+	}
+
+	// patch
+	path := "/zones/" + url.PathEscape(z.ID)
+	if err := c.do(ctxt, "PATCH", path, struct {
+		RRSets []rrset `json:"rrsets"`
+	}{changes}, nil); err != nil {
+		return false, err
+	}
+
+	// rectify and notify
+	if c.rectify {
+		if err := c.do(ctxt, "PUT", path+"/rectify", nil, nil); err != nil {
+			c.errf("could not rectify %s: %v", z.Name, err)
+			return true, err
+		}
+	}
+	if c.notify {
+		if err := c.do(ctxt, "PUT", path+"/notify", nil, nil); err != nil {
+			c.errf("could not notify secondaries of %s: %v", z.Name, err)
+			return true, err
+		}
+	}
+
+	return true, nil
+}
+
+// rrset retrieves the TXT rrset for name in the zone, returning nil if the
+// rrset does not exist.
+func (c *Client) rrset(ctxt context.Context, z *zone, name string) (*rrset, error) {
+	var res struct {
+		RRSets []rrset `json:"rrsets"`
+	}
+	q := url.Values{"rrset_name": {name}, "rrset_type": {allowedRecordType}}
+	if err := c.do(ctxt, "GET", "/zones/"+url.PathEscape(z.ID)+"?"+q.Encode(), nil, &res); err != nil {
+		c.errf("could not retrieve records (type: %s, name: %s): %v", allowedRecordType, name, err)
+		return nil, err
+	}
+	for _, rrSet := range res.RRSets {
+		if strings.EqualFold(rrSet.Name, name) && rrSet.Type == allowedRecordType {
+			return &rrSet, nil
+		}
+	}
+	return nil, nil
+}
+
+// zoneFor returns the zone for name.
+//
+// When the Client was not created with a zone, the zone is the server's zone
+// for the zone apex of name, as determined by the SOA records of name and its
+// parent domains.
+func (c *Client) zoneFor(ctxt context.Context, name string) (*zone, error) {
+	name = strings.ToLower(fqdn(name))
+
+	// determine zone name
+	domain := strings.ToLower(c.zone)
+	switch {
+	case domain != "":
+		if name != domain && !strings.HasSuffix(name, "."+domain) {
+			return nil, errors.New("invalid zone")
+		}
+	default:
+		apex, err := c.resolver.Zone(ctxt, name)
+		if err != nil {
+			c.errf("could not determine zone for %s: %v", name, err)
+			return nil, err
+		}
+		domain = strings.ToLower(apex)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// load zones
+	if c.zones == nil {
+		if err := c.do(ctxt, "GET", "/zones", nil, &c.zones); err != nil {
+			c.errf("could not list zones: %v", err)
+			return nil, err
+		}
+	}
+
+	// find zone
+	for _, z := range c.zones {
+		if strings.ToLower(fqdn(z.Name)) == domain {
+			return z, nil
+		}
+	}
+	return nil, errors.New("no zone found for " + domain)
+}
+
+// do performs an API request, decoding the response into v.
+func (c *Client) do(ctxt context.Context, method, path string, body, v interface{}) error {
+	var r io.Reader
+	if body != nil {
+		buf, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(buf)
+	}
+
+	req, err := http.NewRequest(method, c.baseURL+"/servers/"+url.PathEscape(c.serverID)+path, r)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctxt)
+	req.Header.Set("X-API-Key", c.apiKey)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		buf, _ := ioutil.ReadAll(io.LimitReader(res.Body, 4096))
+		if json.Unmarshal(buf, &apiErr) == nil && apiErr.Error != "" {
+			return fmt.Errorf("%s (status %d)", apiErr.Error, res.StatusCode)
+		}
+		return fmt.Errorf("request failed with status %d", res.StatusCode)
+	}
+	if v != nil {
+		return json.NewDecoder(res.Body).Decode(v)
+	}
+	return nil
+}
+
+// containsRecord returns true if records contains a record for name with the
+// content v.
+func containsRecord(records []*record, name, v string) bool {
+	for _, r := range records {
+		if r.name == name && r.value == unquote(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// containsValue returns true if records contains the value v.
+func containsValue(records []pdnsRecord, v string) bool {
+	for _, r := range records {
+		if unquote(r.Content) == v {
+			return true
+		}
+	}
+	return false
+}
+
+// fqdn returns name with a trailing dot.
+func fqdn(name string) string {
+	return strings.TrimSuffix(name, ".") + "."
+}
+
+// quote quotes a TXT record value.
+func quote(s string) string {
+	return `"` + s + `"`
+}
+
+// unquote removes the quotes surrounding a TXT record value.
+func unquote(s string) string {
+	return strings.TrimFunc(s, func(r rune) bool { return r == '"' })
+}
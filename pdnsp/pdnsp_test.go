@@ -0,0 +1,271 @@
+package pdnsp
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/brankas/autocertdns/propagation"
+	"github.com/brankas/autocertdns/provision"
+)
+
+func TestProvision(t *testing.T) {
+	s := newStandIn(t)
+	s.rrsets["_acme-challenge.example.com."] = []string{`"existing"`}
+
+	checker, err := propagation.New(
+		propagation.Resolvers(s.ns),
+		propagation.Nameservers(s.ns),
+		propagation.Timeout(5*time.Second),
+		propagation.Interval(10*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	c, err := New(BaseURL(s.url), APIKey("key"), Notify(), Rectify(), Checker(checker))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	records, err := c.ProvisionRecords(context.Background(), []provision.Challenge{
+		{Name: "_acme-challenge.example.com", Type: "TXT", Value: "a"},
+		{Name: "_acme-challenge.www.example.com.", Type: "TXT", Value: "b"},
+		{Name: "_acme-challenge.sub.example.com.", Type: "TXT", Value: "c"},
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if v := s.values("_acme-challenge.example.com."); v != `"a" "existing"` {
+		t.Errorf("expected existing value to be preserved, got: %s", v)
+	}
+	if v := s.values("_acme-challenge.www.example.com."); v != `"b"` {
+		t.Errorf("expected b, got: %s", v)
+	}
+	if v := s.subValues["_acme-challenge.sub.example.com."]; len(v) != 1 {
+		t.Errorf("expected record in sub.example.com zone, got: %v", v)
+	}
+	if s.patches != 2 || s.notifies != 2 || s.rectifies != 2 {
+		t.Errorf("expected 2 patches, notifies and rectifies, got: %d, %d, %d", s.patches, s.notifies, s.rectifies)
+	}
+
+	if err = c.UnprovisionRecords(context.Background(), records); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if v := s.values("_acme-challenge.example.com."); v != `"existing"` {
+		t.Errorf("expected existing, got: %s", v)
+	}
+	if _, ok := s.rrsets["_acme-challenge.www.example.com."]; ok {
+		t.Errorf("expected rrset to be deleted")
+	}
+
+	// failed notify after the records were patched
+	s.failNotify = true
+	records, err = c.ProvisionRecords(context.Background(), []provision.Challenge{
+		{Name: "_acme-challenge.example.com", Type: "TXT", Value: "e"},
+	})
+	if err == nil || !strings.Contains(err.Error(), "Notify failed") {
+		t.Errorf("expected notify error, got: %v", err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("expected patched record to be returned, got: %v", records)
+	}
+	s.failNotify = false
+	if err = c.UnprovisionRecords(context.Background(), records); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if v := s.values("_acme-challenge.example.com."); v != `"existing"` {
+		t.Errorf("expected existing, got: %s", v)
+	}
+
+	// name outside of any zone
+	if err = c.Provision(context.Background(), "TXT", "_acme-challenge.example.org", "d"); err == nil {
+		t.Errorf("expected error for unknown zone")
+	}
+
+	// bad key
+	if c, err = New(BaseURL(s.url), APIKey("bad"), Zone("example.com")); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err = c.Provision(context.Background(), "TXT", "_acme-challenge.example.com", "d"); err == nil || !strings.Contains(err.Error(), "Unauthorized") {
+		t.Errorf("expected unauthorized error, got: %v", err)
+	}
+}
+
+func TestWaitsForPropagation(t *testing.T) {
+	tests := []struct {
+		opts []Option
+		exp  bool
+	}{
+		{nil, true},
+		{[]Option{PropagationWait(0)}, false},
+		{[]Option{PropagationWait(-1), Zone("example.com")}, false},
+	}
+	for i, test := range tests {
+		c, err := New(append([]Option{BaseURL("http://127.0.0.1:8081"), APIKey("key")}, test.opts...)...)
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		if waits := c.WaitsForPropagation(); waits != test.exp {
+			t.Errorf("test %d expected %t, got: %t", i, test.exp, waits)
+		}
+		if c.zone == "" && c.resolver == nil {
+			t.Errorf("test %d expected resolver to be created", i)
+		}
+	}
+}
+
+// standIn is a local stand-in for the PowerDNS API, serving the zones
+// example.com and sub.example.com.
+type standIn struct {
+	url       string
+	ns        string
+	rrsets    map[string][]string
+	subValues map[string][]string
+	patches   int
+	notifies  int
+	rectifies int
+
+	failNotify bool
+	sync.Mutex
+}
+
+// newStandIn starts a PowerDNS API stand-in, and a nameserver serving its
+// records.
+func newStandIn(t *testing.T) *standIn {
+	s := &standIn{rrsets: make(map[string][]string), subValues: make(map[string][]string)}
+
+	// start nameserver
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(s.serveDNS)}
+	started := make(chan struct{})
+	srv.NotifyStartedFunc = func() { close(started) }
+	go srv.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { srv.Shutdown() })
+	s.ns = pc.LocalAddr().String()
+
+	// start api
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+	s.url = ts.URL
+	return s
+}
+
+func (s *standIn) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	if req.Header.Get("X-API-Key") != "key" {
+		res.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(res).Encode(map[string]string{"error": "Unauthorized"})
+		return
+	}
+
+	path := strings.TrimPrefix(req.URL.Path, "/api/v1/servers/localhost")
+	sets := s.rrsets
+	if strings.HasPrefix(path, "/zones/sub.example.com.") {
+		sets, path = s.subValues, strings.Replace(path, "sub.example.com.", "example.com.", 1)
+	}
+	switch {
+	case req.Method == "GET" && path == "/zones":
+		json.NewEncoder(res).Encode([]zone{
+			{ID: "example.com.", Name: "example.com."},
+			{ID: "sub.example.com.", Name: "sub.example.com."},
+		})
+	case req.Method == "GET" && path == "/zones/example.com.":
+		var v struct {
+			RRSets []rrset `json:"rrsets"`
+		}
+		for name, values := range sets {
+			r := rrset{Name: name, Type: "TXT", TTL: 60}
+			for _, value := range values {
+				r.Records = append(r.Records, pdnsRecord{Content: value})
+			}
+			v.RRSets = append(v.RRSets, r)
+		}
+		json.NewEncoder(res).Encode(v)
+	case req.Method == "PATCH" && path == "/zones/example.com.":
+		var v struct {
+			RRSets []rrset `json:"rrsets"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&v); err != nil {
+			res.WriteHeader(http.StatusUnprocessableEntity)
+			json.NewEncoder(res).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		for _, r := range v.RRSets {
+			switch r.ChangeType {
+			case "REPLACE":
+				var values []string
+				for _, rec := range r.Records {
+					values = append(values, rec.Content)
+				}
+				sets[r.Name] = values
+			case "DELETE":
+				delete(sets, r.Name)
+			}
+		}
+		s.patches++
+		res.WriteHeader(http.StatusNoContent)
+	case req.Method == "PUT" && path == "/zones/example.com./notify" && s.failNotify:
+		res.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(res).Encode(map[string]string{"error": "Notify failed"})
+	case req.Method == "PUT" && path == "/zones/example.com./notify":
+		s.notifies++
+		json.NewEncoder(res).Encode(map[string]string{"result": "Notification queued"})
+	case req.Method == "PUT" && path == "/zones/example.com./rectify":
+		s.rectifies++
+		json.NewEncoder(res).Encode(map[string]string{"result": "Rectified"})
+	default:
+		res.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(res).Encode(map[string]string{"error": "Not Found"})
+	}
+}
+
+func (s *standIn) serveDNS(w dns.ResponseWriter, req *dns.Msg) {
+	s.Lock()
+	defer s.Unlock()
+
+	res := new(dns.Msg)
+	res.SetReply(req)
+	res.Authoritative = true
+	q := req.Question[0]
+	name := strings.ToLower(q.Name)
+	switch q.Qtype {
+	case dns.TypeSOA:
+		if name == "example.com." || name == "sub.example.com." {
+			res.Answer = append(res.Answer, &dns.SOA{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 60},
+				Ns:  "ns.example.com.", Mbox: "hostmaster.example.com.", Serial: 1,
+			})
+		}
+	case dns.TypeTXT:
+		for _, v := range append(s.rrsets[name], s.subValues[name]...) {
+			res.Answer = append(res.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+				Txt: []string{strings.Trim(v, `"`)},
+			})
+		}
+	}
+	w.WriteMsg(res)
+}
+
+func (s *standIn) values(name string) string {
+	s.Lock()
+	defer s.Unlock()
+	v := append([]string(nil), s.rrsets[name]...)
+	sort.Strings(v)
+	return strings.Join(v, " ")
+}
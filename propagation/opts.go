@@ -0,0 +1,80 @@
+package propagation
+
+import (
+	"time"
+)
+
+// Option is the Checker option type.
+type Option func(*Checker) error
+
+// Resolvers is a Checker option to set the recursive resolvers (host:port)
+// used to look up the authoritative nameservers of a zone.
+//
+// If not set, the nameservers in /etc/resolv.conf are used, falling back to
+// public resolvers.
+func Resolvers(resolvers ...string) Option {
+	return func(c *Checker) error {
+		c.resolvers = make([]string, len(resolvers))
+		for i, r := range resolvers {
+			c.resolvers[i] = addPort(r)
+		}
+		return nil
+	}
+}
+
+// Nameservers is a Checker option to set the nameservers to check, instead of
+// looking up the authoritative nameservers of the zone.
+func Nameservers(nameservers ...string) Option {
+	return func(c *Checker) error {
+		c.nameservers = make([]string, len(nameservers))
+		for i, n := range nameservers {
+			c.nameservers[i] = addPort(n)
+		}
+		return nil
+	}
+}
+
+// Timeout is a Checker option to set how long to wait for a record to
+// propagate.
+func Timeout(d time.Duration) Option {
+	return func(c *Checker) error {
+		c.timeout = d
+		return nil
+	}
+}
+
+// Interval is a Checker option to set the delay between checks of each
+// nameserver.
+func Interval(d time.Duration) Option {
+	return func(c *Checker) error {
+		c.interval = d
+		return nil
+	}
+}
+
+// Quorum is a Checker option to set the number of nameservers that must
+// return a record before it is considered propagated.
+//
+// If zero (the default), a record must be visible on all nameservers.
+func Quorum(n int) Option {
+	return func(c *Checker) error {
+		c.quorum = n
+		return nil
+	}
+}
+
+// Logf is a Checker option to specify the logging function used.
+func Logf(f func(string, ...interface{})) Option {
+	return func(c *Checker) error {
+		c.logf = f
+		return nil
+	}
+}
+
+// Errorf is a Checker option to specify the error logging function used.
+func Errorf(f func(string, ...interface{})) Option {
+	return func(c *Checker) error {
+		c.errf = f
+		return nil
+	}
+}
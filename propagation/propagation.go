@@ -0,0 +1,307 @@
+// Package propagation provides a DNS propagation checker, that waits for
+// records to be visible on the authoritative nameservers of a zone.
+//
+// A Checker can be used by an autocertdns.Manager or by any
+// autocertdns.Provisioner.
+package propagation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// DefaultTimeout is the default propagation timeout.
+	DefaultTimeout = 60 * time.Second
+
+	// DefaultInterval is the default delay between checks.
+	DefaultInterval = 2 * time.Second
+)
+
+// maxCNAMEs is the maximum length of a followed CNAME chain.
+const maxCNAMEs = 10
+
+// DefaultResolvers are the resolvers used when no resolvers were specified,
+// and none could be read from /etc/resolv.conf.
+var DefaultResolvers = []string{"8.8.8.8:53", "1.1.1.1:53"}
+
+// Checker checks DNS record propagation.
+type Checker struct {
+	resolvers   []string
+	nameservers []string
+	timeout     time.Duration
+	interval    time.Duration
+	quorum      int
+	client      *dns.Client
+	logf        func(string, ...interface{})
+	errf        func(string, ...interface{})
+}
+
+// New creates a new DNS propagation Checker.
+func New(opts ...Option) (*Checker, error) {
+	var err error
+
+	c := &Checker{
+		timeout:  DefaultTimeout,
+		interval: DefaultInterval,
+		client:   new(dns.Client),
+		logf:     func(string, ...interface{}) {},
+	}
+
+	// apply opts
+	for _, o := range opts {
+		if err = o(c); err != nil {
+			return nil, err
+		}
+	}
+
+	// ensure errf is set
+	if c.errf == nil {
+		c.errf = func(s string, v ...interface{}) {
+			c.logf("ERROR: "+s, v...)
+		}
+	}
+
+	// load resolvers from system configuration
+	if len(c.resolvers) == 0 {
+		c.resolvers = systemResolvers()
+	}
+
+	if c.quorum < 0 {
+		return nil, errors.New("propagation quorum cannot be negative")
+	}
+
+	return c, nil
+}
+
+// Wait waits until a TXT record for name containing value is visible on the
+// nameservers, or until the timeout has passed.
+//
+// When no nameservers were specified for the Checker, the authoritative
+// nameservers for name are looked up.
+func (c *Checker) Wait(ctxt context.Context, name, value string) error {
+	return c.wait(ctxt, name, value, true)
+}
+
+// WaitRemoved waits until the TXT record for name no longer contains value on
+// the nameservers, or until the timeout has passed.
+//
+// When no nameservers were specified for the Checker, the authoritative
+// nameservers for name are looked up.
+func (c *Checker) WaitRemoved(ctxt context.Context, name, value string) error {
+	return c.wait(ctxt, name, value, false)
+}
+
+// wait waits until the presence of value in the TXT record for name matches
+// present on a quorum of the nameservers.
+func (c *Checker) wait(ctxt context.Context, name, value string, present bool) error {
+	var cancel func()
+	ctxt, cancel = context.WithTimeout(ctxt, c.timeout)
+	defer cancel()
+
+	name = dns.Fqdn(name)
+
+	nameservers := c.nameservers
+	if len(nameservers) == 0 {
+		var err error
+		if nameservers, err = c.Nameservers(ctxt, name); err != nil {
+			return err
+		}
+	}
+
+	quorum := c.quorum
+	if quorum == 0 || quorum > len(nameservers) {
+		quorum = len(nameservers)
+	}
+
+	// check each nameserver
+	found := make(chan bool, len(nameservers))
+	for _, nn := range nameservers {
+		ns := nn
+		go func() {
+			found <- c.poll(ctxt, ns, name, value, present)
+		}()
+	}
+
+	var n int
+	for range nameservers {
+		if <-found {
+			if n++; n >= quorum {
+				return nil
+			}
+		}
+	}
+
+	if !present {
+		return fmt.Errorf("%s removed from %d of %d nameservers (quorum: %d): %v", name, n, len(nameservers), quorum, ctxt.Err())
+	}
+	return fmt.Errorf("%s propagated to %d of %d nameservers (quorum: %d): %v", name, n, len(nameservers), quorum, ctxt.Err())
+}
+
+// poll polls the nameserver ns until the presence of value in the TXT record
+// for name matches present, returning false if the context is closed first.
+func (c *Checker) poll(ctxt context.Context, ns, name, value string, present bool) bool {
+	q := new(dns.Msg)
+	q.SetQuestion(name, dns.TypeTXT)
+	for {
+		res, _, err := c.client.Exchange(q, ns)
+		if err == nil && hasTXT(res, name, value) == present {
+			if present {
+				c.logf("%s has propagated to %s", name, ns)
+			} else {
+				c.logf("%s has been removed from %s", name, ns)
+			}
+			return true
+		}
+
+		select {
+		case <-ctxt.Done():
+			return false
+		case <-time.After(c.interval):
+		}
+	}
+}
+
+// Nameservers returns the authoritative nameservers (as host:port) for the
+// zone containing name.
+func (c *Checker) Nameservers(ctxt context.Context, name string) ([]string, error) {
+	zone, err := c.Zone(ctxt, name)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := c.exchange(ctxt, zone, dns.TypeNS)
+	if err != nil {
+		return nil, err
+	}
+
+	var nameservers []string
+	for _, rr := range res.Answer {
+		if ns, ok := rr.(*dns.NS); ok && strings.EqualFold(ns.Hdr.Name, zone) {
+			nameservers = append(nameservers, addPort(ns.Ns))
+		}
+	}
+	if len(nameservers) == 0 {
+		return nil, fmt.Errorf("could not find nameservers for zone %s", zone)
+	}
+	return nameservers, nil
+}
+
+// Zone returns the apex of the zone containing name (as a FQDN, with a
+// trailing .), found by looking up the SOA records of name and each of its
+// parent domains.
+func (c *Checker) Zone(ctxt context.Context, name string) (string, error) {
+	name = dns.Fqdn(name)
+	for _, i := range dns.Split(name) {
+		res, err := c.exchange(ctxt, name[i:], dns.TypeSOA)
+		if err != nil {
+			return "", err
+		}
+		for _, rr := range res.Answer {
+			if soa, ok := rr.(*dns.SOA); ok && strings.EqualFold(soa.Hdr.Name, name[i:]) {
+				return dns.Fqdn(strings.ToLower(name[i:])), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("could not find zone for %s", name)
+}
+
+// Target returns the target of the CNAME chain starting at name (as a FQDN,
+// with a trailing .), or name itself when name is not a CNAME.
+func (c *Checker) Target(ctxt context.Context, name string) (string, error) {
+	name = dns.Fqdn(name)
+	for i := 0; i < maxCNAMEs; i++ {
+		res, err := c.exchange(ctxt, name, dns.TypeCNAME)
+		if err != nil {
+			return "", err
+		}
+
+		var target string
+		for _, rr := range res.Answer {
+			if cname, ok := rr.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, name) {
+				target = cname.Target
+			}
+		}
+		if target == "" {
+			return name, nil
+		}
+		c.logf("%s is a CNAME for %s", name, target)
+		name = dns.Fqdn(target)
+	}
+	return "", fmt.Errorf("too many CNAMEs for %s", name)
+}
+
+// exchange sends a query for name and typ to the resolvers, returning the
+// first successful response.
+func (c *Checker) exchange(ctxt context.Context, name string, typ uint16) (*dns.Msg, error) {
+	q := new(dns.Msg)
+	q.SetQuestion(name, typ)
+
+	var err error
+	for _, r := range c.resolvers {
+		if err = ctxt.Err(); err != nil {
+			break
+		}
+		var res *dns.Msg
+		res, _, err = c.client.Exchange(q, r)
+		switch {
+		case err != nil:
+			continue
+		case res.Rcode != dns.RcodeSuccess && res.Rcode != dns.RcodeNameError:
+			err = fmt.Errorf("%s returned %s for %s", r, dns.RcodeToString[res.Rcode], name)
+			continue
+		}
+		return res, nil
+	}
+
+	if err == nil {
+		err = errors.New("no resolvers")
+	}
+	c.errf("could not query %s (type: %s): %v", name, dns.TypeToString[typ], err)
+	return nil, err
+}
+
+// hasTXT returns true if the answer section of res contains a TXT record for
+// name containing value.
+func hasTXT(res *dns.Msg, name, value string) bool {
+	for _, rr := range res.Answer {
+		txt, ok := rr.(*dns.TXT)
+		if !ok || !strings.EqualFold(txt.Hdr.Name, name) {
+			continue
+		}
+		for _, s := range txt.Txt {
+			if s == value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// systemResolvers returns the resolvers configured in /etc/resolv.conf, or
+// DefaultResolvers.
+func systemResolvers() []string {
+	conf, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+	if err != nil || len(conf.Servers) == 0 {
+		return DefaultResolvers
+	}
+	resolvers := make([]string, len(conf.Servers))
+	for i, s := range conf.Servers {
+		resolvers[i] = net.JoinHostPort(s, conf.Port)
+	}
+	return resolvers
+}
+
+// addPort adds the default DNS port to addr, if addr does not have a port.
+func addPort(addr string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(strings.TrimSuffix(addr, "."), "53")
+}
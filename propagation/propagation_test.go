@@ -0,0 +1,200 @@
+package propagation
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestWait(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	txt := map[string][]string{}
+	addr := startServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		mu.Lock()
+		defer mu.Unlock()
+		res := new(dns.Msg)
+		res.SetReply(req)
+		q := req.Question[0]
+		for _, v := range txt[q.Name] {
+			res.Answer = append(res.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 1},
+				Txt: []string{v},
+			})
+		}
+		w.WriteMsg(res)
+	})
+
+	c, err := New(
+		Nameservers(addr),
+		Timeout(2*time.Second),
+		Interval(10*time.Millisecond),
+		Logf(t.Logf),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	const name = "_acme-challenge.example.com."
+
+	// not propagated
+	if err := c.Wait(context.Background(), name, "token"); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+
+	// propagates after a delay
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		mu.Lock()
+		defer mu.Unlock()
+		txt[name] = []string{"other", "token"}
+	}()
+	if err := c.Wait(context.Background(), name, "token"); err != nil {
+		t.Errorf("expected no error, got: %v", err)
+	}
+
+	// removed after a delay
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		mu.Lock()
+		defer mu.Unlock()
+		txt[name] = []string{"other"}
+	}()
+	if err := c.WaitRemoved(context.Background(), name, "token"); err != nil {
+		t.Errorf("expected no error, got: %v", err)
+	}
+}
+
+func TestNameservers(t *testing.T) {
+	t.Parallel()
+
+	addr := startServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		res := new(dns.Msg)
+		res.SetReply(req)
+		q := req.Question[0]
+		switch {
+		case q.Qtype == dns.TypeSOA && q.Name == "example.com.":
+			res.Answer = append(res.Answer, testSOA(q.Name))
+		case q.Qtype == dns.TypeNS && q.Name == "example.com.":
+			for _, ns := range []string{"ns1.example.net.", "ns2.example.net."} {
+				res.Answer = append(res.Answer, &dns.NS{
+					Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 300},
+					Ns:  ns,
+				})
+			}
+		case dns.IsSubDomain("example.com.", q.Name):
+			res.Ns = append(res.Ns, testSOA("example.com."))
+		default:
+			res.Rcode = dns.RcodeNameError
+		}
+		w.WriteMsg(res)
+	})
+
+	c, err := New(Resolvers(addr))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	nameservers, err := c.Nameservers(context.Background(), "_acme-challenge.www.example.com")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if exp := []string{"ns1.example.net:53", "ns2.example.net:53"}; !reflect.DeepEqual(nameservers, exp) {
+		t.Errorf("expected %v, got: %v", exp, nameservers)
+	}
+
+	if _, err := c.Nameservers(context.Background(), "example.org"); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+
+	zone, err := c.Zone(context.Background(), "_acme-challenge.www.example.com")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if zone != "example.com." {
+		t.Errorf("expected example.com., got: %s", zone)
+	}
+}
+
+func TestTarget(t *testing.T) {
+	t.Parallel()
+
+	addr := startServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		res := new(dns.Msg)
+		res.SetReply(req)
+		q := req.Question[0]
+		cnames := map[string]string{
+			"_acme-challenge.example.com.": "example.acme.example.net.",
+			"example.acme.example.net.":    "final.acme.example.net.",
+			"loop.example.com.":            "loop.example.com.",
+		}
+		if target, ok := cnames[q.Name]; ok {
+			res.Answer = append(res.Answer, &dns.CNAME{
+				Hdr:    dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 300},
+				Target: target,
+			})
+		}
+		w.WriteMsg(res)
+	})
+
+	c, err := New(Resolvers(addr))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	tests := []struct {
+		name, exp string
+	}{
+		{"_acme-challenge.example.com", "final.acme.example.net."},
+		{"_acme-challenge.example.org.", "_acme-challenge.example.org."},
+	}
+	for i, test := range tests {
+		target, err := c.Target(context.Background(), test.name)
+		if err != nil {
+			t.Fatalf("test %d expected no error, got: %v", i, err)
+		}
+		if target != test.exp {
+			t.Errorf("test %d expected %s, got: %s", i, test.exp, target)
+		}
+	}
+
+	if _, err := c.Target(context.Background(), "loop.example.com"); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+}
+
+// startServer starts an in-process DNS server on a random UDP port, returning
+// its address.
+func startServer(t *testing.T, f func(dns.ResponseWriter, *dns.Msg)) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	s := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(f)}
+	started := make(chan struct{})
+	s.NotifyStartedFunc = func() { close(started) }
+	go s.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { s.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+// testSOA returns a SOA record for zone.
+func testSOA(zone string) dns.RR {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 300},
+		Ns:      "ns1.example.net.",
+		Mbox:    "hostmaster." + zone,
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  60,
+	}
+}
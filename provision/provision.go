@@ -0,0 +1,47 @@
+// Package provision defines the types shared between the autocertdns.Manager
+// and DNS provisioners that implement the autocertdns.ProvisionerV2
+// interface.
+package provision
+
+// Challenge is a DNS-01 challenge record to be provisioned.
+type Challenge struct {
+	// Domain is the domain name being validated (ie, example.com or
+	// *.example.com).
+	Domain string
+
+	// Name is the FQDN of the record (ie, _acme-challenge.example.com, or the
+	// target of a CNAME for _acme-challenge.example.com).
+	Name string
+
+	// Type is the record type (always TXT).
+	Type string
+
+	// Value is the record value.
+	Value string
+
+	// Token is the ACME challenge token.
+	Token string
+
+	// KeyAuth is the ACME key authorization, from which Value is derived.
+	KeyAuth string
+}
+
+// Record is an opaque handle to a provisioned record, returned by a
+// provisioner when provisioning a Challenge, and passed back to the same
+// provisioner to unprovision the record.
+type Record interface{}
+
+// Error is a provisioning error.
+type Error string
+
+// Error satisfies the error interface.
+func (err Error) Error() string {
+	return string(err)
+}
+
+// Error values.
+const (
+	// ErrUnknownRecord is the unknown record error, returned when a
+	// provisioner is passed a record handle it did not create.
+	ErrUnknownRecord Error = "unknown record"
+)
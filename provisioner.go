@@ -0,0 +1,78 @@
+package autocertdns
+
+import (
+	"context"
+
+	"github.com/brankas/autocertdns/provision"
+)
+
+// ProvisionerV2 is the extended interface for providers that can provision
+// DNS records, that return handles to provisioned records and that provision
+// and unprovision challenges in batches.
+type ProvisionerV2 interface {
+	Provisioner
+
+	// ProvisionRecords provisions the challenges, returning a handle for each
+	// provisioned record. On error, the handles for any records that were
+	// provisioned are returned along with the error.
+	ProvisionRecords(ctxt context.Context, challenges []provision.Challenge) ([]provision.Record, error)
+
+	// UnprovisionRecords unprovisions previously provisioned records.
+	UnprovisionRecords(ctxt context.Context, records []provision.Record) error
+
+	// WaitsForPropagation returns true when ProvisionRecords waits for the
+	// provisioned records to propagate before returning.
+	WaitsForPropagation() bool
+}
+
+// AsProvisionerV2 returns p as a ProvisionerV2, adapting p when p does not
+// implement ProvisionerV2.
+//
+// An adapted Provisioner provisions and unprovisions each challenge in turn,
+// and does not wait for propagation.
+func AsProvisionerV2(p Provisioner) ProvisionerV2 {
+	if v2, ok := p.(ProvisionerV2); ok {
+		return v2
+	}
+	return provisionerV2{p}
+}
+
+// provisionerV2 adapts a Provisioner as a ProvisionerV2.
+type provisionerV2 struct {
+	Provisioner
+}
+
+// ProvisionRecords satisfies the ProvisionerV2 interface.
+func (p provisionerV2) ProvisionRecords(ctxt context.Context, challenges []provision.Challenge) ([]provision.Record, error) {
+	var records []provision.Record
+	for _, c := range challenges {
+		if err := p.Provision(ctxt, c.Type, c.Name, c.Value); err != nil {
+			return records, err
+		}
+		records = append(records, c)
+	}
+	return records, nil
+}
+
+// UnprovisionRecords satisfies the ProvisionerV2 interface.
+func (p provisionerV2) UnprovisionRecords(ctxt context.Context, records []provision.Record) error {
+	var err error
+	for _, r := range records {
+		c, ok := r.(provision.Challenge)
+		if !ok {
+			if err == nil {
+				err = ErrUnknownRecord
+			}
+			continue
+		}
+		if e := p.Unprovision(ctxt, c.Type, c.Name, c.Value); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// WaitsForPropagation satisfies the ProvisionerV2 interface.
+func (p provisionerV2) WaitsForPropagation() bool {
+	return false
+}
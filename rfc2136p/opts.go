@@ -0,0 +1,105 @@
+package rfc2136p
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/brankas/autocertdns/propagation"
+)
+
+// Option is the Client option type.
+type Option func(c *Client) error
+
+// Server is a Client option to set the address (host:port) of the primary
+// nameserver that updates are sent to. The port defaults to 53.
+func Server(server string) Option {
+	return func(c *Client) error {
+		c.server = server
+		return nil
+	}
+}
+
+// Zone is a Client option to set the zone updated.
+//
+// If not set, the zone is determined by querying the server for the zone apex
+// of the provisioned name.
+func Zone(zone string) Option {
+	return func(c *Client) error {
+		c.zone = zone
+		return nil
+	}
+}
+
+// TSIG is a Client option to set the TSIG key name, base64 encoded secret, and
+// algorithm used to sign updates. Supported algorithms are hmac-sha256 (used
+// when algorithm is empty) and hmac-sha512.
+func TSIG(name, secret, algorithm string) Option {
+	return func(c *Client) error {
+		switch strings.ToLower(dns.Fqdn(algorithm)) {
+		case ".", dns.HmacSHA256:
+			c.algorithm = dns.HmacSHA256
+		case dns.HmacSHA512:
+			c.algorithm = dns.HmacSHA512
+		default:
+			return errors.New("rfc2136p unsupported TSIG algorithm " + algorithm)
+		}
+		if _, err := base64.StdEncoding.DecodeString(secret); err != nil {
+			return errors.New("rfc2136p invalid TSIG secret")
+		}
+		c.keyName, c.secret = dns.Fqdn(strings.ToLower(name)), secret
+		return nil
+	}
+}
+
+// TTL is a Client option to set the TTL of provisioned records.
+func TTL(ttl uint32) Option {
+	return func(c *Client) error {
+		c.ttl = ttl
+		return nil
+	}
+}
+
+// TCP is a Client option to send updates over TCP instead of UDP.
+func TCP() Option {
+	return func(c *Client) error {
+		c.net = "tcp"
+		return nil
+	}
+}
+
+// Timeout is a Client option to set the timeout for update requests.
+func Timeout(d time.Duration) Option {
+	return func(c *Client) error {
+		c.timeout = d
+		return nil
+	}
+}
+
+// Checker is a Client option to set the propagation checker used to wait for
+// provisioned records to propagate to all of the zone's nameservers.
+func Checker(checker *propagation.Checker) Option {
+	return func(c *Client) error {
+		c.checker = checker
+		return nil
+	}
+}
+
+// Logf is a Client option to specify the logging function used.
+func Logf(f func(string, ...interface{})) Option {
+	return func(c *Client) error {
+		c.logf = f
+		return nil
+	}
+}
+
+// Errorf is a Client option to specify the error logging function used.
+func Errorf(f func(string, ...interface{})) Option {
+	return func(c *Client) error {
+		c.errf = f
+		return nil
+	}
+}
@@ -0,0 +1,279 @@
+// Package rfc2136p provides a RFC 2136 dynamic DNS update client that
+// satisfies autocertdns.Provisioner and autocertdns.ProvisionerV2.
+//
+// Records are added and removed with DNS UPDATE messages signed with TSIG,
+// and can be used with any nameserver supporting dynamic updates, such as
+// BIND or Knot.
+package rfc2136p
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/brankas/autocertdns/propagation"
+	"github.com/brankas/autocertdns/provision"
+)
+
+const (
+	// allowedRecordType is the allowed record provisioning type.
+	allowedRecordType = "TXT"
+
+	// DefaultTTL is the default TTL of provisioned records.
+	DefaultTTL = 60
+
+	// DefaultTimeout is the default timeout for update requests.
+	DefaultTimeout = 10 * time.Second
+
+	// fudge is the allowed TSIG time skew, in seconds.
+	fudge = 300
+)
+
+// record is a handle to a provisioned record.
+type record struct {
+	zone string
+	rr   *dns.TXT
+}
+
+// Client is a RFC 2136 dynamic DNS update client.
+type Client struct {
+	server    string
+	zone      string
+	keyName   string
+	secret    string
+	algorithm string
+	ttl       uint32
+	net       string
+	timeout   time.Duration
+	checker   *propagation.Checker
+	logf      func(string, ...interface{})
+	errf      func(string, ...interface{})
+}
+
+// New creates a new RFC 2136 dynamic DNS update client.
+func New(opts ...Option) (*Client, error) {
+	c := &Client{
+		ttl:     DefaultTTL,
+		net:     "udp",
+		timeout: DefaultTimeout,
+		logf:    func(string, ...interface{}) {},
+	}
+
+	// apply opts
+	for _, o := range opts {
+		if err := o(c); err != nil {
+			return nil, err
+		}
+	}
+
+	// ensure errf is set
+	if c.errf == nil {
+		c.errf = func(s string, v ...interface{}) {
+			c.logf("ERROR: "+s, v...)
+		}
+	}
+
+	if c.server == "" {
+		return nil, errors.New("rfc2136p missing server")
+	}
+	if _, _, err := net.SplitHostPort(c.server); err != nil {
+		c.server = net.JoinHostPort(c.server, "53")
+	}
+	if c.zone != "" {
+		c.zone = dns.Fqdn(strings.ToLower(c.zone))
+	}
+
+	return c, nil
+}
+
+// Provision creates a DNS record of typ, for the specified domain name and
+// with the value in token.
+func (c *Client) Provision(ctxt context.Context, typ, name, token string) error {
+	_, err := c.ProvisionRecords(ctxt, []provision.Challenge{{Type: typ, Name: name, Value: token}})
+	return err
+}
+
+// Unprovision deletes the DNS record of typ, for the specified domain name,
+// and for the record with the specified token as the value.
+func (c *Client) Unprovision(ctxt context.Context, typ, name, token string) error {
+	if typ != allowedRecordType {
+		return errors.New("only TXT records are supported")
+	}
+	zone, err := c.zoneFor(ctxt, name)
+	if err != nil {
+		return err
+	}
+	return c.UnprovisionRecords(ctxt, []provision.Record{&record{zone: zone, rr: c.txt(name, token)}})
+}
+
+// ProvisionRecords adds the DNS records for the challenges, sending a single
+// update for each zone. Other values at the same names are left untouched.
+//
+// When the Client has a propagation checker, it waits for the records to
+// propagate.
+func (c *Client) ProvisionRecords(ctxt context.Context, challenges []provision.Challenge) ([]provision.Record, error) {
+	// group by zone
+	var zones []string
+	rrs := make(map[string][]dns.RR)
+	for _, ch := range challenges {
+		if ch.Type != allowedRecordType {
+			return nil, errors.New("only TXT records are supported")
+		}
+		zone, err := c.zoneFor(ctxt, ch.Name)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := rrs[zone]; !ok {
+			zones = append(zones, zone)
+		}
+		rrs[zone] = append(rrs[zone], c.txt(ch.Name, ch.Value))
+	}
+
+	// send updates
+	var records []provision.Record
+	for _, zone := range zones {
+		for _, rr := range rrs[zone] {
+			c.logf("provisioning (type: %s, name: %s, token: %s)", allowedRecordType, rr.Header().Name, rr.(*dns.TXT).Txt[0])
+		}
+		m := new(dns.Msg)
+		m.SetUpdate(zone)
+		m.Insert(rrs[zone])
+		if err := c.update(ctxt, m); err != nil {
+			c.errf("unable to provision records in %s: %v", zone, err)
+			return records, err
+		}
+		for _, rr := range rrs[zone] {
+			records = append(records, &record{zone: zone, rr: rr.(*dns.TXT)})
+		}
+	}
+
+	// wait for propagation
+	if c.checker != nil {
+		for _, ch := range challenges {
+			if err := c.checker.Wait(ctxt, ch.Name, ch.Value); err != nil {
+				return records, err
+			}
+		}
+	}
+
+	return records, nil
+}
+
+// UnprovisionRecords removes the provisioned records, sending a single update
+// for each zone. Other values at the same names are left untouched.
+func (c *Client) UnprovisionRecords(ctxt context.Context, records []provision.Record) error {
+	// group by zone
+	var err error
+	var zones []string
+	rrs := make(map[string][]dns.RR)
+	for _, rec := range records {
+		r, ok := rec.(*record)
+		if !ok {
+			if err == nil {
+				err = provision.ErrUnknownRecord
+			}
+			continue
+		}
+		if _, ok := rrs[r.zone]; !ok {
+			zones = append(zones, r.zone)
+		}
+		rrs[r.zone] = append(rrs[r.zone], r.rr)
+	}
+
+	// send updates
+	for _, zone := range zones {
+		for _, rr := range rrs[zone] {
+			c.logf("unprovisioning (type: %s, name: %s, token: %s)", allowedRecordType, rr.Header().Name, rr.(*dns.TXT).Txt[0])
+		}
+		m := new(dns.Msg)
+		m.SetUpdate(zone)
+		m.Remove(rrs[zone])
+		if e := c.update(ctxt, m); e != nil {
+			c.errf("unable to unprovision records in %s: %v", zone, e)
+			if err == nil {
+				err = e
+			}
+		}
+	}
+	return err
+}
+
+// WaitsForPropagation satisfies the autocertdns.ProvisionerV2 interface.
+//
+// Returns true when the Client was created with a propagation checker.
+func (c *Client) WaitsForPropagation() bool {
+	return c.checker != nil
+}
+
+// txt builds a TXT record for name with value.
+func (c *Client) txt(name, value string) *dns.TXT {
+	return &dns.TXT{
+		Hdr: dns.RR_Header{
+			Name:   dns.Fqdn(strings.ToLower(name)),
+			Rrtype: dns.TypeTXT,
+			Class:  dns.ClassINET,
+			Ttl:    c.ttl,
+		},
+		Txt: []string{value},
+	}
+}
+
+// update signs and sends the update message to the server.
+func (c *Client) update(ctxt context.Context, m *dns.Msg) error {
+	timeout := c.timeout
+	if deadline, ok := ctxt.Deadline(); ok {
+		if d := time.Until(deadline); d < timeout {
+			timeout = d
+		}
+	}
+	client := &dns.Client{
+		Net:     c.net,
+		Timeout: timeout,
+	}
+	if c.keyName != "" {
+		client.TsigSecret = map[string]string{c.keyName: c.secret}
+		m.SetTsig(c.keyName, c.algorithm, fudge, time.Now().Unix())
+	}
+
+	res, _, err := client.Exchange(m, c.server)
+	if err != nil {
+		return err
+	}
+	if res.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("update failed: %s", dns.RcodeToString[res.Rcode])
+	}
+	return nil
+}
+
+// zoneFor returns the zone for name.
+//
+// When the Client was not created with a zone, the zone is determined by
+// querying the server for the zone apex of name.
+func (c *Client) zoneFor(ctxt context.Context, name string) (string, error) {
+	name = dns.Fqdn(strings.ToLower(name))
+
+	zone := c.zone
+	if zone == "" {
+		checker, err := propagation.New(
+			propagation.Resolvers(c.server),
+			propagation.Logf(c.logf),
+			propagation.Errorf(c.errf),
+		)
+		if err != nil {
+			return "", err
+		}
+		if zone, err = checker.Zone(ctxt, name); err != nil {
+			return "", err
+		}
+	}
+
+	if name != zone && !strings.HasSuffix(name, "."+zone) {
+		return "", errors.New("invalid domain")
+	}
+	return zone, nil
+}
@@ -0,0 +1,174 @@
+package rfc2136p
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/brankas/autocertdns/provision"
+)
+
+const (
+	testZone   = "example.com."
+	testKey    = "update-key."
+	testSecret = "c2VjcmV0LXNlY3JldC1zZWNyZXQtc2VjcmV0"
+)
+
+func TestProvision(t *testing.T) {
+	for _, alg := range []string{"", "hmac-sha256", "HMAC-SHA512."} {
+		t.Run(alg, func(t *testing.T) {
+			s, addr := startServer(t)
+			c, err := New(Server(addr), TSIG(testKey, testSecret, alg))
+			if err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+
+			// existing value is preserved
+			s.add("_acme-challenge.example.com.", "existing")
+
+			records, err := c.ProvisionRecords(context.Background(), []provision.Challenge{
+				{Name: "_acme-challenge.example.com", Type: "TXT", Value: "a"},
+				{Name: "_acme-challenge.www.example.com.", Type: "TXT", Value: "b"},
+			})
+			if err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+			if v := s.values("_acme-challenge.example.com."); v != "a existing" {
+				t.Errorf("expected a and existing, got: %q", v)
+			}
+			if v := s.values("_acme-challenge.www.example.com."); v != "b" {
+				t.Errorf("expected b, got: %q", v)
+			}
+
+			if err = c.UnprovisionRecords(context.Background(), records); err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+			if v := s.values("_acme-challenge.example.com."); v != "existing" {
+				t.Errorf("expected existing, got: %q", v)
+			}
+			if v := s.values("_acme-challenge.www.example.com."); v != "" {
+				t.Errorf("expected no values, got: %q", v)
+			}
+
+			// v1
+			if err = c.Provision(context.Background(), "TXT", "_acme-challenge.example.com", "c"); err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+			if err = c.Unprovision(context.Background(), "TXT", "_acme-challenge.example.com", "c"); err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+			if v := s.values("_acme-challenge.example.com."); v != "existing" {
+				t.Errorf("expected existing, got: %q", v)
+			}
+		})
+	}
+}
+
+func TestProvisionBadKey(t *testing.T) {
+	_, addr := startServer(t)
+	c, err := New(Server(addr), Zone("example.com"), TSIG(testKey, "YmFkLXNlY3JldA==", ""))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err = c.Provision(context.Background(), "TXT", "_acme-challenge.example.com", "a"); err == nil {
+		t.Errorf("expected error")
+	}
+	if err = c.Provision(context.Background(), "TXT", "_acme-challenge.example.org", "a"); err == nil {
+		t.Errorf("expected error for name outside zone")
+	}
+}
+
+// server is an in-memory nameserver accepting TSIG signed updates.
+type server struct {
+	records map[string][]string
+	sync.Mutex
+}
+
+// startServer starts a nameserver for testZone.
+func startServer(t *testing.T) (*server, string) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	srv := &server{records: make(map[string][]string)}
+	s := &dns.Server{
+		PacketConn: pc,
+		Handler:    dns.HandlerFunc(srv.serveDNS),
+		TsigSecret: map[string]string{testKey: testSecret},
+		MsgAcceptFunc: func(dns.Header) dns.MsgAcceptAction {
+			return dns.MsgAccept
+		},
+	}
+	started := make(chan struct{})
+	s.NotifyStartedFunc = func() { close(started) }
+	go s.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { s.Shutdown() })
+	return srv, pc.LocalAddr().String()
+}
+
+func (s *server) serveDNS(w dns.ResponseWriter, req *dns.Msg) {
+	res := new(dns.Msg)
+	res.SetReply(req)
+	q := req.Question[0]
+	switch {
+	case req.Opcode == dns.OpcodeUpdate:
+		if q.Name != testZone {
+			res.Rcode = dns.RcodeNotZone
+			break
+		}
+		if req.IsTsig() == nil || w.TsigStatus() != nil {
+			res.Rcode = dns.RcodeNotAuth
+			break
+		}
+		s.Lock()
+		for _, rr := range req.Ns {
+			txt := rr.(*dns.TXT)
+			switch txt.Hdr.Class {
+			case dns.ClassINET:
+				s.records[txt.Hdr.Name] = append(s.records[txt.Hdr.Name], txt.Txt[0])
+			case dns.ClassNONE:
+				var v []string
+				for _, value := range s.records[txt.Hdr.Name] {
+					if value != txt.Txt[0] {
+						v = append(v, value)
+					}
+				}
+				s.records[txt.Hdr.Name] = v
+			}
+		}
+		s.Unlock()
+		res.SetTsig(testKey, req.IsTsig().Algorithm, fudge, int64(req.IsTsig().TimeSigned))
+	case q.Qtype == dns.TypeSOA && strings.EqualFold(q.Name, testZone):
+		res.Authoritative = true
+		res.Answer = append(res.Answer, &dns.SOA{
+			Hdr:    dns.RR_Header{Name: testZone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 300},
+			Ns:     "ns1." + testZone,
+			Mbox:   "hostmaster." + testZone,
+			Serial: 1,
+			Minttl: 60,
+		})
+	default:
+		res.Rcode = dns.RcodeNameError
+	}
+	w.WriteMsg(res)
+}
+
+func (s *server) add(name, value string) {
+	s.Lock()
+	defer s.Unlock()
+	s.records[name] = append(s.records[name], value)
+}
+
+func (s *server) values(name string) string {
+	s.Lock()
+	defer s.Unlock()
+	v := append([]string(nil), s.records[name]...)
+	sort.Strings(v)
+	return strings.Join(v, " ")
+}
@@ -0,0 +1,167 @@
+package route53p
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/route53/route53iface"
+
+	"github.com/brankas/autocertdns/propagation"
+)
+
+// Option is the Client option type.
+type Option func(c *Client) error
+
+// HostedZoneID is a Client option to set the hosted zone ID.
+//
+// If not set, the hosted zone is determined from the Domain, or by looking up
+// the hosted zone for the zone apex of the provisioned name.
+func HostedZoneID(hostedZoneID string) Option {
+	return func(c *Client) error {
+		c.hostedZoneID = hostedZoneID
+		return nil
+	}
+}
+
+// Domain is a Client option to set the domain.
+//
+// If not set, the domain is the zone apex of the provisioned name, as
+// determined by its SOA records.
+func Domain(domain string) Option {
+	return func(c *Client) error {
+		c.domain = domain
+		return nil
+	}
+}
+
+// Route53 is a Client option to pass an already created Route 53 client.
+func Route53(client route53iface.Route53API) Option {
+	return func(c *Client) error {
+		c.route53 = client
+		return nil
+	}
+}
+
+// Session is a Client option to set the AWS session used to create the Route
+// 53 client.
+func Session(sess *session.Session) Option {
+	return func(c *Client) error {
+		c.session = sess
+		return nil
+	}
+}
+
+// Region is a Client option to set the AWS region.
+//
+// If not set, DefaultRegion is used.
+func Region(region string) Option {
+	return func(c *Client) error {
+		c.config.Region = aws.String(region)
+		return nil
+	}
+}
+
+// Endpoint is a Client option to set the Route 53 API endpoint URL, such as a
+// local stand-in for the API.
+func Endpoint(endpoint string) Option {
+	return func(c *Client) error {
+		c.config.Endpoint = aws.String(endpoint)
+		return nil
+	}
+}
+
+// StaticCredentials is a Client option to set static AWS credentials. The
+// session token is optional.
+func StaticCredentials(accessKeyID, secretAccessKey, sessionToken string) Option {
+	return func(c *Client) error {
+		c.config.Credentials = credentials.NewStaticCredentials(accessKeyID, secretAccessKey, sessionToken)
+		return nil
+	}
+}
+
+// Profile is a Client option to load credentials and configuration from the
+// profile in the shared AWS config and credentials files (~/.aws/config and
+// ~/.aws/credentials).
+func Profile(profile string) Option {
+	return func(c *Client) error {
+		c.profile = profile
+		return nil
+	}
+}
+
+// AssumeRole is a Client option to assume the IAM role, using the session's
+// credentials. The external ID is optional.
+func AssumeRole(roleARN, externalID string) Option {
+	return func(c *Client) error {
+		c.roleARN, c.externalID = roleARN, externalID
+		return nil
+	}
+}
+
+// TTL is a Client option to set the TTL of provisioned records.
+func TTL(ttl int64) Option {
+	return func(c *Client) error {
+		c.ttl = ttl
+		return nil
+	}
+}
+
+// PropagationWait is a Client option to set the propagation wait timeout.
+func PropagationWait(d time.Duration) Option {
+	return func(c *Client) error {
+		c.propagationWait = d
+		return nil
+	}
+}
+
+// CheckDelay is a Client option to set the delay between DNS name propagation
+// checks.
+func CheckDelay(d time.Duration) Option {
+	return func(c *Client) error {
+		c.checkDelay = d
+		return nil
+	}
+}
+
+// PollInterval is a Client option to set the delay between checks of a
+// change's status.
+func PollInterval(d time.Duration) Option {
+	return func(c *Client) error {
+		c.pollInterval = d
+		return nil
+	}
+}
+
+// Checker is a Client option to set the propagation checker used to wait for
+// provisioned records to propagate, instead of checking the hosted zone's
+// nameservers. The checker is also used to look up zone apexes.
+func Checker(checker *propagation.Checker) Option {
+	return func(c *Client) error {
+		c.checker = checker
+		return nil
+	}
+}
+
+// Logf is a Client option to specify the logging function used.
+func Logf(f func(string, ...interface{})) Option {
+	return func(c *Client) error {
+		c.logf = f
+		return nil
+	}
+}
+
+// Errorf is a Client option to specify the error logging function used.
+func Errorf(f func(string, ...interface{})) Option {
+	return func(c *Client) error {
+		c.errf = f
+		return nil
+	}
+}
+
+// IgnorePropagationErrors is a Client option to ignore propagation errors.
+func IgnorePropagationErrors(c *Client) error {
+	c.ignorePropagationErrors = true
+	return nil
+}
@@ -0,0 +1,536 @@
+// Package route53p provides an AWS Route 53 client that satisfies
+// autocertdns.Provisioner and autocertdns.ProvisionerV2.
+package route53p
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/aws/aws-sdk-go/service/route53/route53iface"
+
+	"github.com/brankas/autocertdns/propagation"
+	"github.com/brankas/autocertdns/provision"
+)
+
+const (
+	// allowedRecordType is the allowed record provisioning type.
+	allowedRecordType = "TXT"
+
+	// DefaultRegion is the default AWS region. Route 53 is a global service,
+	// and is available from the us-east-1 region.
+	DefaultRegion = "us-east-1"
+
+	// DefaultTTL is the default TTL of provisioned records.
+	DefaultTTL = 10
+
+	// DefaultPropagationWait is the default propagation waiting time.
+	DefaultPropagationWait = 60 * time.Second
+
+	// DefaultCheckDelay is the default check delay.
+	DefaultCheckDelay = 2 * time.Second
+
+	// DefaultPollInterval is the default delay between change status checks.
+	DefaultPollInterval = 2 * time.Second
+)
+
+// Client wraps an AWS Route 53 client.
+type Client struct {
+	route53                 route53iface.Route53API
+	session                 *session.Session
+	config                  *aws.Config
+	profile                 string
+	roleARN                 string
+	externalID              string
+	hostedZoneID            string
+	domain                  string
+	ttl                     int64
+	propagationWait         time.Duration
+	checkDelay              time.Duration
+	pollInterval            time.Duration
+	ignorePropagationErrors bool
+	checker                 *propagation.Checker
+	logf                    func(string, ...interface{})
+	errf                    func(string, ...interface{})
+
+	// resolver is the checker used to look up the zone apex when no hosted
+	// zone ID or domain was specified.
+	resolver *propagation.Checker
+
+	// zones are the resolved hosted zones, keyed by domain.
+	zones map[string]*zone
+	mu    sync.Mutex
+}
+
+// zone is a resolved hosted zone.
+type zone struct {
+	// id is the hosted zone ID.
+	id string
+
+	// domain is the hosted zone's DNS name (without the trailing .).
+	domain string
+
+	// nameservers are the hosted zone's nameservers, to check for
+	// propagation.
+	nameservers []string
+}
+
+// record is a handle to a provisioned record.
+type record struct {
+	zone  *zone
+	name  string
+	value string
+}
+
+// New creates a AWS Route 53 client that can handle DNS provisioning requests
+// for use with the autocertdns.Manager.
+//
+// When no Route 53 client or session is provided, a session is created using
+// the default AWS credential chain (environment, shared config and instance
+// roles).
+func New(opts ...Option) (*Client, error) {
+	var err error
+
+	c := &Client{
+		config:          aws.NewConfig(),
+		ttl:             DefaultTTL,
+		propagationWait: DefaultPropagationWait,
+		checkDelay:      DefaultCheckDelay,
+		pollInterval:    DefaultPollInterval,
+		logf:            func(string, ...interface{}) {},
+		zones:           make(map[string]*zone),
+	}
+
+	// apply opts
+	for _, o := range opts {
+		if err = o(c); err != nil {
+			return nil, err
+		}
+	}
+
+	// ensure errf is set
+	if c.errf == nil {
+		c.errf = func(s string, v ...interface{}) {
+			c.logf("ERROR: "+s, v...)
+		}
+	}
+
+	// create route53 client
+	if c.route53 == nil {
+		if c.config.Region == nil {
+			c.config.Region = aws.String(DefaultRegion)
+		}
+		if c.session == nil {
+			opts := session.Options{
+				Config:  *c.config,
+				Profile: c.profile,
+			}
+			if c.profile != "" {
+				opts.SharedConfigState = session.SharedConfigEnable
+			}
+			if c.session, err = session.NewSessionWithOptions(opts); err != nil {
+				return nil, err
+			}
+		}
+		config := c.config.Copy()
+		if c.roleARN != "" {
+			config.Credentials = stscreds.NewCredentials(c.session, c.roleARN, func(p *stscreds.AssumeRoleProvider) {
+				if c.externalID != "" {
+					p.ExternalID = aws.String(c.externalID)
+				}
+			})
+		}
+		c.route53 = route53.New(c.session, config)
+	}
+
+	// force end .
+	c.domain = strings.ToLower(strings.TrimSuffix(c.domain, "."))
+
+	// create resolver for zone apex lookups
+	c.resolver = c.checker
+	if c.resolver == nil && c.hostedZoneID == "" && c.domain == "" {
+		if c.resolver, err = propagation.New(propagation.Logf(c.logf), propagation.Errorf(c.errf)); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// Provision creates a DNS record of typ, for the specified domain name and
+// with the value in token.
+func (c *Client) Provision(ctxt context.Context, typ, name, token string) error {
+	_, err := c.ProvisionRecords(ctxt, []provision.Challenge{{Type: typ, Name: name, Value: token}})
+	return err
+}
+
+// Unprovision deletes the DNS record of typ, for the specified domain name,
+// and for the record with the specified token as the value.
+func (c *Client) Unprovision(ctxt context.Context, typ, name, token string) error {
+	if typ != allowedRecordType {
+		return errors.New("only TXT records are supported")
+	}
+
+	// determine hosted zone
+	z, err := c.zoneFor(ctxt, name)
+	if err != nil {
+		return err
+	}
+
+	return c.UnprovisionRecords(ctxt, []provision.Record{
+		&record{zone: z, name: fqdn(name), value: token},
+	})
+}
+
+// ProvisionRecords adds the values of the challenges to the TXT record sets,
+// preserving any existing values, waits for the changes to be in sync, and
+// waits for the records to propagate to the hosted zone's nameservers.
+//
+// The records for each hosted zone are created in a single change.
+func (c *Client) ProvisionRecords(ctxt context.Context, challenges []provision.Challenge) ([]provision.Record, error) {
+	// group by hosted zone
+	var zones []*zone
+	additions := make(map[*zone][]*record)
+	for _, ch := range challenges {
+		if ch.Type != allowedRecordType {
+			return nil, errors.New("only TXT records are supported")
+		}
+
+		// determine hosted zone
+		z, err := c.zoneFor(ctxt, ch.Name)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := additions[z]; !ok {
+			zones = append(zones, z)
+		}
+		additions[z] = append(additions[z], &record{zone: z, name: fqdn(ch.Name), value: ch.Value})
+	}
+
+	// create dns records
+	var records []provision.Record
+	for _, z := range zones {
+		for _, r := range additions[z] {
+			c.logf("provisioning (type: %s, name: %s, token: %s)", allowedRecordType, r.name, r.value)
+		}
+		changed, err := c.change(ctxt, z, additions[z], nil)
+		if changed {
+			for _, r := range additions[z] {
+				records = append(records, r)
+			}
+		}
+		if err != nil {
+			return records, err
+		}
+	}
+
+	// wait for propagation
+	for _, z := range zones {
+		checker, err := c.propagationChecker(z)
+		if err != nil {
+			return records, err
+		}
+		for _, r := range additions[z] {
+			if err = checker.Wait(ctxt, r.name, r.value); err != nil && !c.ignorePropagationErrors {
+				return records, err
+			} else if err != nil {
+				c.errf("ignored propagated error: %v", err)
+			}
+		}
+	}
+
+	return records, nil
+}
+
+// UnprovisionRecords removes the values of the provisioned records from their
+// record sets, deleting any record sets left empty.
+func (c *Client) UnprovisionRecords(ctxt context.Context, records []provision.Record) error {
+	// group by hosted zone
+	var zones []*zone
+	deletions := make(map[*zone][]*record)
+	for _, rec := range records {
+		r, ok := rec.(*record)
+		if !ok {
+			return provision.ErrUnknownRecord
+		}
+		if _, ok := deletions[r.zone]; !ok {
+			zones = append(zones, r.zone)
+		}
+		deletions[r.zone] = append(deletions[r.zone], r)
+	}
+
+	var err error
+	for _, z := range zones {
+		for _, r := range deletions[z] {
+			c.logf("unprovisioning (type: %s, name: %s, token: %s)", allowedRecordType, r.name, r.value)
+		}
+		if _, e := c.change(ctxt, z, nil, deletions[z]); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// WaitsForPropagation satisfies the autocertdns.ProvisionerV2 interface.
+func (c *Client) WaitsForPropagation() bool {
+	return true
+}
+
+// change adds and removes record values in the hosted zone as a single
+// change, merging with the values of the existing record sets, and waits for
+// the change to be in sync. Reports whether the record sets hold the requested
+// values, as the change is not undone when waiting for it fails.
+func (c *Client) change(ctxt context.Context, z *zone, add, remove []*record) (bool, error) {
+	// collect names
+	var names []string
+	seen := make(map[string]bool)
+	for _, r := range append(add, remove...) {
+		if !seen[r.name] {
+			names, seen[r.name] = append(names, r.name), true
+		}
+	}
+
+	// build change
+	batch := new(route53.ChangeBatch)
+	for _, name := range names {
+		existing, err := c.rrset(ctxt, z, name)
+		if err != nil {
+			return false, err
+		}
+
+		// merge values
+		var values []*route53.ResourceRecord
+		if existing != nil {
+			for _, rr := range existing.ResourceRecords {
+				if !containsRecord(remove, name, aws.StringValue(rr.Value)) {
+					values = append(values, rr)
+				}
+			}
+		}
+		for _, r := range add {
+			if r.name == name && !containsValue(values, r.value) {
+				values = append(values, &route53.ResourceRecord{Value: aws.String(quote(r.value))})
+			}
+		}
+
+		switch {
+		case len(values) != 0:
+			ttl := c.ttl
+			if existing != nil && len(add) == 0 {
+				ttl = aws.Int64Value(existing.TTL)
+			}
+			batch.Changes = append(batch.Changes, &route53.Change{
+				Action: aws.String(route53.ChangeActionUpsert),
+				ResourceRecordSet: &route53.ResourceRecordSet{
+					Name:            aws.String(name),
+					Type:            aws.String(allowedRecordType),
+					TTL:             aws.Int64(ttl),
+					ResourceRecords: values,
+				},
+			})
+		case existing != nil:
+			batch.Changes = append(batch.Changes, &route53.Change{
+				Action:            aws.String(route53.ChangeActionDelete),
+				ResourceRecordSet: existing,
+			})
+		}
+	}
+	if len(batch.Changes) == 0 {
+		return true, nil
+	}
+
+	// do change
+	res, err := c.route53.ChangeResourceRecordSetsWithContext(ctxt, &route53.ChangeResourceRecordSetsInput{
+		HostedZoneId: aws.String(z.id),
+		ChangeBatch:  batch,
+	})
+	if err != nil {
+		c.errf("unable to change records in %s: %v", z.id, err)
+		return false, err
+	}
+
+	// wait for change to be in sync
+	info := res.ChangeInfo
+	for aws.StringValue(info.Status) != route53.ChangeStatusInsync {
+		select {
+		case <-ctxt.Done():
+			return true, ctxt.Err()
+		case <-time.After(c.pollInterval):
+		}
+		change, err := c.route53.GetChangeWithContext(ctxt, &route53.GetChangeInput{Id: info.Id})
+		if err != nil {
+			return true, err
+		}
+		info = change.ChangeInfo
+	}
+
+	return true, nil
+}
+
+// rrset retrieves the TXT record set for name in the hosted zone, returning
+// nil if the record set does not exist.
+func (c *Client) rrset(ctxt context.Context, z *zone, name string) (*route53.ResourceRecordSet, error) {
+	res, err := c.route53.ListResourceRecordSetsWithContext(ctxt, &route53.ListResourceRecordSetsInput{
+		HostedZoneId:    aws.String(z.id),
+		StartRecordName: aws.String(name),
+		StartRecordType: aws.String(allowedRecordType),
+		MaxItems:        aws.String("1"),
+	})
+	if err != nil {
+		c.errf("could not retrieve records (type: %s, name: %s): %v", allowedRecordType, name, err)
+		return nil, err
+	}
+	for _, rrSet := range res.ResourceRecordSets {
+		if strings.EqualFold(aws.StringValue(rrSet.Name), name) && aws.StringValue(rrSet.Type) == allowedRecordType {
+			return rrSet, nil
+		}
+	}
+	return nil, nil
+}
+
+// zoneFor returns the hosted zone for name.
+//
+// When the Client was not created with a hosted zone ID or domain, the hosted
+// zone is the public hosted zone for the zone apex of name, as determined by
+// the SOA records of name and its parent domains. Resolved hosted zones are
+// cached, keyed by domain (or by the hosted zone ID, when set). Names outside
+// of the domain or the hosted zone are rejected.
+func (c *Client) zoneFor(ctxt context.Context, name string) (*zone, error) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+
+	// determine domain
+	key, domain := c.hostedZoneID, c.domain
+	if domain != "" && name != domain && !strings.HasSuffix(name, "."+domain) {
+		return nil, errors.New("invalid domain")
+	}
+	switch {
+	case key != "":
+	case domain != "":
+		key = domain
+	default:
+		apex, err := c.resolver.Zone(ctxt, name)
+		if err != nil {
+			c.errf("could not determine zone for %s: %v", name, err)
+			return nil, err
+		}
+		domain = strings.TrimSuffix(apex, ".")
+		key = domain
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	z, ok := c.zones[key]
+	if !ok {
+		var err error
+		if z, err = c.hostedZone(ctxt, domain); err != nil {
+			return nil, err
+		}
+		c.zones[key] = z
+	}
+	if name != z.domain && !strings.HasSuffix(name, "."+z.domain) {
+		return nil, errors.New("invalid domain")
+	}
+	return z, nil
+}
+
+// hostedZone retrieves the hosted zone, finding the public hosted zone for
+// domain when the Client was not created with a hosted zone ID.
+func (c *Client) hostedZone(ctxt context.Context, domain string) (*zone, error) {
+
+	// find hosted zone
+	id := c.hostedZoneID
+	if id == "" {
+		res, err := c.route53.ListHostedZonesByNameWithContext(ctxt, &route53.ListHostedZonesByNameInput{
+			DNSName: aws.String(domain + "."),
+		})
+		if err != nil {
+			c.errf("could not list hosted zones for %s: %v", domain, err)
+			return nil, err
+		}
+		for _, hz := range res.HostedZones {
+			if strings.EqualFold(aws.StringValue(hz.Name), domain+".") && (hz.Config == nil || !aws.BoolValue(hz.Config.PrivateZone)) {
+				id = aws.StringValue(hz.Id)
+				break
+			}
+		}
+		if id == "" {
+			return nil, errors.New("no hosted zone found for " + domain)
+		}
+	}
+
+	// retrieve nameservers
+	res, err := c.route53.GetHostedZoneWithContext(ctxt, &route53.GetHostedZoneInput{
+		Id: aws.String(id),
+	})
+	if err != nil {
+		c.errf("could not retrieve hosted zone %s: %v", id, err)
+		return nil, err
+	}
+	z := &zone{
+		id:     strings.TrimPrefix(aws.StringValue(res.HostedZone.Id), "/hostedzone/"),
+		domain: strings.ToLower(strings.TrimSuffix(aws.StringValue(res.HostedZone.Name), ".")),
+	}
+	if res.DelegationSet != nil {
+		for _, ns := range res.DelegationSet.NameServers {
+			z.nameservers = append(z.nameservers, aws.StringValue(ns))
+		}
+	}
+	return z, nil
+}
+
+// propagationChecker returns the propagation checker for the hosted zone.
+func (c *Client) propagationChecker(z *zone) (*propagation.Checker, error) {
+	if c.checker != nil {
+		return c.checker, nil
+	}
+	return propagation.New(
+		propagation.Nameservers(z.nameservers...),
+		propagation.Timeout(c.propagationWait),
+		propagation.Interval(c.checkDelay),
+		propagation.Logf(c.logf),
+		propagation.Errorf(c.errf),
+	)
+}
+
+// containsRecord returns true if records contains a record for name with the
+// value v.
+func containsRecord(records []*record, name, v string) bool {
+	for _, r := range records {
+		if r.name == name && r.value == unquote(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// containsValue returns true if rrs contains the value v.
+func containsValue(rrs []*route53.ResourceRecord, v string) bool {
+	for _, rr := range rrs {
+		if unquote(aws.StringValue(rr.Value)) == v {
+			return true
+		}
+	}
+	return false
+}
+
+// fqdn returns name with a trailing dot.
+func fqdn(name string) string {
+	return strings.TrimSuffix(name, ".") + "."
+}
+
+// quote quotes a TXT record value.
+func quote(s string) string {
+	return `"` + s + `"`
+}
+
+// unquote removes the quotes surrounding a TXT record value.
+func unquote(s string) string {
+	return strings.TrimFunc(s, func(r rune) bool { return r == '"' })
+}
@@ -0,0 +1,326 @@
+package route53p
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/brankas/autocertdns/propagation"
+	"github.com/brankas/autocertdns/provision"
+)
+
+func TestProvision(t *testing.T) {
+	s := newStandIn(t)
+	s.rrsets["_acme-challenge.example.com."] = []string{`"existing"`}
+
+	checker, err := propagation.New(
+		propagation.Resolvers(s.ns),
+		propagation.Nameservers(s.ns),
+		propagation.Timeout(5*time.Second),
+		propagation.Interval(10*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	c, err := New(
+		Endpoint(s.url),
+		StaticCredentials("id", "secret", ""),
+		PollInterval(time.Millisecond),
+		Checker(checker),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	records, err := c.ProvisionRecords(context.Background(), []provision.Challenge{
+		{Name: "_acme-challenge.example.com", Type: "TXT", Value: "a"},
+		{Name: "_acme-challenge.example.com.", Type: "TXT", Value: "b"},
+		{Name: "_acme-challenge.www.example.com", Type: "TXT", Value: "c"},
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if v := s.values("_acme-challenge.example.com."); v != `"a" "b" "existing"` {
+		t.Errorf("expected existing value to be preserved, got: %s", v)
+	}
+	if v := s.values("_acme-challenge.www.example.com."); v != `"c"` {
+		t.Errorf("expected c, got: %s", v)
+	}
+	if s.changes != 1 {
+		t.Errorf("expected 1 change, got: %d", s.changes)
+	}
+	if z := c.zones["example.com"]; z == nil || z.id != "Z1" || len(z.nameservers) != 1 || z.nameservers[0] != s.ns {
+		t.Errorf("expected public hosted zone Z1 for the zone apex, got: %+v", z)
+	}
+
+	if err = c.UnprovisionRecords(context.Background(), records); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if v := s.values("_acme-challenge.example.com."); v != `"existing"` {
+		t.Errorf("expected existing, got: %s", v)
+	}
+	if _, ok := s.rrsets["_acme-challenge.www.example.com."]; ok {
+		t.Errorf("expected record set to be deleted")
+	}
+
+	// failed status check after the change was submitted
+	s.failStatus = true
+	records, err = c.ProvisionRecords(context.Background(), []provision.Challenge{
+		{Name: "_acme-challenge.example.com", Type: "TXT", Value: "e"},
+	})
+	if err == nil {
+		t.Errorf("expected error, got nil")
+	}
+	if len(records) != 1 {
+		t.Fatalf("expected submitted record to be returned, got: %v", records)
+	}
+	s.failStatus = false
+	if err = c.UnprovisionRecords(context.Background(), records); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if v := s.values("_acme-challenge.example.com."); v != `"existing"` {
+		t.Errorf("expected existing, got: %s", v)
+	}
+
+	// name outside of any zone
+	if err = c.Provision(context.Background(), "TXT", "_acme-challenge.example.org", "d"); err == nil {
+		t.Errorf("expected error")
+	}
+
+	// name outside of the cached hosted zone
+	if c, err = New(
+		Endpoint(s.url),
+		StaticCredentials("id", "secret", ""),
+		HostedZoneID("Z1"),
+		Checker(checker),
+	); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if _, err = c.zoneFor(context.Background(), "_acme-challenge.example.com"); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err = c.Provision(context.Background(), "TXT", "_acme-challenge.example.org", "d"); err == nil || err.Error() != "invalid domain" {
+		t.Errorf("expected invalid domain error, got: %v", err)
+	}
+
+	// name outside of the domain
+	if c, err = New(
+		Endpoint(s.url),
+		StaticCredentials("id", "secret", ""),
+		HostedZoneID("Z1"),
+		Domain("example.org"),
+		Checker(checker),
+	); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err = c.Provision(context.Background(), "TXT", "_acme-challenge.example.com", "d"); err == nil || err.Error() != "invalid domain" {
+		t.Errorf("expected invalid domain error, got: %v", err)
+	}
+	if s.changes != 4 {
+		t.Errorf("expected 4 changes, got: %d", s.changes)
+	}
+}
+
+// standIn is a local stand-in for the Route 53 API, serving a single public
+// hosted zone for example.com, and a private hosted zone for
+// www.example.com.
+type standIn struct {
+	url     string
+	ns      string
+	rrsets  map[string][]string
+	changes int
+
+	failStatus bool
+	sync.Mutex
+}
+
+// newStandIn starts a Route 53 API stand-in, and a nameserver serving its
+// records.
+func newStandIn(t *testing.T) *standIn {
+	s := &standIn{rrsets: make(map[string][]string)}
+
+	// start nameserver
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(s.serveDNS)}
+	started := make(chan struct{})
+	srv.NotifyStartedFunc = func() { close(started) }
+	go srv.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { srv.Shutdown() })
+	s.ns = pc.LocalAddr().String()
+
+	// start api
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+	s.url = ts.URL
+
+	return s
+}
+
+// hostedZone is a hosted zone.
+type hostedZone struct {
+	ID              string `xml:"Id"`
+	Name            string `xml:"Name"`
+	CallerReference string `xml:"CallerReference"`
+	PrivateZone     bool   `xml:"Config>PrivateZone"`
+}
+
+// rrset is a resource record set.
+type rrset struct {
+	Name   string  `xml:"Name"`
+	Type   string  `xml:"Type"`
+	TTL    int64   `xml:"TTL"`
+	Values []value `xml:"ResourceRecords>ResourceRecord"`
+}
+
+// value is a resource record value.
+type value struct {
+	Value string `xml:"Value"`
+}
+
+// rrsetValues converts values to resource record values.
+func rrsetValues(values []string) []value {
+	var v []value
+	for _, s := range values {
+		v = append(v, value{s})
+	}
+	return v
+}
+
+// changeInfo is a change.
+type changeInfo struct {
+	ID          string `xml:"ChangeInfo>Id"`
+	Status      string `xml:"ChangeInfo>Status"`
+	SubmittedAt string `xml:"ChangeInfo>SubmittedAt"`
+}
+
+var zones = []hostedZone{
+	{ID: "/hostedzone/Z1", Name: "example.com.", CallerReference: "1"},
+	{ID: "/hostedzone/Z2", Name: "www.example.com.", CallerReference: "2", PrivateZone: true},
+}
+
+func (s *standIn) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	path := strings.TrimPrefix(req.URL.Path, "/2013-04-01/")
+	var v interface{}
+	switch {
+	case path == "hostedzonesbyname":
+		v = struct {
+			XMLName     xml.Name     `xml:"ListHostedZonesByNameResponse"`
+			HostedZones []hostedZone `xml:"HostedZones>HostedZone"`
+			IsTruncated bool         `xml:"IsTruncated"`
+			MaxItems    string       `xml:"MaxItems"`
+		}{HostedZones: zones, MaxItems: "100"}
+	case path == "hostedzone/Z1":
+		v = struct {
+			XMLName     xml.Name   `xml:"GetHostedZoneResponse"`
+			HostedZone  hostedZone `xml:"HostedZone"`
+			NameServers []string   `xml:"DelegationSet>NameServers>NameServer"`
+		}{HostedZone: zones[0], NameServers: []string{s.ns}}
+	case path == "hostedzone/Z1/rrset" && req.Method == "GET":
+		name, sets := req.URL.Query().Get("name"), []rrset{{Name: "zzz.example.com.", Type: "TXT", TTL: 300, Values: rrsetValues([]string{`"other"`})}}
+		if values, ok := s.rrsets[name]; ok {
+			sets = []rrset{{Name: name, Type: "TXT", TTL: 10, Values: rrsetValues(values)}}
+		}
+		v = struct {
+			XMLName            xml.Name `xml:"ListResourceRecordSetsResponse"`
+			ResourceRecordSets []rrset  `xml:"ResourceRecordSets>ResourceRecordSet"`
+			IsTruncated        bool     `xml:"IsTruncated"`
+			MaxItems           string   `xml:"MaxItems"`
+		}{ResourceRecordSets: sets, MaxItems: "1"}
+	case path == "hostedzone/Z1/rrset/" && req.Method == "POST":
+		var body struct {
+			Changes []struct {
+				Action string `xml:"Action"`
+				RRSet  rrset  `xml:"ResourceRecordSet"`
+			} `xml:"ChangeBatch>Changes>Change"`
+		}
+		if err := xml.NewDecoder(req.Body).Decode(&body); err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, change := range body.Changes {
+			switch change.Action {
+			case "UPSERT":
+				var values []string
+				for _, v := range change.RRSet.Values {
+					values = append(values, v.Value)
+				}
+				s.rrsets[change.RRSet.Name] = values
+			case "DELETE":
+				delete(s.rrsets, change.RRSet.Name)
+			}
+		}
+		s.changes++
+		v = struct {
+			XMLName xml.Name `xml:"ChangeResourceRecordSetsResponse"`
+			changeInfo
+		}{changeInfo: changeInfo{ID: fmt.Sprintf("/change/C%d", s.changes), Status: "PENDING", SubmittedAt: "2020-01-01T00:00:00Z"}}
+	case strings.HasPrefix(path, "change/") && s.failStatus:
+		http.Error(res, "change not found", http.StatusBadRequest)
+		return
+	case strings.HasPrefix(path, "change/"):
+		v = struct {
+			XMLName xml.Name `xml:"GetChangeResponse"`
+			changeInfo
+		}{changeInfo: changeInfo{ID: "/" + path, Status: "INSYNC", SubmittedAt: "2020-01-01T00:00:00Z"}}
+	default:
+		http.Error(res, "not found", http.StatusNotFound)
+		return
+	}
+
+	res.Header().Set("Content-Type", "text/xml")
+	if err := xml.NewEncoder(res).Encode(v); err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (s *standIn) serveDNS(w dns.ResponseWriter, req *dns.Msg) {
+	s.Lock()
+	defer s.Unlock()
+
+	res := new(dns.Msg)
+	res.SetReply(req)
+	res.Authoritative = true
+	q := req.Question[0]
+	if q.Qtype == dns.TypeSOA {
+		if strings.EqualFold(q.Name, "example.com.") {
+			res.Answer = append(res.Answer, &dns.SOA{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 10},
+				Ns:  "ns.example.com.", Mbox: "hostmaster.example.com.", Serial: 1,
+			})
+		}
+		w.WriteMsg(res)
+		return
+	}
+	for _, v := range s.rrsets[strings.ToLower(q.Name)] {
+		res.Answer = append(res.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 10},
+			Txt: []string{strings.Trim(v, `"`)},
+		})
+	}
+	w.WriteMsg(res)
+}
+
+func (s *standIn) values(name string) string {
+	s.Lock()
+	defer s.Unlock()
+	v := append([]string(nil), s.rrsets[name]...)
+	sort.Strings(v)
+	return strings.Join(v, " ")
+}
@@ -0,0 +1,59 @@
+package router
+
+import (
+	"errors"
+
+	"github.com/brankas/autocertdns"
+	"github.com/brankas/autocertdns/propagation"
+)
+
+// Option is the Router option type.
+type Option func(r *Router) error
+
+// Route is a Router option to send challenges for names in zone to the
+// provisioner.
+//
+// The zone "." matches all names, and can be used as a default route.
+func Route(zone string, p autocertdns.Provisioner) Option {
+	return func(r *Router) error {
+		if p == nil {
+			return errors.New("router missing provisioner")
+		}
+		zone = normalize(zone)
+		for _, rt := range r.routes {
+			if rt.zone == zone {
+				return errors.New("router duplicate zone " + zone)
+			}
+		}
+		r.routes = append(r.routes, route{
+			zone:        zone,
+			provisioner: autocertdns.AsProvisionerV2(p),
+		})
+		return nil
+	}
+}
+
+// Checker is a Router option to set the propagation checker used to wait for
+// records provisioned by provisioners that do not wait for propagation.
+func Checker(checker *propagation.Checker) Option {
+	return func(r *Router) error {
+		r.checker = checker
+		return nil
+	}
+}
+
+// Logf is a Router option to specify the logging function used.
+func Logf(f func(string, ...interface{})) Option {
+	return func(r *Router) error {
+		r.logf = f
+		return nil
+	}
+}
+
+// Errorf is a Router option to specify the error logging function used.
+func Errorf(f func(string, ...interface{})) Option {
+	return func(r *Router) error {
+		r.errf = f
+		return nil
+	}
+}
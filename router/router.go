@@ -0,0 +1,215 @@
+// Package router provides a composite autocertdns.Provisioner that routes
+// challenges to provisioners by zone.
+package router
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/brankas/autocertdns"
+	"github.com/brankas/autocertdns/propagation"
+	"github.com/brankas/autocertdns/provision"
+)
+
+// Error is a router error.
+type Error string
+
+// Error satisfies the error interface.
+func (err Error) Error() string {
+	return string(err)
+}
+
+// Error values.
+const (
+	// ErrNoRoute is the no route error, returned when no zone matches a
+	// challenge name.
+	ErrNoRoute Error = "no route"
+)
+
+// route is a zone and its provisioner.
+type route struct {
+	zone        string
+	provisioner autocertdns.ProvisionerV2
+}
+
+// record is a handle to a record provisioned by a routed provisioner.
+type record struct {
+	// route is the index of the route in the Router's routes.
+	route  int
+	record provision.Record
+}
+
+// Router is a composite provisioner that sends each challenge to the
+// provisioner registered for the longest zone suffix matching the challenge
+// name.
+type Router struct {
+	routes  []route
+	checker *propagation.Checker
+	logf    func(string, ...interface{})
+	errf    func(string, ...interface{})
+}
+
+// New creates a new provisioner router.
+func New(opts ...Option) (*Router, error) {
+	r := &Router{
+		logf: func(string, ...interface{}) {},
+	}
+
+	// apply opts
+	for _, o := range opts {
+		if err := o(r); err != nil {
+			return nil, err
+		}
+	}
+
+	// ensure errf is set
+	if r.errf == nil {
+		r.errf = func(s string, v ...interface{}) {
+			r.logf("ERROR: "+s, v...)
+		}
+	}
+
+	// sort by longest zone first
+	sort.SliceStable(r.routes, func(i, j int) bool {
+		return len(r.routes[i].zone) > len(r.routes[j].zone)
+	})
+
+	return r, nil
+}
+
+// Provision satisfies the autocertdns.Provisioner interface.
+func (r *Router) Provision(ctxt context.Context, typ, name, token string) error {
+	i, err := r.route(name)
+	if err != nil {
+		return err
+	}
+	return r.routes[i].provisioner.Provision(ctxt, typ, name, token)
+}
+
+// Unprovision satisfies the autocertdns.Provisioner interface.
+func (r *Router) Unprovision(ctxt context.Context, typ, name, token string) error {
+	i, err := r.route(name)
+	if err != nil {
+		return err
+	}
+	return r.routes[i].provisioner.Unprovision(ctxt, typ, name, token)
+}
+
+// ProvisionRecords satisfies the autocertdns.ProvisionerV2 interface.
+//
+// Challenges are grouped by route, and each group is provisioned as a single
+// batch. When the Router has a propagation checker, it waits for the
+// records of provisioners that do not wait for propagation themselves.
+func (r *Router) ProvisionRecords(ctxt context.Context, challenges []provision.Challenge) ([]provision.Record, error) {
+	// group by route, as provisioners may not be comparable
+	var routes []int
+	groups := make(map[int][]provision.Challenge)
+	for _, ch := range challenges {
+		i, err := r.route(ch.Name)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := groups[i]; !ok {
+			routes = append(routes, i)
+		}
+		groups[i] = append(groups[i], ch)
+	}
+
+	// provision
+	var records []provision.Record
+	for _, i := range routes {
+		recs, err := r.routes[i].provisioner.ProvisionRecords(ctxt, groups[i])
+		for _, rec := range recs {
+			records = append(records, &record{route: i, record: rec})
+		}
+		if err != nil {
+			return records, err
+		}
+	}
+
+	// wait for propagation
+	if r.checker != nil {
+		for _, i := range routes {
+			if r.routes[i].provisioner.WaitsForPropagation() {
+				continue
+			}
+			for _, ch := range groups[i] {
+				if err := r.checker.Wait(ctxt, ch.Name, ch.Value); err != nil {
+					return records, err
+				}
+			}
+		}
+	}
+
+	return records, nil
+}
+
+// UnprovisionRecords satisfies the autocertdns.ProvisionerV2 interface.
+//
+// Records are unprovisioned by the provisioner that provisioned them, and the
+// first error encountered is returned.
+func (r *Router) UnprovisionRecords(ctxt context.Context, records []provision.Record) error {
+	// group by route
+	var err error
+	var routes []int
+	groups := make(map[int][]provision.Record)
+	for _, rec := range records {
+		v, ok := rec.(*record)
+		if !ok || v.route < 0 || v.route >= len(r.routes) {
+			if err == nil {
+				err = provision.ErrUnknownRecord
+			}
+			continue
+		}
+		if _, ok := groups[v.route]; !ok {
+			routes = append(routes, v.route)
+		}
+		groups[v.route] = append(groups[v.route], v.record)
+	}
+
+	// unprovision
+	for _, i := range routes {
+		if e := r.routes[i].provisioner.UnprovisionRecords(ctxt, groups[i]); e != nil {
+			r.errf("could not unprovision records: %v", e)
+			if err == nil {
+				err = e
+			}
+		}
+	}
+	return err
+}
+
+// WaitsForPropagation satisfies the autocertdns.ProvisionerV2 interface.
+//
+// Returns true when the Router has a propagation checker, or when all routed
+// provisioners wait for propagation.
+func (r *Router) WaitsForPropagation() bool {
+	if r.checker != nil {
+		return true
+	}
+	for _, rt := range r.routes {
+		if !rt.provisioner.WaitsForPropagation() {
+			return false
+		}
+	}
+	return true
+}
+
+// route returns the index of the route with the longest zone matching name.
+func (r *Router) route(name string) (int, error) {
+	name = normalize(name)
+	for i, rt := range r.routes {
+		if rt.zone == "" || name == rt.zone || strings.HasSuffix(name, "."+rt.zone) {
+			r.logf("routing %s to zone %q", name, rt.zone)
+			return i, nil
+		}
+	}
+	return -1, fmt.Errorf("%s: %w", name, ErrNoRoute)
+}
+
+// normalize lowercases name and removes its trailing dot.
+func normalize(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
@@ -0,0 +1,142 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/brankas/autocertdns/provision"
+)
+
+func TestRoute(t *testing.T) {
+	a, b, def := new(provisioner), new(provisioner), new(provisioner)
+	r, err := New(
+		Route("example.com", a),
+		Route("sub.example.com.", b),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	challenges := []provision.Challenge{
+		{Name: "_acme-challenge.example.com.", Type: "TXT", Value: "a"},
+		{Name: "_acme-challenge.www.SUB.example.com", Type: "TXT", Value: "b"},
+		{Name: "_acme-challenge.sub.example.com", Type: "TXT", Value: "c"},
+	}
+	records, err := r.ProvisionRecords(context.Background(), challenges)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("expected 3 records, got: %d", len(records))
+	}
+	if v := a.values(); v != "a" {
+		t.Errorf("expected a, got: %q", v)
+	}
+	if v := b.values(); v != "bc" {
+		t.Errorf("expected bc, got: %q", v)
+	}
+
+	if err = r.UnprovisionRecords(context.Background(), records); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if v := a.values() + b.values(); v != "" {
+		t.Errorf("expected no values, got: %q", v)
+	}
+
+	// unmatched
+	_, err = r.ProvisionRecords(context.Background(), []provision.Challenge{
+		{Name: "_acme-challenge.example.org", Type: "TXT", Value: "d"},
+	})
+	if !errors.Is(err, ErrNoRoute) {
+		t.Errorf("expected ErrNoRoute, got: %v", err)
+	}
+	if err = r.Provision(context.Background(), "TXT", "_acme-challenge.notexample.com", "e"); !errors.Is(err, ErrNoRoute) {
+		t.Errorf("expected ErrNoRoute, got: %v", err)
+	}
+
+	// default route
+	if r, err = New(Route(".", def), Route("example.com", a)); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err = r.Provision(context.Background(), "TXT", "_acme-challenge.example.org", "f"); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if v := def.values(); v != "f" {
+		t.Errorf("expected f, got: %q", v)
+	}
+
+	// duplicate
+	if _, err = New(Route("example.com", a), Route("EXAMPLE.com.", b)); err == nil {
+		t.Errorf("expected error for duplicate zone")
+	}
+}
+
+func TestRouteNotComparable(t *testing.T) {
+	a, b := new(provisioner), new(provisioner)
+	r, err := New(
+		Route("example.com", funcProvisioner{a.Provision, a.Unprovision}),
+		Route("example.org", funcProvisioner{b.Provision, b.Unprovision}),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	records, err := r.ProvisionRecords(context.Background(), []provision.Challenge{
+		{Name: "_acme-challenge.example.com", Type: "TXT", Value: "a"},
+		{Name: "_acme-challenge.example.org", Type: "TXT", Value: "b"},
+		{Name: "_acme-challenge.www.example.com", Type: "TXT", Value: "c"},
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if v := a.values() + b.values(); v != "acb" {
+		t.Errorf("expected acb, got: %q", v)
+	}
+
+	if err = r.UnprovisionRecords(context.Background(), records); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if v := a.values() + b.values(); v != "" {
+		t.Errorf("expected no values, got: %q", v)
+	}
+}
+
+// funcProvisioner is a Provisioner value that is not comparable.
+type funcProvisioner []func(context.Context, string, string, string) error
+
+func (p funcProvisioner) Provision(ctxt context.Context, typ, name, token string) error {
+	return p[0](ctxt, typ, name, token)
+}
+
+func (p funcProvisioner) Unprovision(ctxt context.Context, typ, name, token string) error {
+	return p[1](ctxt, typ, name, token)
+}
+
+// provisioner is a Provisioner that stores values in memory.
+type provisioner struct {
+	v []string
+}
+
+func (p *provisioner) Provision(_ context.Context, _, _, token string) error {
+	p.v = append(p.v, token)
+	return nil
+}
+
+func (p *provisioner) Unprovision(_ context.Context, _, _, token string) error {
+	for i, v := range p.v {
+		if v == token {
+			p.v = append(p.v[:i], p.v[i+1:]...)
+			return nil
+		}
+	}
+	return errors.New("not found")
+}
+
+func (p *provisioner) values() string {
+	var s string
+	for _, v := range p.v {
+		s += v
+	}
+	return s
+}
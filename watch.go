@@ -0,0 +1,127 @@
+package autocertdns
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultWatchInterval is the default cache polling interval.
+	defaultWatchInterval = 30 * time.Second
+
+	// watchDelay is the delay after the last cache change before a reload is
+	// signaled, allowing a certificate and key being replaced in succession to
+	// be picked up together.
+	watchDelay = 1 * time.Second
+)
+
+// watch watches the cached certificate and key files for the Manager's domain,
+// returning a channel that receives a value after the files have been
+// changed.
+//
+// File system notifications are used where available, otherwise the files are
+// polled every WatchInterval.
+func (m *Manager) watch(ctxt context.Context) <-chan struct{} {
+	domain := strings.TrimSuffix(m.Domain, ".")
+	names := []string{domain + certSuffix, domain + keySuffix}
+
+	interval := m.WatchInterval
+	if interval == 0 {
+		interval = defaultWatchInterval
+	}
+
+	events := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case events <- struct{}{}:
+		default:
+		}
+	}
+
+	go func() {
+		err := watchNotify(ctxt, m.CacheDir, names, notify)
+		if err == nil {
+			return
+		}
+		m.log("polling %s for changes every %v: %v", m.CacheDir, interval, err)
+		watchPoll(ctxt, m.CacheDir, names, interval, notify)
+	}()
+
+	return debounce(ctxt, events, watchDelay)
+}
+
+// watchPoll polls the named files in dir every interval, calling notify when
+// the size or modification time of any of the files has changed.
+func watchPoll(ctxt context.Context, dir string, names []string, interval time.Duration, notify func()) {
+	snapshot := func() string {
+		var s []string
+		for _, name := range names {
+			fi, err := os.Stat(filepath.Join(dir, name))
+			if err != nil {
+				s = append(s, name+":")
+				continue
+			}
+			s = append(s, fmt.Sprintf("%s:%d:%d", name, fi.Size(), fi.ModTime().UnixNano()))
+		}
+		return strings.Join(s, ",")
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	prev := snapshot()
+	for {
+		select {
+		case <-ctxt.Done():
+			return
+		case <-t.C:
+			if cur := snapshot(); cur != prev {
+				prev = cur
+				notify()
+			}
+		}
+	}
+}
+
+// debounce returns a channel that receives a value once no events have been
+// received for the delay d.
+func debounce(ctxt context.Context, events <-chan struct{}, d time.Duration) <-chan struct{} {
+	out := make(chan struct{}, 1)
+	go func() {
+		for {
+			select {
+			case <-ctxt.Done():
+				return
+			case <-events:
+			}
+
+			// wait for events to settle
+			t := time.NewTimer(d)
+		settle:
+			for {
+				select {
+				case <-ctxt.Done():
+					t.Stop()
+					return
+				case <-events:
+					if !t.Stop() {
+						<-t.C
+					}
+					t.Reset(d)
+				case <-t.C:
+					break settle
+				}
+			}
+
+			select {
+			case out <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return out
+}
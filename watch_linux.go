@@ -0,0 +1,68 @@
+//go:build linux
+// +build linux
+
+package autocertdns
+
+import (
+	"context"
+	"os"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// watchNotify watches dir using inotify, calling notify when any of the named
+// files are created, written, moved or removed. Blocks until the context is
+// closed.
+func watchNotify(ctxt context.Context, dir string, names []string, notify func()) error {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return err
+	}
+	f := os.NewFile(uintptr(fd), "inotify")
+
+	const mask = unix.IN_CLOSE_WRITE | unix.IN_CREATE | unix.IN_DELETE | unix.IN_MOVED_FROM | unix.IN_MOVED_TO
+	if _, err = unix.InotifyAddWatch(fd, dir, mask); err != nil {
+		f.Close()
+		return err
+	}
+
+	// close on context done, unblocking read
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctxt.Done():
+		case <-done:
+		}
+		f.Close()
+	}()
+
+	buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+	for {
+		n, err := f.Read(buf)
+		if err != nil {
+			if ctxt.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		var changed bool
+		for i := 0; i+unix.SizeofInotifyEvent <= n; {
+			ev := (*unix.InotifyEvent)(unsafe.Pointer(&buf[i]))
+			start, end := i+unix.SizeofInotifyEvent, i+unix.SizeofInotifyEvent+int(ev.Len)
+			name := strings.TrimRight(string(buf[start:end]), "\x00")
+			for _, n := range names {
+				if name == n {
+					changed = true
+				}
+			}
+			i = end
+		}
+		if changed {
+			notify()
+		}
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package autocertdns
+
+import (
+	"context"
+	"errors"
+)
+
+// watchNotify is not supported on this platform, and always returns an error
+// causing the cache to be polled instead.
+func watchNotify(context.Context, string, []string, func()) error {
+	return errors.New("file system notifications not supported")
+}
@@ -0,0 +1,138 @@
+package webhookp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/brankas/autocertdns/propagation"
+)
+
+// Option is the Client option type.
+type Option func(c *Client) error
+
+// URL is a Client option to set the webhook URL.
+func URL(url string) Option {
+	return func(c *Client) error {
+		c.url = url
+		return nil
+	}
+}
+
+// Secret is a Client option to set the secret used to sign requests.
+func Secret(secret []byte) Option {
+	return func(c *Client) error {
+		c.secret = secret
+		return nil
+	}
+}
+
+// Header is a Client option to add a header sent with each request, such as
+// an Authorization header.
+func Header(key, value string) Option {
+	return func(c *Client) error {
+		c.header.Add(key, value)
+		return nil
+	}
+}
+
+// HTTPClient is a Client option to set the HTTP client used for requests.
+func HTTPClient(client *http.Client) Option {
+	return func(c *Client) error {
+		c.client = client
+		return nil
+	}
+}
+
+// TLSConfig is a Client option to set the TLS configuration of a new HTTP
+// client used for requests.
+func TLSConfig(config *tls.Config) Option {
+	return func(c *Client) error {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = config
+		c.client = &http.Client{Transport: transport}
+		return nil
+	}
+}
+
+// ClientCertificate is a Client option to authenticate with the client
+// certificate and key in the PEM encoded certFile and keyFile (mTLS), and
+// optionally verify the webhook server using the CA certificates in the PEM
+// encoded caFile.
+func ClientCertificate(certFile, keyFile, caFile string) Option {
+	return func(c *Client) error {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		config := &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}
+		if caFile != "" {
+			buf, err := ioutil.ReadFile(caFile)
+			if err != nil {
+				return err
+			}
+			config.RootCAs = x509.NewCertPool()
+			if !config.RootCAs.AppendCertsFromPEM(buf) {
+				return errors.New("webhookp invalid ca file")
+			}
+		}
+		return TLSConfig(config)(c)
+	}
+}
+
+// Retry is a Client option to set the number of attempts for each request,
+// and the delay before the first retry. The delay doubles after each retry.
+func Retry(attempts int, backoff time.Duration) Option {
+	return func(c *Client) error {
+		c.attempts, c.backoff = attempts, backoff
+		return nil
+	}
+}
+
+// Timeout is a Client option to set the timeout for each attempt.
+func Timeout(d time.Duration) Option {
+	return func(c *Client) error {
+		c.timeout = d
+		return nil
+	}
+}
+
+// HookWaits is a Client option to indicate that the webhook waits for records
+// to propagate before responding.
+func HookWaits() Option {
+	return func(c *Client) error {
+		c.propagates = true
+		return nil
+	}
+}
+
+// Checker is a Client option to set the propagation checker used to wait for
+// provisioned records to propagate.
+func Checker(checker *propagation.Checker) Option {
+	return func(c *Client) error {
+		c.checker = checker
+		return nil
+	}
+}
+
+// Logf is a Client option to specify the logging function used.
+func Logf(f func(string, ...interface{})) Option {
+	return func(c *Client) error {
+		c.logf = f
+		return nil
+	}
+}
+
+// Errorf is a Client option to specify the error logging function used.
+func Errorf(f func(string, ...interface{})) Option {
+	return func(c *Client) error {
+		c.errf = f
+		return nil
+	}
+}
@@ -0,0 +1,327 @@
+// Package webhookp provides a provisioner that sends present and cleanup
+// events to a HTTP webhook, and that satisfies autocertdns.Provisioner and
+// autocertdns.ProvisionerV2.
+//
+// Events are POSTed as JSON to the configured URL:
+//
+//	{
+//	  "action": "present",
+//	  "records": [
+//	    {
+//	      "type": "TXT",
+//	      "name": "_acme-challenge.example.com.",
+//	      "value": "...",
+//	      "domain": "example.com"
+//	    }
+//	  ]
+//	}
+//
+// When created with a secret, each request includes a timestamp in the
+// X-Autocertdns-Timestamp header, and a HMAC-SHA256 signature of the
+// timestamp and body in the X-Autocertdns-Signature header (see Sign and
+// Verify).
+//
+// Any 2xx response is a success. Requests failing with a network error, or a
+// 429 or 5xx response, are retried with backoff.
+package webhookp
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/brankas/autocertdns/propagation"
+	"github.com/brankas/autocertdns/provision"
+)
+
+const (
+	// allowedRecordType is the allowed record provisioning type.
+	allowedRecordType = "TXT"
+
+	// DefaultAttempts is the default number of attempts for each request.
+	DefaultAttempts = 3
+
+	// DefaultBackoff is the default delay before the first retry.
+	DefaultBackoff = time.Second
+
+	// DefaultTimeout is the default timeout for each attempt.
+	DefaultTimeout = 30 * time.Second
+)
+
+// Request headers.
+const (
+	TimestampHeader = "X-Autocertdns-Timestamp"
+	SignatureHeader = "X-Autocertdns-Signature"
+)
+
+// Actions sent to the webhook.
+const (
+	ActionPresent = "present"
+	ActionCleanup = "cleanup"
+)
+
+// Event is a webhook event.
+type Event struct {
+	Action  string        `json:"action"`
+	Records []EventRecord `json:"records"`
+}
+
+// EventRecord is a record in a webhook event.
+type EventRecord struct {
+	Type   string `json:"type"`
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Domain string `json:"domain,omitempty"`
+}
+
+// record is a handle to a provisioned record.
+type record struct {
+	EventRecord
+}
+
+// Client is a webhook provisioner client.
+type Client struct {
+	url        string
+	client     *http.Client
+	header     http.Header
+	secret     []byte
+	attempts   int
+	backoff    time.Duration
+	timeout    time.Duration
+	checker    *propagation.Checker
+	propagates bool
+	logf       func(string, ...interface{})
+	errf       func(string, ...interface{})
+}
+
+// New creates a new webhook provisioner client.
+func New(opts ...Option) (*Client, error) {
+	c := &Client{
+		header:   make(http.Header),
+		attempts: DefaultAttempts,
+		backoff:  DefaultBackoff,
+		timeout:  DefaultTimeout,
+		logf:     func(string, ...interface{}) {},
+	}
+
+	// apply opts
+	for _, o := range opts {
+		if err := o(c); err != nil {
+			return nil, err
+		}
+	}
+
+	// ensure errf is set
+	if c.errf == nil {
+		c.errf = func(s string, v ...interface{}) {
+			c.logf("ERROR: "+s, v...)
+		}
+	}
+
+	if c.url == "" {
+		return nil, errors.New("webhookp missing url")
+	}
+	if c.client == nil {
+		c.client = http.DefaultClient
+	}
+	if c.attempts < 1 {
+		c.attempts = 1
+	}
+
+	return c, nil
+}
+
+// Provision sends a present event for a DNS record of typ, for the specified
+// domain name and with the value in token.
+func (c *Client) Provision(ctxt context.Context, typ, name, token string) error {
+	_, err := c.ProvisionRecords(ctxt, []provision.Challenge{{Type: typ, Name: name, Value: token}})
+	return err
+}
+
+// Unprovision sends a cleanup event for the DNS record of typ, for the
+// specified domain name, and for the record with the specified token as the
+// value.
+func (c *Client) Unprovision(ctxt context.Context, typ, name, token string) error {
+	if typ != allowedRecordType {
+		return errors.New("only TXT records are supported")
+	}
+	return c.UnprovisionRecords(ctxt, []provision.Record{&record{EventRecord{
+		Type:  typ,
+		Name:  name,
+		Value: token,
+	}}})
+}
+
+// ProvisionRecords sends a single present event for the challenges.
+//
+// When the Client has a propagation checker, it waits for the records to
+// propagate.
+func (c *Client) ProvisionRecords(ctxt context.Context, challenges []provision.Challenge) ([]provision.Record, error) {
+	ev := Event{Action: ActionPresent}
+	for _, ch := range challenges {
+		if ch.Type != allowedRecordType {
+			return nil, errors.New("only TXT records are supported")
+		}
+		c.logf("provisioning (type: %s, name: %s, token: %s)", ch.Type, ch.Name, ch.Value)
+		ev.Records = append(ev.Records, EventRecord{
+			Type:   ch.Type,
+			Name:   ch.Name,
+			Value:  ch.Value,
+			Domain: ch.Domain,
+		})
+	}
+	if err := c.send(ctxt, ev); err != nil {
+		return nil, err
+	}
+
+	var records []provision.Record
+	for _, r := range ev.Records {
+		records = append(records, &record{r})
+	}
+
+	// wait for propagation
+	if c.checker != nil {
+		for _, ch := range challenges {
+			if err := c.checker.Wait(ctxt, ch.Name, ch.Value); err != nil {
+				return records, err
+			}
+		}
+	}
+
+	return records, nil
+}
+
+// UnprovisionRecords sends a single cleanup event for the records.
+func (c *Client) UnprovisionRecords(ctxt context.Context, records []provision.Record) error {
+	var err error
+	ev := Event{Action: ActionCleanup}
+	for _, rec := range records {
+		r, ok := rec.(*record)
+		if !ok {
+			if err == nil {
+				err = provision.ErrUnknownRecord
+			}
+			continue
+		}
+		c.logf("unprovisioning (type: %s, name: %s, token: %s)", r.Type, r.Name, r.Value)
+		ev.Records = append(ev.Records, r.EventRecord)
+	}
+	if len(ev.Records) == 0 {
+		return err
+	}
+	if e := c.send(ctxt, ev); e != nil && err == nil {
+		err = e
+	}
+	return err
+}
+
+// WaitsForPropagation satisfies the autocertdns.ProvisionerV2 interface.
+//
+// Returns true when the Client was created with a propagation checker, or
+// with the HookWaits option.
+func (c *Client) WaitsForPropagation() bool {
+	return c.checker != nil || c.propagates
+}
+
+// send sends the event, retrying with backoff.
+func (c *Client) send(ctxt context.Context, ev Event) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; ; i++ {
+		var retry bool
+		if retry, err = c.post(ctxt, body); err == nil {
+			return nil
+		}
+		if !retry || i >= c.attempts-1 {
+			c.errf("could not send %s event: %v", ev.Action, err)
+			return err
+		}
+
+		d := c.backoff << uint(i)
+		c.errf("could not send %s event, retrying in %v: %v", ev.Action, d, err)
+		select {
+		case <-ctxt.Done():
+			return err
+		case <-time.After(d):
+		}
+	}
+}
+
+// post posts the body to the webhook, returning whether the request can be
+// retried on error.
+func (c *Client) post(ctxt context.Context, body []byte) (bool, error) {
+	ctxt, cancel := context.WithTimeout(ctxt, c.timeout)
+	defer cancel()
+
+	req, err := http.NewRequest("POST", c.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(ctxt)
+	for k, v := range c.header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.secret != nil {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(TimestampHeader, ts)
+		req.Header.Set(SignatureHeader, Sign(c.secret, ts, body))
+	}
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer res.Body.Close()
+	msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+
+	switch {
+	case res.StatusCode >= 200 && res.StatusCode < 300:
+		return false, nil
+	case res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500:
+		return true, fmt.Errorf("webhook returned status %d: %s", res.StatusCode, bytes.TrimSpace(msg))
+	}
+	return false, fmt.Errorf("webhook returned status %d: %s", res.StatusCode, bytes.TrimSpace(msg))
+}
+
+// Sign returns the signature of the timestamp and body, as sent in the
+// X-Autocertdns-Signature header. The signature is "sha256=" followed by the
+// hex encoded HMAC-SHA256 of the timestamp, a ".", and the body.
+func Sign(secret []byte, timestamp string, body []byte) string {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(timestamp))
+	h.Write([]byte{'.'})
+	h.Write(body)
+	return "sha256=" + hex.EncodeToString(h.Sum(nil))
+}
+
+// Verify verifies the signature and timestamp headers of a webhook request
+// with the body, for use by webhook implementations. Requests with a timestamp
+// more than maxAge away from the current time are rejected.
+func Verify(secret []byte, header http.Header, body []byte, maxAge time.Duration) error {
+	ts := header.Get(TimestampHeader)
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return errors.New("invalid timestamp")
+	}
+	if d := time.Since(time.Unix(sec, 0)); d > maxAge || d < -maxAge {
+		return errors.New("timestamp out of range")
+	}
+	if !hmac.Equal([]byte(header.Get(SignatureHeader)), []byte(Sign(secret, ts, body))) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package webhookp
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/brankas/autocertdns/provision"
+)
+
+func TestWebhook(t *testing.T) {
+	secret := []byte("secret")
+
+	var mu sync.Mutex
+	var events []Event
+	var attempts int
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		if attempts == 1 {
+			http.Error(res, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		if err := Verify(secret, req.Header, body, time.Minute); err != nil {
+			http.Error(res, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		var ev Event
+		if err := json.Unmarshal(body, &ev); err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+		events = append(events, ev)
+	}))
+	defer s.Close()
+
+	c, err := New(URL(s.URL), Secret(secret), Retry(2, time.Millisecond))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	records, err := c.ProvisionRecords(context.Background(), []provision.Challenge{
+		{Domain: "example.com", Name: "_acme-challenge.example.com.", Type: "TXT", Value: "a"},
+		{Domain: "www.example.com", Name: "_acme-challenge.www.example.com.", Type: "TXT", Value: "b"},
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err = c.UnprovisionRecords(context.Background(), records); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if attempts != 3 {
+		t.Errorf("expected 3 attempts, got: %d", attempts)
+	}
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got: %d", len(events))
+	}
+	if events[0].Action != ActionPresent || len(events[0].Records) != 2 || events[0].Records[1].Value != "b" {
+		t.Errorf("unexpected present event: %+v", events[0])
+	}
+	if events[1].Action != ActionCleanup || len(events[1].Records) != 2 || events[1].Records[0].Domain != "example.com" {
+		t.Errorf("unexpected cleanup event: %+v", events[1])
+	}
+}
+
+func TestWebhookNotRetried(t *testing.T) {
+	var mu sync.Mutex
+	var attempts int
+	s := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		body, _ := ioutil.ReadAll(req.Body)
+		if err := Verify([]byte("secret"), req.Header, body, time.Minute); err != nil {
+			http.Error(res, err.Error(), http.StatusUnauthorized)
+		}
+	}))
+	defer s.Close()
+
+	c, err := New(URL(s.URL), Secret([]byte("other")), Retry(3, time.Millisecond))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err = c.Provision(context.Background(), "TXT", "_acme-challenge.example.com", "a"); err == nil {
+		t.Errorf("expected error")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if attempts != 1 {
+		t.Errorf("expected 1 attempt, got: %d", attempts)
+	}
+}
+
+func TestWebhookClientCertificate(t *testing.T) {
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if len(req.TLS.PeerCertificates) == 0 || req.TLS.PeerCertificates[0].Subject.CommonName != "client" {
+			http.Error(res, "forbidden", http.StatusForbidden)
+		}
+	}))
+	s.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	s.StartTLS()
+	defer s.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(s.Certificate())
+	c, err := New(URL(s.URL), TLSConfig(&tls.Config{
+		RootCAs:      roots,
+		Certificates: []tls.Certificate{clientCert(t)},
+	}))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err = c.Provision(context.Background(), "TXT", "_acme-challenge.example.com", "a"); err != nil {
+		t.Errorf("expected no error, got: %v", err)
+	}
+}
+
+// clientCert generates a self-signed client certificate.
+func clientCert(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
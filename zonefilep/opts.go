@@ -0,0 +1,91 @@
+package zonefilep
+
+import (
+	"time"
+
+	"github.com/brankas/autocertdns/propagation"
+)
+
+// Option is the Client option type.
+type Option func(c *Client) error
+
+// File is a Client option to set the path of the zone file.
+func File(file string) Option {
+	return func(c *Client) error {
+		c.file = file
+		return nil
+	}
+}
+
+// Origin is a Client option to set the zone origin, used for relative names
+// in the zone file.
+//
+// If not set, the zone file must set its origin with an $ORIGIN directive or
+// only use absolute names.
+func Origin(origin string) Option {
+	return func(c *Client) error {
+		c.origin = origin
+		return nil
+	}
+}
+
+// TTL is a Client option to set the TTL of provisioned records.
+func TTL(ttl int) Option {
+	return func(c *Client) error {
+		c.ttl = ttl
+		return nil
+	}
+}
+
+// Reload is a Client option to set the command run after the zone file has
+// been written, such as:
+//
+//	Reload("rndc", "reload", "example.com")
+func Reload(command ...string) Option {
+	return func(c *Client) error {
+		c.reload = command
+		return nil
+	}
+}
+
+// Timeout is a Client option to set the reload command timeout.
+func Timeout(d time.Duration) Option {
+	return func(c *Client) error {
+		c.timeout = d
+		return nil
+	}
+}
+
+// Checker is a Client option to set the propagation checker used to wait for
+// provisioned records to propagate to the zone's nameservers.
+func Checker(checker *propagation.Checker) Option {
+	return func(c *Client) error {
+		c.checker = checker
+		return nil
+	}
+}
+
+// PropagationWait is a Client option to wait up to d for provisioned records
+// to propagate to the zone's nameservers.
+func PropagationWait(d time.Duration) Option {
+	return func(c *Client) error {
+		c.propagationWait = d
+		return nil
+	}
+}
+
+// Logf is a Client option to specify the logging function used.
+func Logf(f func(string, ...interface{})) Option {
+	return func(c *Client) error {
+		c.logf = f
+		return nil
+	}
+}
+
+// Errorf is a Client option to specify the error logging function used.
+func Errorf(f func(string, ...interface{})) Option {
+	return func(c *Client) error {
+		c.errf = f
+		return nil
+	}
+}
@@ -0,0 +1,478 @@
+// Package zonefilep provides a provisioner for BIND-style zone files on disk
+// that satisfies autocertdns.Provisioner and autocertdns.ProvisionerV2.
+//
+// Records are added to, and removed from, the zone file as single lines, so
+// that comments, directives (such as $INCLUDE) and the formatting of the rest
+// of the file are kept. The SOA serial is bumped on every change, the file is
+// written atomically with its mode and owner kept, and a reload command (such
+// as rndc reload) is run.
+//
+// The SOA record must be in the zone file itself, and not in a file included
+// with $INCLUDE.
+package zonefilep
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/brankas/autocertdns/internal/atomicfile"
+	"github.com/brankas/autocertdns/propagation"
+	"github.com/brankas/autocertdns/provision"
+)
+
+const (
+	// allowedRecordType is the allowed record provisioning type.
+	allowedRecordType = "TXT"
+
+	// DefaultTTL is the default TTL of provisioned records.
+	DefaultTTL = 60
+
+	// DefaultTimeout is the default reload command timeout.
+	DefaultTimeout = 30 * time.Second
+
+	// marker is the comment appended to provisioned record lines.
+	marker = "; autocertdns"
+)
+
+// Client is a zone file provisioner.
+type Client struct {
+	file            string
+	origin          string
+	ttl             int
+	reload          []string
+	timeout         time.Duration
+	checker         *propagation.Checker
+	propagationWait time.Duration
+	now             func() time.Time
+	logf            func(string, ...interface{})
+	errf            func(string, ...interface{})
+
+	// mu serializes changes to the zone file.
+	mu sync.Mutex
+}
+
+// record is a handle to a provisioned record.
+type record struct {
+	name  string
+	value string
+}
+
+// New creates a zone file provisioner that can handle DNS provisioning
+// requests for use with the autocertdns.Manager.
+func New(opts ...Option) (*Client, error) {
+	var err error
+
+	c := &Client{
+		ttl:     DefaultTTL,
+		timeout: DefaultTimeout,
+		now:     time.Now,
+		logf:    func(string, ...interface{}) {},
+	}
+
+	// apply opts
+	for _, o := range opts {
+		if err = o(c); err != nil {
+			return nil, err
+		}
+	}
+
+	// ensure errf is set
+	if c.errf == nil {
+		c.errf = func(s string, v ...interface{}) {
+			c.logf("ERROR: "+s, v...)
+		}
+	}
+
+	if c.file == "" {
+		return nil, errors.New("zonefilep missing zone file")
+	}
+	if c.origin != "" {
+		c.origin = fqdn(c.origin)
+	}
+
+	// ensure the zone file can be parsed
+	buf, err := ioutil.ReadFile(c.file)
+	if err != nil {
+		return nil, err
+	}
+	soa, err := c.parse(buf)
+	if err != nil {
+		return nil, err
+	}
+	if c.origin == "" {
+		c.origin = soa.Hdr.Name
+	}
+
+	// create propagation checker
+	if c.checker == nil && c.propagationWait != 0 {
+		if c.checker, err = propagation.New(
+			propagation.Timeout(c.propagationWait),
+			propagation.Logf(c.logf),
+			propagation.Errorf(c.errf),
+		); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// Provision creates a DNS record of typ, for the specified domain name and
+// with the value in token.
+func (c *Client) Provision(ctxt context.Context, typ, name, token string) error {
+	_, err := c.ProvisionRecords(ctxt, []provision.Challenge{{Type: typ, Name: name, Value: token}})
+	return err
+}
+
+// Unprovision deletes the DNS record of typ, for the specified domain name,
+// and for the record with the specified token as the value.
+func (c *Client) Unprovision(ctxt context.Context, typ, name, token string) error {
+	if typ != allowedRecordType {
+		return errors.New("only TXT records are supported")
+	}
+	return c.UnprovisionRecords(ctxt, []provision.Record{&record{name: fqdn(name), value: token}})
+}
+
+// ProvisionRecords appends the records for the challenges to the zone file,
+// bumps the SOA serial and runs the reload command, once for all challenges.
+//
+// When the Client has a propagation checker, it waits for the records to
+// propagate.
+func (c *Client) ProvisionRecords(ctxt context.Context, challenges []provision.Challenge) ([]provision.Record, error) {
+	var records []*record
+	for _, ch := range challenges {
+		if ch.Type != allowedRecordType {
+			return nil, errors.New("only TXT records are supported")
+		}
+		r := &record{name: fqdn(ch.Name), value: ch.Value}
+		if !dns.IsSubDomain(c.origin, r.name) {
+			return nil, fmt.Errorf("%s is not in zone %s", r.name, c.origin)
+		}
+		c.logf("provisioning (type: %s, name: %s, token: %s)", allowedRecordType, r.name, r.value)
+		records = append(records, r)
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	res := make([]provision.Record, len(records))
+	for i, r := range records {
+		res[i] = r
+	}
+
+	// records written before a failed reload are returned for cleanup
+	if written, err := c.update(ctxt, records, nil); err != nil {
+		c.errf("unable to provision records in %s: %v", c.file, err)
+		if !written {
+			return nil, err
+		}
+		return res, err
+	}
+
+	// wait for propagation
+	if c.checker != nil {
+		for _, r := range records {
+			if err := c.checker.Wait(ctxt, r.name, r.value); err != nil {
+				return res, err
+			}
+		}
+	}
+
+	return res, nil
+}
+
+// UnprovisionRecords removes the lines of the provisioned records from the
+// zone file, bumps the SOA serial and runs the reload command.
+func (c *Client) UnprovisionRecords(ctxt context.Context, records []provision.Record) error {
+	var err error
+	var recs []*record
+	for _, rec := range records {
+		r, ok := rec.(*record)
+		if !ok {
+			if err == nil {
+				err = provision.ErrUnknownRecord
+			}
+			continue
+		}
+		c.logf("unprovisioning (type: %s, name: %s, token: %s)", allowedRecordType, r.name, r.value)
+		recs = append(recs, r)
+	}
+	if len(recs) == 0 {
+		return err
+	}
+
+	if _, e := c.update(ctxt, nil, recs); e != nil {
+		c.errf("unable to unprovision records in %s: %v", c.file, e)
+		if err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// WaitsForPropagation satisfies the autocertdns.ProvisionerV2 interface.
+//
+// Returns true when the Client was created with a propagation checker.
+func (c *Client) WaitsForPropagation() bool {
+	return c.checker != nil
+}
+
+// update adds and removes record lines in the zone file, bumps the SOA
+// serial, writes the file and runs the reload command, returning whether the
+// file was written.
+func (c *Client) update(ctxt context.Context, add, remove []*record) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fi, err := os.Stat(c.file)
+	if err != nil {
+		return false, err
+	}
+	buf, err := ioutil.ReadFile(c.file)
+	if err != nil {
+		return false, err
+	}
+	soa, err := c.parse(buf)
+	if err != nil {
+		return false, err
+	}
+
+	// remove lines
+	var lines [][]byte
+	var removed int
+	for _, line := range bytes.SplitAfter(buf, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		if containsRecord(remove, c.lineRecord(line)) {
+			removed++
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if len(add) == 0 && removed == 0 {
+		return false, nil
+	}
+
+	// add lines
+	if n := len(lines); n != 0 && !bytes.HasSuffix(lines[n-1], []byte("\n")) {
+		lines[n-1] = append(lines[n-1], '\n')
+	}
+	for _, r := range add {
+		line := fmt.Sprintf("%s\t%d\tIN\t%s\t%s\t%s\n", r.name, c.ttl, allowedRecordType, quote(r.value), marker)
+		lines = append(lines, []byte(line))
+	}
+	buf = bytes.Join(lines, nil)
+
+	// bump serial
+	serial := nextSerial(soa.Serial, c.now())
+	if buf, err = replaceSerial(buf, serial); err != nil {
+		return false, err
+	}
+	if soa, err = c.parse(buf); err != nil {
+		return false, err
+	}
+	if soa.Serial != serial {
+		return false, fmt.Errorf("unable to update SOA serial in %s", c.file)
+	}
+
+	// write, keeping the file's mode and owner
+	uid, gid := owner(fi)
+	if err = atomicfile.WriteFileOwner(c.file, buf, fi.Mode().Perm(), uid, gid); err != nil {
+		return false, err
+	}
+	c.logf("updated %s (serial: %d)", c.file, serial)
+
+	return true, c.runReload(ctxt)
+}
+
+// parse parses the zone file contents in buf, returning the zone's SOA.
+func (c *Client) parse(buf []byte) (*dns.SOA, error) {
+	zp := dns.NewZoneParser(bytes.NewReader(buf), c.origin, c.file)
+	zp.SetIncludeAllowed(true)
+	var soa *dns.SOA
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		if s, ok := rr.(*dns.SOA); ok && soa == nil {
+			soa = s
+		}
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	if soa == nil {
+		return nil, fmt.Errorf("%s has no SOA record", c.file)
+	}
+	if c.origin != "" && !strings.EqualFold(soa.Hdr.Name, c.origin) {
+		return nil, fmt.Errorf("%s SOA %s does not match origin %s", c.file, soa.Hdr.Name, c.origin)
+	}
+
+	// the serial is replaced in the file's contents, so the SOA cannot be in
+	// an included file
+	if _, err := replaceSerial(buf, soa.Serial); err != nil {
+		return nil, fmt.Errorf("%s: %v (SOA records in $INCLUDE files are not supported)", c.file, err)
+	}
+	return soa, nil
+}
+
+// lineRecord returns the record for a single line TXT record with an absolute
+// name, or nil.
+func (c *Client) lineRecord(line []byte) *record {
+	s := strings.TrimSpace(string(line))
+	if s == "" || s[0] == ';' || s[0] == '$' {
+		return nil
+	}
+	rr, err := dns.NewRR(s)
+	if err != nil || rr == nil {
+		return nil
+	}
+	txt, ok := rr.(*dns.TXT)
+	if !ok || !dns.IsFqdn(strings.Fields(s)[0]) {
+		return nil
+	}
+	return &record{name: txt.Hdr.Name, value: unescape(strings.Join(txt.Txt, ""))}
+}
+
+// runReload runs the reload command.
+func (c *Client) runReload(ctxt context.Context) error {
+	if len(c.reload) == 0 {
+		return nil
+	}
+
+	ctxt, cancel := context.WithTimeout(ctxt, c.timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctxt, c.reload[0], c.reload[1:]...)
+	out, err := cmd.CombinedOutput()
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if line != "" {
+			c.logf("%s: %s", c.reload[0], line)
+		}
+	}
+	switch {
+	case ctxt.Err() == context.DeadlineExceeded:
+		return fmt.Errorf("reload command %s timed out after %v", c.reload[0], c.timeout)
+	case err != nil:
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return fmt.Errorf("reload command %s exited with code %d", c.reload[0], exitErr.ExitCode())
+		}
+		return fmt.Errorf("reload command %s: %w", c.reload[0], err)
+	}
+	return nil
+}
+
+// containsRecord returns true when records contains r.
+func containsRecord(records []*record, r *record) bool {
+	if r == nil {
+		return false
+	}
+	for _, z := range records {
+		if strings.EqualFold(z.name, r.name) && z.value == r.value {
+			return true
+		}
+	}
+	return false
+}
+
+// nextSerial returns the serial following serial.
+//
+// Date based serials (YYYYMMDDnn) are moved to the current date when behind,
+// otherwise the serial is incremented.
+func nextSerial(serial uint32, now time.Time) uint32 {
+	if serial >= 1000000000 {
+		y, m, d := now.UTC().Date()
+		if date := uint32(y*1000000 + int(m)*10000 + d*100); date > serial {
+			return date
+		}
+	}
+	return serial + 1
+}
+
+// replaceSerial replaces the serial of the first SOA record in the zone file
+// contents in buf.
+func replaceSerial(buf []byte, serial uint32) ([]byte, error) {
+	// tokens following SOA are the mname, rname and serial
+	n := -1
+	for i := 0; i < len(buf); {
+		switch ch := buf[i]; {
+		case ch == ';':
+			for i < len(buf) && buf[i] != '\n' {
+				i++
+			}
+		case ch == '"':
+			for i++; i < len(buf) && buf[i] != '"'; i++ {
+				if buf[i] == '\\' {
+					i++
+				}
+			}
+			i++
+		case ch == ' ' || ch == '\t' || ch == '\r' || ch == '\n' || ch == '(' || ch == ')':
+			i++
+		default:
+			start := i
+			for i < len(buf) && !bytes.ContainsRune([]byte(" \t\r\n();\""), rune(buf[i])) {
+				i++
+			}
+			tok := buf[start:i]
+			switch {
+			case n == -1 && strings.EqualFold(string(tok), "SOA"):
+				n = 0
+			case n == 2:
+				if _, err := strconv.ParseUint(string(tok), 10, 32); err != nil {
+					return nil, fmt.Errorf("invalid SOA serial %q", tok)
+				}
+				s := strconv.FormatUint(uint64(serial), 10)
+				return append(append(append([]byte{}, buf[:start]...), s...), buf[i:]...), nil
+			case n >= 0:
+				n++
+			}
+		}
+	}
+	return nil, errors.New("unable to find SOA serial")
+}
+
+// quote quotes a TXT value.
+func quote(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+}
+
+// unescape unescapes a TXT value as parsed by the dns package.
+func unescape(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' || i == len(value)-1 {
+			b.WriteByte(value[i])
+			continue
+		}
+		i++
+		if i+2 < len(value) && isDigit(value[i]) && isDigit(value[i+1]) && isDigit(value[i+2]) {
+			n, _ := strconv.Atoi(value[i : i+3])
+			b.WriteByte(byte(n))
+			i += 2
+			continue
+		}
+		b.WriteByte(value[i])
+	}
+	return b.String()
+}
+
+// isDigit returns true when ch is a decimal digit.
+func isDigit(ch byte) bool {
+	return '0' <= ch && ch <= '9'
+}
+
+// fqdn returns name with a trailing dot.
+func fqdn(name string) string {
+	return strings.TrimSuffix(name, ".") + "."
+}
@@ -0,0 +1,199 @@
+package zonefilep
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/brankas/autocertdns/provision"
+)
+
+const testZone = `; example.com zone
+$ORIGIN example.com.
+$TTL 3600
+@	IN	SOA	ns1.example.com. hostmaster.example.com. (
+		2020010101 ; serial
+		3600       ; refresh
+		600        ; retry
+		86400      ; expire
+		60 )       ; minimum
+	IN	NS	ns1
+ns1	IN	A	192.0.2.1
+www	IN	TXT	"SOA 1 2 3" ; not the SOA
+$INCLUDE hosts.zone
+`
+
+func TestZoneFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zonefilep")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "example.com.zone")
+	if err = ioutil.WriteFile(file, []byte(testZone), 0644); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "hosts.zone"), []byte("mail IN A 192.0.2.2\n"), 0644); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	reloaded := filepath.Join(dir, "reloaded")
+
+	c, err := New(
+		File(file),
+		Reload("sh", "-c", "echo reloaded >> "+reloaded),
+		Logf(t.Logf),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	c.now = func() time.Time {
+		return time.Date(2021, 3, 4, 0, 0, 0, 0, time.UTC)
+	}
+
+	// provision
+	records, err := c.ProvisionRecords(context.Background(), []provision.Challenge{
+		{Name: "_acme-challenge.example.com", Type: "TXT", Value: "a"},
+		{Name: "_acme-challenge.www.example.com.", Type: "TXT", Value: `b"c`},
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err = c.Provision(context.Background(), "TXT", "_acme-challenge.example.org", "d"); err == nil {
+		t.Errorf("expected error for name outside zone")
+	}
+
+	buf := readFile(t, file)
+	if !strings.HasPrefix(buf, strings.Replace(testZone, "2020010101", "2021030400", 1)) {
+		t.Errorf("expected zone to be kept, got:\n%s", buf)
+	}
+	txt := zoneTXT(t, file)
+	if v := txt["_acme-challenge.example.com."]; v != "a" {
+		t.Errorf("expected a, got: %q", v)
+	}
+	if v := txt["_acme-challenge.www.example.com."]; v != `b"c` {
+		t.Errorf(`expected b"c, got: %q`, v)
+	}
+
+	// unprovision
+	if err = c.UnprovisionRecords(context.Background(), records); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if buf, exp := readFile(t, file), strings.Replace(testZone, "2020010101", "2021030401", 1); buf != exp {
+		t.Errorf("expected:\n%s\ngot:\n%s", exp, buf)
+	}
+
+	if buf, exp := readFile(t, reloaded), "reloaded\nreloaded\n"; buf != exp {
+		t.Errorf("expected %q, got: %q", exp, buf)
+	}
+
+	// failing reload
+	c.reload = []string{"false"}
+	records, err = c.ProvisionRecords(context.Background(), []provision.Challenge{
+		{Name: "_acme-challenge.example.com", Type: "TXT", Value: "e"},
+	})
+	if err == nil || !strings.Contains(err.Error(), "exited with code 1") {
+		t.Errorf("expected exit error, got: %v", err)
+	}
+	if len(records) != 1 {
+		t.Errorf("expected 1 record, got: %d", len(records))
+	}
+}
+
+func TestZoneFileOwner(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing file ownership requires root")
+	}
+	dir := t.TempDir()
+	file := filepath.Join(dir, "example.com.zone")
+	if err := ioutil.WriteFile(file, []byte(strings.Replace(testZone, "$INCLUDE hosts.zone\n", "", 1)), 0640); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err := os.Chown(file, 1234, 5678); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	c, err := New(File(file))
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err = c.Provision(context.Background(), "TXT", "_acme-challenge.example.com", "a"); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	fi, err := os.Stat(file)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if uid, gid := owner(fi); uid != 1234 || gid != 5678 {
+		t.Errorf("expected owner 1234:5678, got: %d:%d", uid, gid)
+	}
+	if m := fi.Mode().Perm(); m != 0640 {
+		t.Errorf("expected mode 0640, got: %o", m)
+	}
+}
+
+func TestIncludedSOA(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "example.com.zone")
+	if err := ioutil.WriteFile(file, []byte("$ORIGIN example.com.\n$INCLUDE soa.zone\nns1 IN A 192.0.2.1\n"), 0644); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	soa := "@ 3600 IN SOA ns1.example.com. hostmaster.example.com. 1 3600 600 86400 60\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "soa.zone"), []byte(soa), 0644); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if _, err := New(File(file)); err == nil || !strings.Contains(err.Error(), "$INCLUDE") {
+		t.Errorf("expected $INCLUDE error, got: %v", err)
+	}
+}
+
+func TestNextSerial(t *testing.T) {
+	now := time.Date(2021, 3, 4, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		serial, exp uint32
+	}{
+		{1, 2},
+		{2020010101, 2021030400},
+		{2021030400, 2021030401},
+		{2021030499, 2021030500},
+		{2030010100, 2030010101},
+	}
+	for i, test := range tests {
+		if serial := nextSerial(test.serial, now); serial != test.exp {
+			t.Errorf("test %d expected %d, got: %d", i, test.exp, serial)
+		}
+	}
+}
+
+// readFile reads the contents of file.
+func readFile(t *testing.T, file string) string {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	return string(buf)
+}
+
+// zoneTXT parses the zone file, returning the TXT values.
+func zoneTXT(t *testing.T, file string) map[string]string {
+	buf := readFile(t, file)
+	zp := dns.NewZoneParser(strings.NewReader(buf), "", file)
+	zp.SetIncludeAllowed(true)
+	txt := make(map[string]string)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		if r, ok := rr.(*dns.TXT); ok {
+			txt[r.Hdr.Name] = unescape(strings.Join(r.Txt, ""))
+		}
+	}
+	if err := zp.Err(); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	return txt
+}